@@ -1,17 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"embed"
 	"fmt"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/spf13/pflag"
 	"net/http"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/audit"
+	"tkestack.io/image-transfer/pkg/auth"
+	"tkestack.io/image-transfer/pkg/credentials"
 	tcr_image_transfer "tkestack.io/image-transfer/pkg/image-transfer"
 	"tkestack.io/image-transfer/pkg/image-transfer/options"
 	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/notify"
+	"tkestack.io/image-transfer/pkg/queue"
+	"tkestack.io/image-transfer/pkg/schedule"
 	"tkestack.io/image-transfer/pkg/utils"
 )
 
@@ -22,33 +33,190 @@ type Source map[string]configs.Security
 type Target map[string]configs.Security
 
 type ImageTransferRequest struct {
-	Source      Source            `json:"source"`
-	Target      Target            `json:"target"`
-	Images      map[string]string `json:"images"`
-	RoutineNums int               `json:"routine_nums"`
-	RetryNums   int               `json:"retry_nums"`
+	Source Source            `json:"source"`
+	Target Target            `json:"target"`
+	Images map[string]string `json:"images"`
+	// Credentials are the names of the stored credentials used besides Source and Target
+	Credentials []string `json:"credentials"`
+	// Priority orders the waiting transfers of the queue, higher first
+	Priority    int `json:"priority"`
+	RoutineNums int `json:"routine_nums"`
+	RetryNums   int `json:"retry_nums"`
 }
 
+var (
+	// serverFlags are apart from the global flags which the sync command is made of
+	serverFlags = pflag.NewFlagSet("image-transfer", pflag.ExitOnError)
+
+	usersFile       = serverFlags.String("usersFile", "", "users file of the web console, the users map to their bcrypt password hashes")
+	tokensFile      = serverFlags.String("tokensFile", "./tokens.yaml", "file where the API tokens are kept")
+	oidcConfig      = serverFlags.String("oidcConfigFile", "", "oidc config file to log in the web console by single sign-on")
+	policyFile      = serverFlags.String("policyFile", "", "policy file binding users and groups to roles, everyone is an admin without it")
+	credentialsFile = serverFlags.String("credentialsFile", "./credentials.yaml", "file where the registry credentials are kept, encrypted by the master key")
+	masterKeyFile   = serverFlags.String("masterKeyFile", "", "file holding the master key of the credentials store, read from $"+credentials.MasterKeyEnv+" if it is not given")
+	auditDir        = serverFlags.String("auditDir", "./audit", "directory of the audit trail, kept apart from the logs cleared by the web console")
+	auditMaxSize    = serverFlags.Int("auditMaxSize", 100, "size in megabytes an audit file is rotated at")
+	maxRunningJobs  = serverFlags.Int("maxRunningJobs", 2, "number of transfers the server runs at a time, the others wait in the queue")
+	maxWorkers      = serverFlags.Int("workers", 10, "number of images all the running transfers copy at a time")
+	notifiersFile   = serverFlags.String("notifiersFile", "", "notifiers file of the webhooks, slack and email told when a transfer job finishes")
+	syncsFile       = serverFlags.String("syncsFile", "./syncs.yaml", "file where the scheduled syncs are kept")
+	sessionTTL      = serverFlags.Duration("sessionTTL", 12*time.Hour, "how long a login session of the web console lasts")
+	hashPassword    = serverFlags.Bool("hashPassword", false, "read a password from stdin, print its bcrypt hash for the users file and exit")
+)
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	// image-transfer sync 以命令行方式迁移规则文件中的镜像，--watch 时作为守护进程持续同步
+	if len(os.Args) > 1 && os.Args[1] == "sync" {
+		cmd := tcr_image_transfer.NewSyncCommand("sync")
+		cmd.SetArgs(os.Args[2:])
+		if err := cmd.Execute(); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	serverFlags.AddFlagSet(pflag.CommandLine)
+	// nolint: errcheck
+	serverFlags.Parse(os.Args[1:])
+	log.InitLogger()
+	defer log.FlushLogger()
+
+	if *hashPassword {
+		printPasswordHash()
+		return
+	}
+
+	authenticator, err := newAuthenticator()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	credentialHandler, err := newCredentialHandler(authenticator.Policy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	auditLogger, err := audit.NewLogger(*auditDir, *auditMaxSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer auditLogger.Close()
+
+	jobQueue := queue.NewQueue(*maxRunningJobs, 100)
+	queueHandler := queue.NewHandler(jobQueue, authenticator.Policy)
+	workers := tcr_image_transfer.NewWorkerPool(*maxWorkers)
+
+	dispatcher, err := newDispatcher()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	jobQueue.OnFinish(dispatcher.OnFinish)
+
+	syncStore, err := schedule.NewStore(*syncsFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	scheduler := schedule.NewScheduler(syncStore, newSyncRunner(authenticator.Policy, credentialHandler, jobQueue, workers))
+	scheduler.Start()
+	defer scheduler.Stop()
+	syncHandler := schedule.NewHandler(scheduler, authenticator.Policy, credentialHandler)
+
 	r := gin.Default()
 
 	// 添加 CORS 中间件
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:  []string{"*"},
-		AllowMethods:  []string{"GET", "POST", "OPTIONS"},
-		AllowHeaders:  []string{"Origin", "Content-Type", "Accept"},
+		AllowMethods:  []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowHeaders:  []string{"Origin", "Content-Type", "Accept", "Authorization"},
 		ExposeHeaders: []string{"Content-Length"},
 		MaxAge:        12 * 3600,
 	}))
 
-	// 添加基本认证中间件
-	username := "admin"        // 替换为你的用户名
-	password := "RKO6G6VBH0R5" // 替换为你的密码
-	r.Use(utils.BasicAuth(username, password))
+	// 记录所有修改状态的请求，包括认证失败的请求
+	r.Use(auditLogger.Middleware())
+
+	// 登录页面及静态文件无需认证
+	r.GET("/login", func(c *gin.Context) {
+		data, err := staticFiles.ReadFile("static/login.html")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load login.html"})
+			return
+		}
+		c.Data(http.StatusOK, "text/html; charset=utf-8", data)
+	})
+	r.GET("/login/methods", authenticator.LoginMethodsHandler)
+	r.POST("/login", authenticator.LoginHandler)
+	r.POST("/logout", authenticator.LogoutHandler)
+	r.GET("/oidc/login", authenticator.OIDCLoginHandler)
+	r.GET("/oidc/callback", authenticator.OIDCCallbackHandler)
+
+	// 镜像仓库的推送事件由定时同步的 webhook 密钥认证
+	r.POST("/hooks/:name", syncHandler.HookHandler)
+
+	// 提供 CSS 文件
+	r.GET("/static/css/*filepath", func(c *gin.Context) {
+		filepath := c.Param("filepath")
+		data, err := staticFiles.ReadFile("static/css" + filepath) // 读取嵌入的 CSS 文件
+		if err != nil {
+			log.Errorf("Error reading CSS file: %v", err) // 打印具体错误
+			c.JSON(http.StatusNotFound, gin.H{"error": "CSS file not found"})
+			return
+		}
+		c.Data(http.StatusOK, "text/css; charset=utf-8", data)
+	})
+
+	// 提供 JS 文件
+	r.GET("/static/js/*filepath", func(c *gin.Context) {
+		filepath := c.Param("filepath")
+		data, err := staticFiles.ReadFile("static/js" + filepath) // 读取嵌入的 JS 文件
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "JS file not found"})
+			return
+		}
+		c.Data(http.StatusOK, "application/javascript; charset=utf-8", data)
+	})
+
+	// 以下接口需要登录会话、API token 或用户名密码认证
+	authorized := r.Group("/", authenticator.Middleware(), authenticator.RequireRole(auth.RoleViewer))
+
+	authorized.GET("/tokens", authenticator.ListTokensHandler)
+	authorized.POST("/tokens", authenticator.CreateTokenHandler)
+	authorized.DELETE("/tokens/:id", authenticator.RevokeTokenHandler)
+
+	authorized.GET("/audit", authenticator.RequireRole(auth.RoleAdmin), auditLogger.QueryHandler)
+
+	authorized.GET("/queue", queueHandler.StatusHandler)
+	authorized.GET("/jobs/:id", queueHandler.GetHandler)
+	authorized.GET("/jobs/:id/progress", queueHandler.ProgressHandler)
+	authorized.GET("/ws/jobs/:id/progress", queueHandler.ProgressWSHandler)
+	authorized.GET("/sse/jobs/:id/progress", queueHandler.ProgressSSEHandler)
+	authorized.DELETE("/jobs/:id", authenticator.RequireRole(auth.RoleOperator), queueHandler.CancelHandler)
+
+	authorized.POST("/notifiers/test", authenticator.RequireRole(auth.RoleAdmin), dispatcher.TestHandler)
 
-	r.POST("/image-transfer", func(c *gin.Context) {
+	authorized.GET("/syncs", syncHandler.ListHandler)
+	authorized.GET("/syncs/:name", syncHandler.GetHandler)
+	authorized.POST("/syncs", authenticator.RequireRole(auth.RoleOperator), syncHandler.CreateHandler)
+	authorized.PUT("/syncs/:name", authenticator.RequireRole(auth.RoleOperator), syncHandler.UpdateHandler)
+	authorized.POST("/syncs/:name/enable", authenticator.RequireRole(auth.RoleOperator), syncHandler.EnableHandler)
+	authorized.POST("/syncs/:name/disable", authenticator.RequireRole(auth.RoleOperator), syncHandler.DisableHandler)
+	authorized.POST("/syncs/:name/run", authenticator.RequireRole(auth.RoleOperator), syncHandler.RunHandler)
+	authorized.DELETE("/syncs/:name", authenticator.RequireRole(auth.RoleOperator), syncHandler.DeleteHandler)
+	authorized.POST("/syncs/:name/webhook", authenticator.RequireRole(auth.RoleOperator), syncHandler.CreateWebhookHandler)
+	authorized.DELETE("/syncs/:name/webhook", authenticator.RequireRole(auth.RoleOperator), syncHandler.DeleteWebhookHandler)
+
+	authorized.GET("/credentials", credentialHandler.ListHandler)
+	authorized.POST("/credentials", authenticator.RequireRole(auth.RoleOperator), credentialHandler.CreateHandler)
+	authorized.DELETE("/credentials/:name", authenticator.RequireRole(auth.RoleOperator), credentialHandler.DeleteHandler)
+
+	authorized.POST("/image-transfer", authenticator.RequireRole(auth.RoleOperator), func(c *gin.Context) {
 		var req ImageTransferRequest
 
 		if err := c.ShouldBindJSON(&req); err != nil {
@@ -56,14 +224,26 @@ func main() {
 			return
 		}
 
-		opts := options.NewClientOptions()
-		client, err := tcr_image_transfer.NewTransferClient(opts)
-		if err != nil {
-			log.Errorf("init Transfer Client error: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initialize transfer client"})
+		// 校验每个镜像的迁移源与目标是否在用户的权限范围内
+		identity := auth.CurrentIdentity(c)
+		if denied := authenticator.Policy.CheckImages(identity, req.Images); len(denied) > 0 {
+			for source, reason := range denied {
+				log.Warnf("transfer of %s denied: %s", source, reason)
+			}
+			c.JSON(http.StatusForbidden, gin.H{"error": "transfer of some images is not allowed", "denied": denied})
 			return
 		}
 
+		var resolver configs.SecurityResolver
+		if len(req.Credentials) > 0 {
+			selected, err := credentialHandler.Resolver(identity, req.Credentials)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			resolver = selected
+		}
+
 		merged := make(map[string]configs.Security)
 		for k, v := range req.Source {
 			merged[k] = v
@@ -72,31 +252,38 @@ func main() {
 			merged[k] = v
 		}
 
-		client.Config.ImageList = req.Images
-		client.Config.Security = merged
-		client.Config.FlagConf.Config.RoutineNums = 1
-		client.Config.FlagConf.Config.RetryNums = 1
-		if req.RoutineNums != 0 {
-			client.Config.FlagConf.Config.RoutineNums = req.RoutineNums
+		client, err := newTransferClient(req.Images, merged, resolver, req.RoutineNums, req.RetryNums, workers)
+		if err != nil {
+			log.Errorf("init Transfer Client error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to initialize transfer client"})
+			return
 		}
 
-		if req.RetryNums != 0 {
-			client.Config.FlagConf.Config.RetryNums = req.RetryNums
+		job, err := jobQueue.Submit(queue.Job{
+			User:     identity.Name,
+			Email:    identity.Email,
+			Priority: req.Priority,
+			Images:   len(req.Images),
+			Progress: client.Progress,
+		}, func(job *queue.Job) (*tcr_image_transfer.Summary, error) {
+			client.JobID = job.ID
+			err := client.Run()
+			summary := client.Summary()
+			return &summary, err
+		})
+		if err != nil {
+			log.Errorf("queue transfer error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue transfer"})
+			return
 		}
 
-		go func() {
-			if err := client.Run(); err != nil {
-				log.Error(fmt.Sprintf("Run failed:  %v\n", err.Error()))
-			} else {
-				log.Infof("Image transfer executed successfully")
-			}
-		}()
-
-		c.JSON(http.StatusOK, gin.H{"message": "Image transfer executed successfully"})
+		log.Info("Submit transfer", log.String(log.JobIDKey, job.ID), log.String(log.UserKey, identity.Name),
+			log.String("email", identity.Email), log.Int("images", len(req.Images)))
+		c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Image transfer queued as job %s", job.ID), "job": job})
 	})
 
 	// 设置路由以访问静态页面
-	r.GET("/", func(c *gin.Context) {
+	authorized.GET("/", func(c *gin.Context) {
 		data, err := staticFiles.ReadFile("static/index.html") // 读取嵌入的 HTML 文件
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load index.html"})
@@ -105,38 +292,197 @@ func main() {
 		c.Data(http.StatusOK, "text/html; charset=utf-8", data)
 	})
 
-	// 提供 CSS 文件
-	r.GET("/static/css/*filepath", func(c *gin.Context) {
-		filepath := c.Param("filepath")
-		data, err := staticFiles.ReadFile("static/css" + filepath) // 读取嵌入的 CSS 文件
+	// WebSocket 路由
+	authorized.GET("/ws/logs", utils.LogWSHandler)
+	authorized.GET("/sse/logs", utils.LogSSEHandler)
+
+	authorized.POST("/clear-log", authenticator.RequireRole(auth.RoleAdmin), utils.ClearLogHandler)
+
+	port := ":8080"
+	fmt.Printf("Starting server on %s\n", port)
+	if err := r.Run(port); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// newTransferClient creates a client transferring images, the routine and retry numbers
+// default to 1
+func newTransferClient(images map[string]string, security map[string]configs.Security, resolver configs.SecurityResolver,
+	routineNums, retryNums int, workers *tcr_image_transfer.WorkerPool) (*tcr_image_transfer.Client, error) {
+	opts := options.NewClientOptions()
+	opts.Config.RoutineNums = 1
+	opts.Config.RetryNums = 1
+	if routineNums != 0 {
+		opts.Config.RoutineNums = routineNums
+	}
+	if retryNums != 0 {
+		opts.Config.RetryNums = retryNums
+	}
+
+	// 每个任务使用独立的配置，避免并发运行的任务互相覆盖镜像列表与凭据
+	clientConfig, err := configs.NewConfigs(opts)
+	if err != nil {
+		return nil, err
+	}
+	clientConfig.ImageList = images
+	clientConfig.Security = security
+	clientConfig.Resolver = resolver
+
+	client := tcr_image_transfer.NewTransferClientWithConfigs(clientConfig)
+	client.Workers = workers
+	return client, nil
+}
+
+// newSyncRunner runs the syncs through the job queue as their owners
+func newSyncRunner(policy *auth.Policy, credentialHandler *credentials.Handler, jobQueue *queue.Queue,
+	workers *tcr_image_transfer.WorkerPool) schedule.RunFunc {
+	return func(definition schedule.Sync) error {
+		// 每次运行前按所有者当前的权限重新校验，权限或凭据可能已被收回
+		identity := definition.Identity()
+		if denied := policy.CheckImages(identity, definition.Images); len(denied) > 0 {
+			return fmt.Errorf("transfer of %d images is not allowed to %s", len(denied), identity.Name)
+		}
+		var resolver configs.SecurityResolver
+		if len(definition.Credentials) > 0 {
+			selected, err := credentialHandler.Resolver(identity, definition.Credentials)
+			if err != nil {
+				return err
+			}
+			resolver = selected
+		}
+
+		client, err := newTransferClient(definition.Images, nil, resolver, definition.RoutineNums, definition.RetryNums, workers)
 		if err != nil {
-			log.Errorf("Error reading CSS file: %v", err) // 打印具体错误
-			c.JSON(http.StatusNotFound, gin.H{"error": "CSS file not found"})
-			return
+			return err
 		}
-		c.Data(http.StatusOK, "text/css; charset=utf-8", data)
-	})
 
-	// 提供 JS 文件
-	r.GET("/static/js/*filepath", func(c *gin.Context) {
-		filepath := c.Param("filepath")
-		data, err := staticFiles.ReadFile("static/js" + filepath) // 读取嵌入的 JS 文件
+		job, err := jobQueue.Submit(queue.Job{
+			User:     identity.Name,
+			Email:    identity.Email,
+			Sync:     definition.Name,
+			Priority: definition.Priority,
+			Images:   len(definition.Images),
+			Progress: client.Progress,
+		}, func(job *queue.Job) (*tcr_image_transfer.Summary, error) {
+			client.JobID = job.ID
+			err := client.NormalTransfer(client.Config.ImageList, nil, nil, nil)
+			summary := client.Summary()
+			return &summary, err
+		})
 		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "JS file not found"})
-			return
+			return err
 		}
-		c.Data(http.StatusOK, "application/javascript; charset=utf-8", data)
-	})
 
-	// WebSocket 路由
-	r.GET("/ws/logs", utils.LogWSHandler)
+		finished, _ := jobQueue.Wait(job.ID)
+		switch finished.State {
+		case queue.StateSucceeded:
+			return nil
+		case queue.StateCancelled:
+			return fmt.Errorf("job %s was cancelled", job.ID)
+		default:
+			return fmt.Errorf("job %s %s: %s", job.ID, finished.State, finished.Error)
+		}
+	}
+}
 
-	r.POST("/clear-log", utils.ClearLogHandler)
+// newDispatcher loads the notifiers, there is none without notifiers file
+func newDispatcher() (*notify.Dispatcher, error) {
+	config := &notify.Config{}
+	if *notifiersFile != "" {
+		loaded, err := notify.LoadConfig(*notifiersFile)
+		if err != nil {
+			return nil, err
+		}
+		config = loaded
+	}
+	return notify.NewDispatcher(config)
+}
 
-	port := ":8080"
-	fmt.Printf("Starting server on %s\n", port)
-	if err := r.Run(port); err != nil {
+// newCredentialHandler opens the credentials store, it is disabled without a master key
+func newCredentialHandler(policy *auth.Policy) (*credentials.Handler, error) {
+	masterKey, err := credentials.LoadMasterKey(*masterKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if masterKey == "" {
+		fmt.Printf("No master key given, the credentials store is disabled\n")
+		return credentials.NewHandler(nil, policy), nil
+	}
+
+	store, err := credentials.NewStore(*credentialsFile, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewHandler(store, policy), nil
+}
+
+// newAuthenticator loads the users of the web console, a random admin password is generated
+// if neither a users file nor oidc is given
+func newAuthenticator() (*auth.Authenticator, error) {
+	var provider *auth.OIDCProvider
+	if *oidcConfig != "" {
+		config, err := auth.LoadOIDCConfig(*oidcConfig)
+		if err != nil {
+			return nil, err
+		}
+		if provider, err = auth.NewOIDCProvider(context.Background(), config); err != nil {
+			return nil, err
+		}
+	}
+
+	var users auth.Users
+	if *usersFile != "" {
+		var err error
+		if users, err = auth.LoadUsers(*usersFile); err != nil {
+			return nil, err
+		}
+	} else if provider == nil {
+		password, hash, err := randomPassword()
+		if err != nil {
+			return nil, err
+		}
+		users = auth.Users{"admin": auth.User{PasswordHash: hash}}
+		// 只打印到终端，不写入 web 界面可见的日志
+		fmt.Printf("No --usersFile given, login with the generated user admin / %s\n", password)
+	}
+
+	tokens, err := auth.NewTokenStore(*tokensFile)
+	if err != nil {
+		return nil, err
+	}
+	authenticator := auth.NewAuthenticator(users, tokens, auth.NewSessionStore(*sessionTTL), "/login")
+	authenticator.OIDC = provider
+
+	if *policyFile != "" {
+		if authenticator.Policy, err = auth.LoadPolicy(*policyFile); err != nil {
+			return nil, err
+		}
+	}
+	return authenticator, nil
+}
+
+func randomPassword() (string, string, error) {
+	password, err := auth.GeneratePassword()
+	if err != nil {
+		return "", "", err
+	}
+	hash, err := auth.HashPassword(password)
+	return password, hash, err
+}
+
+// printPasswordHash reads a password from stdin and prints its bcrypt hash
+func printPasswordHash() {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	hash, err := auth.HashPassword(strings.TrimRight(password, "\r\n"))
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
+	fmt.Println(hash)
 }
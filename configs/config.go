@@ -28,6 +28,7 @@ import (
 	"sync"
 	"tkestack.io/image-transfer/pkg/image-transfer/options"
 	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/transfer"
 )
 
 var (
@@ -49,7 +50,11 @@ type Configs struct {
 	Conf      *ini.File
 	Security  map[string]Security
 	ImageList map[string]string
-	Secret    map[string]Secret
+	// Rules keeps the options of the rules in the rule file by their sources
+	Rules  map[string]Rule
+	Secret map[string]Secret
+	// Resolver resolves the registries missing in Security, like the credentials stored by the server
+	Resolver SecurityResolver
 	//ConfMap       map[string]interface{}
 	//ConfMapString map[string]string
 }
@@ -61,6 +66,11 @@ type Security struct {
 	Insecure bool   `json:"insecure" yaml:"insecure"`
 }
 
+// SecurityResolver resolves the authentication information of a registry kept outside of Configs
+type SecurityResolver interface {
+	Resolve(registry string, namespace string) (Security, bool)
+}
+
 // Secret describes secret info for tencent cloud
 type Secret struct {
 	SecretID  string `json:"secretId" yaml:"secretId"`
@@ -76,48 +86,89 @@ func InitConfigs(opts *options.ClientOptions) (*Configs, error) {
 		instance.FlagConf = opts
 	})
 
-	if instance.FlagConf.Config.CCRToTCR == true {
-		if len(instance.FlagConf.Config.SecretFile) == 0 || len(instance.FlagConf.Config.SecurityFile) == 0 {
-			return nil, errors.New("no SecretFile or security file is provided, Exit")
-		} else if len(instance.FlagConf.Config.TCRName) == 0 {
-			return nil, errors.New("no tcr name is provided, Exit")
+	if err := instance.load(); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// NewConfigs creates a Configs apart from the global instance, so that the transfers of the
+// server running side by side do not share their image lists and securities
+func NewConfigs(opts *options.ClientOptions) (*Configs, error) {
+	c := &Configs{FlagConf: opts}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the image list, securities and secrets the flags refer to
+func (c *Configs) load() error {
+	if c.FlagConf.Config.CCRToTCR == true {
+		if len(c.FlagConf.Config.SecretFile) == 0 || len(c.FlagConf.Config.SecurityFile) == 0 {
+			return errors.New("no SecretFile or security file is provided, Exit")
+		} else if len(c.FlagConf.Config.TCRName) == 0 {
+			return errors.New("no tcr name is provided, Exit")
 		} else {
-			secret, err := instance.GetSecret()
+			secret, err := c.GetSecret()
 			if err != nil {
-				return nil, err
+				return err
 			}
-			instance.Secret = secret
-			securityList, err := instance.GetSecurity()
+			c.Secret = secret
+			securityList, err := c.GetSecurity()
 			if err != nil {
-				return nil, err
+				return err
 			}
-			instance.Security = securityList
+			c.Security = securityList
 		}
 	} else {
-		//if len(instance.FlagConf.Config.RuleFile) == 0 || len(instance.FlagConf.Config.SecurityFile) == 0 {
-		//	return nil, errors.New("no rule file or security file is provided, Exit")
+		//if len(c.FlagConf.Config.RuleFile) == 0 || len(c.FlagConf.Config.SecurityFile) == 0 {
+		//	return errors.New("no rule file or security file is provided, Exit")
 		//}
-		instance.ImageList = instance.GetImageList()
+		rules, err := c.GetRules()
+		if err != nil {
+			return err
+		}
+		c.Rules = rules
+		c.ImageList = c.GetImageList()
+
+		if len(c.FlagConf.Config.BundleIndexFile) != 0 {
+			imageList, err := c.GetBundleImageList()
+			if err != nil {
+				return err
+			}
+			c.ImageList = imageList
+		}
 
-		securityList, err := instance.GetSecurity()
+		securityList, err := c.GetSecurity()
 		if err != nil {
-			return nil, err
+			return err
 		}
-		instance.Security = securityList
+		c.Security = securityList
+
+	}
 
+	if err := c.flagTransferOptions().validate(); err != nil {
+		return err
+	}
+	// the options of a rule may conflict with the ones given by the flags
+	for source := range c.Rules {
+		if err := c.GetTransferOptions(source).validate(); err != nil {
+			return fmt.Errorf("rule %s: %v", source, err)
+		}
 	}
 
-	if instance.FlagConf.Config.RoutineNums > maxRoutineNums {
-		instance.FlagConf.Config.RoutineNums = maxRoutineNums
+	if c.FlagConf.Config.RoutineNums > maxRoutineNums {
+		c.FlagConf.Config.RoutineNums = maxRoutineNums
 	}
 
-	if instance.FlagConf.Config.QPS > maxRatelimit {
-		instance.FlagConf.Config.QPS = maxRatelimit
+	if c.FlagConf.Config.QPS > maxRatelimit {
+		c.FlagConf.Config.QPS = maxRatelimit
 	}
 
-	QPS = instance.FlagConf.Config.QPS
+	QPS = c.FlagConf.Config.QPS
 
-	return instance, nil
+	return nil
 }
 
 // GetConfigs get config of Configs instance
@@ -130,25 +181,103 @@ func GetConfigs() *Configs {
 
 // GetImageList get images list of configs instance
 func (c *Configs) GetImageList() map[string]string {
-	//var imageList map[string]string
-	//
-	//if err := openAndDecode(c.FlagConf.Config.RuleFile, &imageList); err != nil {
-	//	log.Errorf("decode config file %v error: %v", c.FlagConf.Config.RuleFile, err)
-	//	return nil
-	//}
+	// images list is given by the request in server mode, the rule file is only read from command line
+	if c.ImageList == nil && c.Rules != nil {
+		imageList := make(map[string]string, len(c.Rules))
+		for source, rule := range c.Rules {
+			imageList[source] = rule.Target
+		}
+		return imageList
+	}
 
 	return c.ImageList
 }
 
+// GetRules gets the rules of the rule file with their options
+func (c *Configs) GetRules() (map[string]Rule, error) {
+	if c.Rules == nil && len(c.FlagConf.Config.RuleFile) != 0 {
+		var rules map[string]Rule
+
+		if err := openAndDecode(c.FlagConf.Config.RuleFile, &rules); err != nil {
+			log.Errorf("decode config file %v error: %v", c.FlagConf.Config.RuleFile, err)
+			return nil, err
+		}
+		for source, rule := range rules {
+			if err := rule.validate(source); err != nil {
+				return nil, err
+			}
+		}
+		if err := validateMoves(rules); err != nil {
+			return nil, err
+		}
+		return rules, nil
+	}
+
+	return c.Rules, nil
+}
+
+// GetTransferOptions returns the transfer options of the rule of source, the options which the rule
+// does not set are given by the flags
+func (c *Configs) GetTransferOptions(source string) TransferOptions {
+	options := c.Rules[source].TransferOptions
+	if options.ManifestFormat == "" {
+		options.ManifestFormat = c.FlagConf.Config.ManifestFormat
+	}
+	if options.Compression == "" {
+		options.Compression = c.FlagConf.Config.Compression
+	}
+	if options.Platform == "" {
+		options.Platform = c.FlagConf.Config.Platform
+	}
+	return options
+}
+
+// flagTransferOptions returns the transfer options given by the flags
+func (c *Configs) flagTransferOptions() TransferOptions {
+	return TransferOptions{
+		ManifestFormat: c.FlagConf.Config.ManifestFormat,
+		Compression:    c.FlagConf.Config.Compression,
+		Platform:       c.FlagConf.Config.Platform,
+	}
+}
+
+// GetBundleImageList gets images list from the index file of an exported bundle, every image
+// inside the bundle is a source without target, so that it goes to the default registry
+func (c *Configs) GetBundleImageList() (map[string]string, error) {
+	indexPath := c.FlagConf.Config.BundleIndexFile
+
+	index, err := transfer.ReadBundleIndex(indexPath)
+	if err != nil {
+		log.Errorf("read bundle index file %v error: %v", indexPath, err)
+		return nil, err
+	}
+
+	location, err := transfer.BundleLocation(index.Transport, indexPath)
+	if err != nil {
+		log.Errorf("read bundle index file %v error: %v", indexPath, err)
+		return nil, err
+	}
+
+	imageList := make(map[string]string)
+	for _, image := range index.Images {
+		imageList[location+":"+image.Name] = ""
+	}
+
+	return imageList, nil
+}
+
 // GetSecurity gets the Security information in Config
 func (c *Configs) GetSecurity() (map[string]Security, error) {
-	//var securityList map[string]Security
-	//
-	//c.Security
-	//if err := openAndDecode(c.FlagConf.Config.SecurityFile, &securityList); err != nil {
-	//	log.Errorf("decode config file %v error: %v", c.FlagConf.Config.SecurityFile, err)
-	//	return securityList, err
-	//}
+	// security is given by the request in server mode, the security file is only read from command line
+	if c.Security == nil && len(c.FlagConf.Config.SecurityFile) != 0 {
+		var securityList map[string]Security
+
+		if err := openAndDecode(c.FlagConf.Config.SecurityFile, &securityList); err != nil {
+			log.Errorf("decode config file %v error: %v", c.FlagConf.Config.SecurityFile, err)
+			return securityList, err
+		}
+		return securityList, nil
+	}
 
 	return c.Security, nil
 }
@@ -162,8 +291,14 @@ func (c *Configs) GetSecuritySpecific(registry string, namespace string) (Securi
 	if moreSpecificAuth, exist := c.Security[registryAndNamespace]; exist {
 		return moreSpecificAuth, exist
 	}
-	auth, exist := c.Security[registry]
-	return auth, exist
+	if auth, exist := c.Security[registry]; exist {
+		return auth, exist
+	}
+
+	if c.Resolver != nil {
+		return c.Resolver.Resolve(registry, namespace)
+	}
+	return Security{}, false
 }
 
 // GetSecret get secret from secret file
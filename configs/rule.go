@@ -0,0 +1,199 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package configs
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"tkestack.io/image-transfer/pkg/transfer"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// DefaultPruneMaxDeletions limits the tags pruned from the target of a rule which has no limit
+const DefaultPruneMaxDeletions = 10
+
+// Rule is a rule of the rule file, it is written either as the target url or as a mapping of the
+// target url and the options of the rule
+type Rule struct {
+	Target string       `json:"target" yaml:"target"`
+	Prune  PruneOptions `json:"prune" yaml:"prune"`
+	// Move deletes the source tags of the rule once they are transferred
+	Move bool `json:"move" yaml:"move"`
+
+	TransferOptions `yaml:",inline"`
+}
+
+// TransferOptions are the options of a rule applied to every image it transfers
+type TransferOptions struct {
+	// ManifestFormat converts the manifests to schema2 or oci, they are kept as they are if it is empty
+	ManifestFormat string `json:"manifestFormat" yaml:"manifestFormat"`
+	// Compression recompresses the layers with gzip or zstd, they are kept as they are if it is empty
+	Compression string `json:"compression" yaml:"compression"`
+	// Platform chooses the image of a manifest list for the targets which can not store manifest
+	// lists, like docker-archive, it is written as os/arch[/variant] and is the host platform if
+	// it is empty
+	Platform string `json:"platform" yaml:"platform"`
+}
+
+// PruneOptions deletes the tags of the target which no longer exist in the source
+type PruneOptions struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// MaxDeletions refuses to prune the target if more tags are to be deleted than it
+	MaxDeletions int `json:"maxDeletions" yaml:"maxDeletions"`
+	// DryRun lists the tags to be deleted without deleting them
+	DryRun bool `json:"dryRun" yaml:"dryRun"`
+}
+
+// UnmarshalYAML decodes a rule written as the target url or as a mapping
+func (r *Rule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var target string
+	if err := unmarshal(&target); err == nil {
+		r.Target = target
+		return nil
+	}
+
+	type plain Rule
+	return unmarshal((*plain)(r))
+}
+
+// GetMaxDeletions returns the limit of the tags pruned from the target
+func (p PruneOptions) GetMaxDeletions() int {
+	if p.MaxDeletions <= 0 {
+		return DefaultPruneMaxDeletions
+	}
+	return p.MaxDeletions
+}
+
+// validate checks the transfer options
+func (o TransferOptions) validate() error {
+	switch o.ManifestFormat {
+	case "", transfer.ManifestFormatSchema2, transfer.ManifestFormatOCI:
+	default:
+		return fmt.Errorf("unknown manifest format %q, it should be %s or %s", o.ManifestFormat,
+			transfer.ManifestFormatSchema2, transfer.ManifestFormatOCI)
+	}
+	switch o.Compression {
+	case "", transfer.CompressionGzip, transfer.CompressionZstd:
+	default:
+		return fmt.Errorf("unknown compression %q, it should be %s or %s", o.Compression,
+			transfer.CompressionGzip, transfer.CompressionZstd)
+	}
+	// docker manifests can not describe zstd layers
+	if o.Compression == transfer.CompressionZstd && o.ManifestFormat == transfer.ManifestFormatSchema2 {
+		return fmt.Errorf("compression %s needs manifest format %s", o.Compression, transfer.ManifestFormatOCI)
+	}
+	if _, err := transfer.ParsePlatform(o.Platform); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validate checks the options of the rule for source
+func (r Rule) validate(source string) error {
+	if err := r.TransferOptions.validate(); err != nil {
+		return fmt.Errorf("rule %s: %v", source, err)
+	}
+	if r.Move && (utils.IsArchiveURL(source) || utils.IsArchiveURL(r.Target)) {
+		return fmt.Errorf("move of rule %s requires a registry source and target", source)
+	}
+	if err := r.validateWildcard(source); err != nil {
+		return err
+	}
+	if !r.Prune.Enabled {
+		return nil
+	}
+
+	sourceURL, err := utils.NewRepoURL(source)
+	if err != nil {
+		return fmt.Errorf("url %s format error: %v", source, err)
+	}
+	// the tags to delete are the ones of the target repository missing in the source repository
+	if sourceURL.GetTag() != "" {
+		return fmt.Errorf("prune of rule %s requires a source without tag", source)
+	}
+	if utils.IsTargetTemplate(r.Target) || utils.IsArchiveURL(r.Target) {
+		return fmt.Errorf("prune of rule %s requires a registry target without template", source)
+	}
+	if r.Target != "" {
+		targetURL, err := utils.NewRepoURL(r.Target)
+		if err != nil {
+			return fmt.Errorf("url %s format error: %v", r.Target, err)
+		}
+		if targetURL.GetTag() != "" {
+			return fmt.Errorf("prune of rule %s requires a target without tag", source)
+		}
+	}
+	return nil
+}
+
+// validateWildcard checks the rule of a wildcard source, every repository it matches is copied to
+// its own target, which is given by a template or the default registry
+func (r Rule) validateWildcard(source string) error {
+	if !utils.IsWildcardSource(source) {
+		if utils.IsArchiveURL(source) && strings.ContainsAny(source, "*?[") {
+			return fmt.Errorf("wildcard source %s must be a registry repository", source)
+		}
+		return nil
+	}
+	sourceURL, err := utils.NewRepoURL(source)
+	if err != nil {
+		return fmt.Errorf("url %s format error: %v", source, err)
+	}
+	if strings.ContainsAny(sourceURL.GetRegistry(), "*?[") {
+		return fmt.Errorf("wildcard source %s must name its registry", source)
+	}
+	if _, err := path.Match(sourceURL.GetRepoWithNamespace(), ""); err != nil {
+		return fmt.Errorf("wildcard source %s: %v", source, err)
+	}
+	if r.Target != "" && !utils.IsTargetTemplate(r.Target) {
+		return fmt.Errorf("wildcard source %s requires a target template or no target", source)
+	}
+	if r.Move || r.Prune.Enabled {
+		return fmt.Errorf("move and prune of rule %s do not support a wildcard source", source)
+	}
+	return nil
+}
+
+// validateMoves checks that the source repositories of the moved rules are not copied by other
+// rules, which would find the source deleted
+func validateMoves(rules map[string]Rule) error {
+	repositories := map[string][]string{}
+	for source := range rules {
+		sourceURL, err := utils.NewRepoURL(source)
+		if err != nil {
+			return fmt.Errorf("url %s format error: %v", source, err)
+		}
+		repository := sourceURL.GetURLWithoutTag()
+		repositories[repository] = append(repositories[repository], source)
+	}
+
+	for source, rule := range rules {
+		if !rule.Move {
+			continue
+		}
+		sourceURL, _ := utils.NewRepoURL(source)
+		if sources := repositories[sourceURL.GetURLWithoutTag()]; len(sources) > 1 {
+			sort.Strings(sources)
+			return fmt.Errorf("move of rule %s requires no other rule of the same source repository: %v", source, sources)
+		}
+	}
+	return nil
+}
@@ -12,6 +12,7 @@ require (
 	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/gorilla/websocket v1.4.2
 	github.com/opencontainers/go-digest v1.0.0
+	github.com/opencontainers/image-spec v1.0.2-0.20190823105129-775207bd45b6
 	github.com/pkg/errors v0.9.1
 	github.com/skipor/goenv v0.0.0-20170219222015-cf3a15e6b664
 	github.com/spf13/cobra v1.1.3
@@ -19,6 +20,7 @@ require (
 	github.com/tencentcloud/tencentcloud-sdk-go v1.0.62
 	go.uber.org/ratelimit v0.1.0
 	go.uber.org/zap v1.10.0
+	golang.org/x/crypto v0.23.0
 	gopkg.in/ini.v1 v1.51.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	gopkg.in/yaml.v2 v2.4.0
@@ -80,7 +80,7 @@ func (ai *CCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
 	secretID, secretKey, err := GetCcrSecret(secret)
 
 	if err != nil {
-		log.Errorf("GetCcrSecret error: ", err)
+		log.Errorf("GetCcrSecret error: %s", err)
 		return nsList, err
 	}
 
@@ -91,7 +91,7 @@ func (ai *CCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
 	for {
 		resp, err := ai.DescribeNamespacePersonal(secretID, secretKey, region, offset, limit)
 		if err != nil {
-			log.Errorf("GetAllNamespaceByName error, ", err)
+			log.Errorf("GetAllNamespaceByName error, %s", err)
 			return nsList, err
 		}
 		namespaceCount := *resp.Response.Data.NamespaceCount
@@ -248,6 +248,33 @@ func (ai *CCRAPIClient) DescribeImagePersonal(secretID, secretKey,
 
 }
 
+// DeleteImagePersonal is ccr api DeleteImagePersonal, it deletes a tag of a repository
+func (ai *CCRAPIClient) DeleteImagePersonal(secretID, secretKey, region, repoName, tag string) error {
+
+	credential := common.NewCredential(
+		secretID,
+		secretKey,
+	)
+	cpf := profile.NewClientProfile()
+	cpf.HttpProfile.Endpoint = "tcr.tencentcloudapi.com"
+	client, _ := tcr.NewClient(credential, region, cpf)
+
+	request := tcr.NewDeleteImagePersonalRequest()
+
+	request.RepoName = common.StringPtr(repoName)
+	request.Tag = common.StringPtr(tag)
+
+	_, err := client.DeleteImagePersonal(request)
+
+	if err != nil {
+		log.Errorf("An error has returned: %s", err)
+		return err
+	}
+
+	return nil
+
+}
+
 // DescribeNamespacePersonal is ccr api DescribeNamespacePersonal
 func (ai *CCRAPIClient) DescribeNamespacePersonal(secretID, secretKey,
 	region string, offset, limit int64) (*tcr.DescribeNamespacePersonalResponse, error) {
@@ -52,7 +52,7 @@ func (ai *TCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
 	secretID, secretKey, err := GetTcrSecret(secret)
 
 	if err != nil {
-		log.Errorf("GetTcrSecret error: ", err)
+		log.Errorf("GetTcrSecret error: %s", err)
 		return nsList, tcrID, err
 	}
 
@@ -60,7 +60,7 @@ func (ai *TCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
 	filterValues := []string{tcrName}
 	resp, err := ai.DescribeInstances(secretID, secretKey, region, 0, 100, "RegistryName", filterValues)
 	if err != nil {
-		log.Errorf("DescribeInstances error, ", err)
+		log.Errorf("DescribeInstances error, %s", err)
 		return nsList, tcrID, err
 	}
 
@@ -74,7 +74,7 @@ func (ai *TCRAPIClient) GetAllNamespaceByName(secret map[string]configs.Secret,
 	for {
 		resp, err := ai.DescribeNamespaces(secretID, secretKey, region, offset, limit, tcrID)
 		if err != nil {
-			log.Errorf("DescribeNamespaces error, ", err)
+			log.Errorf("DescribeNamespaces error, %s", err)
 			return nsList, tcrID, err
 		}
 		log.Debugf("tcr namespace offset %d limit %d resp is %s", offset, limit, resp.ToJsonString())
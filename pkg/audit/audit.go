@@ -0,0 +1,179 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// FileName is the file the audit records are appended to, rotated files are named like
+// audit-2006-01-02T15-04-05.000.jsonl beside it
+const FileName = "audit.jsonl"
+
+// Record is an entry of the audit trail
+type Record struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user,omitempty"`
+	Email    string    `json:"email,omitempty"`
+	ClientIP string    `json:"clientIP,omitempty"`
+	// Action is the method and route of the call, like POST /image-transfer
+	Action string `json:"action"`
+	Path   string `json:"path,omitempty"`
+	// Request is the body of the call with the secrets redacted
+	Request json.RawMessage `json:"request,omitempty"`
+	Status  int             `json:"status,omitempty"`
+	// Outcome is success or failure
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+const (
+	// OutcomeSuccess marks a call that succeeded
+	OutcomeSuccess = "success"
+	// OutcomeFailure marks a call that failed or was denied
+	OutcomeFailure = "failure"
+)
+
+// Logger appends the audit records to JSONL files in a directory, the records are never
+// deleted by the server, rotated files are kept until they are removed by hand
+type Logger struct {
+	dir    string
+	lock   sync.Mutex
+	writer *lumberjack.Logger
+}
+
+// NewLogger creates a Logger writing to dir, the file is rotated when it reaches maxSize megabytes
+func NewLogger(dir string, maxSize int) (*Logger, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Logger{
+		dir: dir,
+		writer: &lumberjack.Logger{
+			Filename: filepath.Join(dir, FileName),
+			MaxSize:  maxSize,
+		},
+	}, nil
+}
+
+// Record appends record to the audit trail
+func (l *Logger) Record(record Record) error {
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, err = l.writer.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the current audit file
+func (l *Logger) Close() error {
+	return l.writer.Close()
+}
+
+// Filter selects audit records, the zero value selects all
+type Filter struct {
+	User   string
+	Action string
+	Since  time.Time
+	Limit  int
+}
+
+func (f *Filter) match(record *Record) bool {
+	if f.User != "" && record.User != f.User {
+		return false
+	}
+	if f.Action != "" && !strings.Contains(record.Action, f.Action) {
+		return false
+	}
+	return f.Since.IsZero() || !record.Time.Before(f.Since)
+}
+
+// Query returns the records matching filter, newest first
+func (l *Logger) Query(filter Filter) ([]Record, error) {
+	files, err := filepath.Glob(filepath.Join(l.dir, "audit*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	// the current file is the newest, the rotated files sort by their timestamps
+	current := filepath.Join(l.dir, FileName)
+	sort.Slice(files, func(i, j int) bool {
+		if files[i] == current || files[j] == current {
+			return files[i] == current
+		}
+		return files[i] > files[j]
+	})
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	records := []Record{}
+	for _, file := range files {
+		fileRecords, err := readRecords(file, &filter)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(fileRecords) - 1; i >= 0; i-- {
+			records = append(records, fileRecords[i])
+			if filter.Limit > 0 && len(records) >= filter.Limit {
+				return records, nil
+			}
+		}
+	}
+	return records, nil
+}
+
+// readRecords reads the records of an audit file matching filter, oldest first
+func readRecords(file string, filter *Filter) ([]Record, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		if filter.match(&record) {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,196 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"tkestack.io/image-transfer/pkg/auth"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+const (
+	// maxRequestSize is the largest request body kept in a record
+	maxRequestSize = 64 * 1024
+	// maxErrorSize is the largest error response parsed for the error message
+	maxErrorSize = 4 * 1024
+	redacted     = "***"
+)
+
+// sensitiveKeys are the fields of a request body that never go to the audit trail, matched
+// case-insensitively
+var sensitiveKeys = []string{"password", "secret", "clientsecret", "secretkey", "token", "authorization"}
+
+// Middleware records every call that changes state, that is any method but GET, HEAD and OPTIONS.
+// It runs before the authentication so that the denied calls are recorded too.
+func (l *Logger) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = ioutil.ReadAll(c.Request.Body)
+			c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		writer := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		action := c.FullPath()
+		if action == "" {
+			action = c.Request.URL.Path
+		}
+		identity := auth.CurrentIdentity(c)
+		record := Record{
+			User:     identity.Name,
+			Email:    identity.Email,
+			ClientIP: c.ClientIP(),
+			Action:   c.Request.Method + " " + action,
+			Path:     c.Request.URL.Path,
+			Request:  Redact(body),
+			Status:   writer.Status(),
+			Outcome:  OutcomeSuccess,
+		}
+		if record.Status >= http.StatusBadRequest {
+			record.Outcome = OutcomeFailure
+			record.Error = errorMessage(writer.body.Bytes())
+		}
+
+		if err := l.Record(record); err != nil {
+			log.Errorf("write audit record of %s error: %v", record.Action, err)
+		}
+	}
+}
+
+// QueryHandler serves GET /audit, the records can be filtered by the query parameters user,
+// action, since (RFC3339) and limit
+func (l *Logger) QueryHandler(c *gin.Context) {
+	filter := Filter{
+		User:   c.Query("user"),
+		Action: c.Query("action"),
+		Limit:  100,
+	}
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since should be a RFC3339 time"})
+			return
+		}
+		filter.Since = t
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit should be a non-negative number"})
+			return
+		}
+		filter.Limit = n
+	}
+
+	records, err := l.Query(filter)
+	if err != nil {
+		log.Errorf("query audit records error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query audit records"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"records": records})
+}
+
+// Redact returns a JSON request body with the values of its sensitive fields masked, a body
+// that is not JSON is not kept
+func Redact(body []byte) json.RawMessage {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	if len(body) > maxRequestSize {
+		return json.RawMessage(`"request body too large to record"`)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return json.RawMessage(`"request body is not json"`)
+	}
+	redacted, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return nil
+	}
+	return redacted
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if isSensitive(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return value
+}
+
+func isSensitive(key string) bool {
+	return utils.IsContain(sensitiveKeys, strings.ToLower(key))
+}
+
+// errorMessage gets the error field of a JSON error response
+func errorMessage(body []byte) string {
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return ""
+	}
+	return resp.Error
+}
+
+// responseRecorder keeps the beginning of the response to get the error message of a failed call
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	if room := maxErrorSize - w.body.Len(); room > 0 {
+		if len(data) < room {
+			room = len(data)
+		}
+		w.body.Write(data[:room])
+	}
+	return w.ResponseWriter.Write(data)
+}
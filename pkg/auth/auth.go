@@ -0,0 +1,334 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	// SessionCookie is the cookie holding the session id of the web console
+	SessionCookie = "image_transfer_session"
+	// OIDCStateCookie binds an oidc login to the browser that started it
+	OIDCStateCookie = "image_transfer_oidc_state"
+	// UserKey is the key of the authenticated user name in the gin context
+	UserKey = "user"
+	// IdentityKey is the key of the authenticated Identity in the gin context
+	IdentityKey = "identity"
+)
+
+// Identity is who a request is authenticated as, Email is only known for users logged in
+// by oidc, the Groups of the other users come from the users file
+type Identity struct {
+	Name   string   `json:"name"`
+	Email  string   `json:"email,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// OIDC marks the users logged in by oidc, they are not in the users file
+	OIDC bool `json:"oidc,omitempty"`
+}
+
+// Authenticator authenticates the requests of the server by a login session,
+// an API token in the Bearer header, or Basic credentials of a user
+type Authenticator struct {
+	Users    Users
+	Tokens   *TokenStore
+	Sessions *SessionStore
+	// OIDC is the single sign-on provider, nil if it is not configured
+	OIDC *OIDCProvider
+	// Policy grants the roles, everyone is an admin if it is nil
+	Policy *Policy
+	// LoginPath is where unauthenticated browsers are redirected to
+	LoginPath string
+}
+
+// NewAuthenticator creates an Authenticator
+func NewAuthenticator(users Users, tokens *TokenStore, sessions *SessionStore, loginPath string) *Authenticator {
+	return &Authenticator{
+		Users:     users,
+		Tokens:    tokens,
+		Sessions:  sessions,
+		LoginPath: loginPath,
+	}
+}
+
+// CurrentUser returns the user authenticated by the middleware
+func CurrentUser(c *gin.Context) string {
+	return c.GetString(UserKey)
+}
+
+// CurrentIdentity returns the identity authenticated by the middleware
+func CurrentIdentity(c *gin.Context) Identity {
+	if identity, ok := c.Get(IdentityKey); ok {
+		return identity.(Identity)
+	}
+	return Identity{}
+}
+
+// Middleware rejects unauthenticated requests, browsers asking for a page are redirected
+// to the login page instead of getting a Basic prompt
+func (a *Authenticator) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if identity, ok := a.authenticate(c); ok {
+			c.Set(UserKey, identity.Name)
+			c.Set(IdentityKey, identity)
+			c.Next()
+			return
+		}
+
+		if c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html") {
+			c.Redirect(http.StatusFound, a.LoginPath)
+			c.Abort()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	}
+}
+
+func (a *Authenticator) authenticate(c *gin.Context) (Identity, bool) {
+	header := c.GetHeader("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token, ok := a.Tokens.Authenticate(strings.TrimPrefix(header, "Bearer "))
+		if !ok {
+			return Identity{}, false
+		}
+		return a.tokenIdentity(token)
+	}
+
+	if name, password, ok := c.Request.BasicAuth(); ok {
+		if !a.Users.Verify(name, password) {
+			return Identity{}, false
+		}
+		return a.Users.Identity(name)
+	}
+
+	if id, err := c.Cookie(SessionCookie); err == nil {
+		session, ok := a.Sessions.Get(id)
+		return session.Identity, ok
+	}
+	return Identity{}, false
+}
+
+// tokenIdentity resolves the owner of token at every request, so that the tokens of a user
+// follow the changes of the users file and stop working once the user is removed. The
+// groups of an oidc user can not be looked up without a login, the token keeps those of
+// the session it was created in.
+func (a *Authenticator) tokenIdentity(token Token) (Identity, bool) {
+	if token.OIDC {
+		if a.OIDC == nil {
+			return Identity{}, false
+		}
+		return Identity{Name: token.Owner, Email: token.Email, Groups: token.Groups, OIDC: true}, true
+	}
+	return a.Users.Identity(token.Owner)
+}
+
+// LoginMethodsHandler tells the login page which ways to log in are enabled
+func (a *Authenticator) LoginMethodsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"password": len(a.Users) > 0, "oidc": a.OIDC != nil})
+}
+
+// LoginRequest is the body of POST /login
+type LoginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// LoginHandler checks the password of a user and starts a session
+func (a *Authenticator) LoginHandler(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username and password are required"})
+		return
+	}
+
+	if !a.Users.Verify(req.Username, req.Password) {
+		log.Warnf("login of user %s from %s failed", req.Username, c.ClientIP())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid username or password"})
+		return
+	}
+
+	identity, _ := a.Users.Identity(req.Username)
+	if a.StartSession(c, identity) {
+		c.JSON(http.StatusOK, gin.H{"message": "login successfully", "user": req.Username})
+	}
+}
+
+// OIDCLoginHandler redirects the browser to the identity provider
+func (a *Authenticator) OIDCLoginHandler(c *gin.Context) {
+	if a.OIDC == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "oidc login is not enabled"})
+		return
+	}
+
+	state, authURL, err := a.OIDC.AuthCodeURL()
+	if err != nil {
+		log.Errorf("start oidc login error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start oidc login"})
+		return
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     OIDCStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallbackHandler finishes the oidc login and starts a session
+func (a *Authenticator) OIDCCallbackHandler(c *gin.Context) {
+	if a.OIDC == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "oidc login is not enabled"})
+		return
+	}
+
+	if errCode := c.Query("error"); errCode != "" {
+		log.Warnf("oidc login from %s failed: %s %s", c.ClientIP(), errCode, c.Query("error_description"))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "oidc login failed: " + errCode})
+		return
+	}
+
+	state := c.Query("state")
+	cookie, err := c.Cookie(OIDCStateCookie)
+	if err != nil || state == "" || cookie != state {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "oidc login state does not match"})
+		return
+	}
+	http.SetCookie(c.Writer, &http.Cookie{Name: OIDCStateCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+
+	identity, err := a.OIDC.Exchange(c.Request.Context(), state, c.Query("code"))
+	if err != nil {
+		log.Warnf("oidc login from %s failed: %v", c.ClientIP(), err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "oidc login failed"})
+		return
+	}
+
+	if a.StartSession(c, identity) {
+		c.Redirect(http.StatusFound, "/")
+	}
+}
+
+// StartSession creates a session for identity and sets the session cookie
+func (a *Authenticator) StartSession(c *gin.Context, identity Identity) bool {
+	id, session, err := a.Sessions.Create(identity)
+	if err != nil {
+		log.Errorf("create session for user %s error: %v", identity.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create session"})
+		return false
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    id,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Infof("user %s logged in from %s", identity.Name, c.ClientIP())
+	return true
+}
+
+// LogoutHandler ends the session of the request
+func (a *Authenticator) LogoutHandler(c *gin.Context) {
+	if id, err := c.Cookie(SessionCookie); err == nil {
+		a.Sessions.Delete(id)
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+	c.JSON(http.StatusOK, gin.H{"message": "logout successfully"})
+}
+
+// CreateTokenRequest is the body of POST /tokens, TTL is a duration like 720h and the
+// token never expires if it is empty
+type CreateTokenRequest struct {
+	Name string `json:"name" binding:"required"`
+	TTL  string `json:"ttl"`
+}
+
+// CreateTokenHandler creates an API token for the current user, the secret is only
+// returned in this response
+func (a *Authenticator) CreateTokenHandler(c *gin.Context) {
+	var req CreateTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token name is required"})
+		return
+	}
+
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ttl should be a positive duration like 720h"})
+			return
+		}
+	}
+
+	user := CurrentUser(c)
+	token, secret, err := a.Tokens.Create(req.Name, CurrentIdentity(c), ttl)
+	if err != nil {
+		log.Errorf("create token %s for user %s error: %v", req.Name, user, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+		return
+	}
+
+	log.Infof("user %s created token %s(%s)", user, token.Name, token.ID)
+	c.JSON(http.StatusCreated, gin.H{"token": token, "secret": secret})
+}
+
+// ListTokensHandler lists the API tokens of the current user
+func (a *Authenticator) ListTokensHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"tokens": a.Tokens.List(CurrentUser(c))})
+}
+
+// RevokeTokenHandler deletes an API token of the current user
+func (a *Authenticator) RevokeTokenHandler(c *gin.Context) {
+	id := c.Param("id")
+	user := CurrentUser(c)
+
+	token, ok := a.Tokens.Get(id)
+	if !ok || token.Owner != user {
+		c.JSON(http.StatusNotFound, gin.H{"error": "token not found"})
+		return
+	}
+
+	if err := a.Tokens.Revoke(id); err != nil {
+		log.Errorf("revoke token %s error: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke token"})
+		return
+	}
+
+	log.Infof("user %s revoked token %s(%s)", user, token.Name, token.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "token revoked successfully"})
+}
@@ -0,0 +1,551 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// OIDCConfig configures the single sign-on by an OIDC identity provider, an oidc config
+// file looks like
+//
+//	issuer: https://sso.example.com
+//	clientID: image-transfer
+//	clientSecret: xxx
+//	redirectURL: https://image-transfer.example.com/oidc/callback
+//	scopes: [openid, email, profile, groups]
+//	groupsClaim: groups
+//	allowedGroups: [devops]
+type OIDCConfig struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"clientID"`
+	ClientSecret string   `yaml:"clientSecret"`
+	RedirectURL  string   `yaml:"redirectURL"`
+	Scopes       []string `yaml:"scopes"`
+	// UsernameClaim names the user, it falls back to email and sub if the claim is missing
+	UsernameClaim string `yaml:"usernameClaim"`
+	GroupsClaim   string `yaml:"groupsClaim"`
+	// AllowedGroups limits the login to the members of these groups if it is not empty
+	AllowedGroups []string `yaml:"allowedGroups"`
+}
+
+// LoadOIDCConfig reads the oidc config file
+func LoadOIDCConfig(path string) (*OIDCConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("open oidc config file %s error: %v", path, err)
+	}
+
+	config := &OIDCConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("unmarshal oidc config file %s error: %v", path, err)
+	}
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, fmt.Errorf("issuer, clientID and redirectURL are required in oidc config file %s", path)
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	if !utils.IsContain(config.Scopes, "openid") {
+		config.Scopes = append([]string{"openid"}, config.Scopes...)
+	}
+	if config.UsernameClaim == "" {
+		config.UsernameClaim = "preferred_username"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	return config, nil
+}
+
+// OIDCProvider runs the authorization code flow against the issuer of an OIDCConfig
+type OIDCProvider struct {
+	config *OIDCConfig
+	client *http.Client
+
+	authorizationEndpoint string
+	tokenEndpoint         string
+	jwksURI               string
+
+	lock sync.Mutex
+	keys map[string]crypto.PublicKey
+	// keysFetchedAt limits how often tokens with unknown keys make the keys fetched again
+	keysFetchedAt time.Time
+	// logins are the pending authorization requests by state
+	logins map[string]oidcLogin
+}
+
+type oidcLogin struct {
+	nonce     string
+	verifier  string
+	expiresAt time.Time
+}
+
+const (
+	// oidcLoginTimeout is how long a user has to finish the login at the identity provider
+	oidcLoginTimeout = 10 * time.Minute
+	// oidcKeysRefreshInterval is the minimum interval between two fetches of the signing keys
+	oidcKeysRefreshInterval = time.Minute
+	// oidcClockSkew is the difference tolerated between the clocks of the issuer and the server
+	oidcClockSkew = time.Minute
+)
+
+// NewOIDCProvider discovers the endpoints of the issuer
+func NewOIDCProvider(ctx context.Context, config *OIDCConfig) (*OIDCProvider, error) {
+	p := &OIDCProvider{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+		logins: map[string]oidcLogin{},
+	}
+
+	discoveryURL := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(ctx, discoveryURL, &discovery); err != nil {
+		return nil, fmt.Errorf("discover oidc issuer %s error: %v", config.Issuer, err)
+	}
+	if discovery.Issuer != config.Issuer {
+		return nil, fmt.Errorf("oidc issuer %s does not match the discovered issuer %s", config.Issuer, discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc issuer %s misses endpoints in its discovery document", config.Issuer)
+	}
+
+	p.authorizationEndpoint = discovery.AuthorizationEndpoint
+	p.tokenEndpoint = discovery.TokenEndpoint
+	p.jwksURI = discovery.JWKSURI
+	return p, nil
+}
+
+// AuthCodeURL starts a login and returns the state and the url of the identity provider
+// the browser is redirected to
+func (p *OIDCProvider) AuthCodeURL() (string, string, error) {
+	state, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	p.lock.Lock()
+	now := time.Now()
+	for s, login := range p.logins {
+		if now.After(login.expiresAt) {
+			delete(p.logins, s)
+		}
+	}
+	p.logins[state] = oidcLogin{nonce: nonce, verifier: verifier, expiresAt: now.Add(oidcLoginTimeout)}
+	p.lock.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(p.authorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return state, p.authorizationEndpoint + sep + params.Encode(), nil
+}
+
+// Exchange finishes the login of state, it redeems code for an ID token and returns the
+// identity of the verified token
+func (p *OIDCProvider) Exchange(ctx context.Context, state, code string) (Identity, error) {
+	p.lock.Lock()
+	login, ok := p.logins[state]
+	delete(p.logins, state)
+	p.lock.Unlock()
+	if !ok || time.Now().After(login.expiresAt) {
+		return Identity{}, errors.New("oidc login is unknown or expired")
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {login.verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Identity{}, fmt.Errorf("redeem oidc code error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Identity{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Identity{}, fmt.Errorf("redeem oidc code error: %s: %s", resp.Status, body)
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return Identity{}, fmt.Errorf("decode oidc token response error: %v", err)
+	}
+	if token.IDToken == "" {
+		return Identity{}, errors.New("no id_token in oidc token response")
+	}
+
+	claims, err := p.verify(ctx, token.IDToken)
+	if err != nil {
+		return Identity{}, err
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != login.nonce {
+		return Identity{}, errors.New("nonce of oidc id token does not match")
+	}
+	return p.identity(claims)
+}
+
+// identity maps the claims of an ID token to an Identity
+func (p *OIDCProvider) identity(claims map[string]interface{}) (Identity, error) {
+	identity := Identity{OIDC: true}
+	identity.Email, _ = claims["email"].(string)
+	for _, claim := range []string{p.config.UsernameClaim, "email", "sub"} {
+		if name, _ := claims[claim].(string); name != "" {
+			identity.Name = name
+			break
+		}
+	}
+	if identity.Name == "" {
+		return Identity{}, errors.New("no user name in oidc id token")
+	}
+
+	switch groups := claims[p.config.GroupsClaim].(type) {
+	case string:
+		identity.Groups = []string{groups}
+	case []interface{}:
+		for _, group := range groups {
+			if g, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, g)
+			}
+		}
+	}
+
+	if len(p.config.AllowedGroups) > 0 {
+		allowed := false
+		for _, group := range identity.Groups {
+			if utils.IsContain(p.config.AllowedGroups, group) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return Identity{}, fmt.Errorf("user %s is not a member of the allowed groups", identity.Name)
+		}
+	}
+	return identity, nil
+}
+
+// verify checks the signature, issuer, audience and validity period of an ID token and returns
+// its claims
+func (p *OIDCProvider) verify(ctx context.Context, idToken string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed oidc id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("decode oidc id token header error: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("decode oidc id token signature error: %v", err)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, fmt.Errorf("verify oidc id token error: %v", err)
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("decode oidc id token claims error: %v", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != p.config.Issuer {
+		return nil, fmt.Errorf("issuer %s of oidc id token is unexpected", iss)
+	}
+	if !audienceContains(claims["aud"], p.config.ClientID) {
+		return nil, errors.New("audience of oidc id token does not contain the client id")
+	}
+	now := time.Now()
+	exp, _ := claims["exp"].(float64)
+	if now.Add(-oidcClockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("oidc id token is expired")
+	}
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return nil, errors.New("oidc id token has no issue time")
+	}
+	if time.Unix(int64(iat), 0).After(now.Add(oidcClockSkew)) {
+		return nil, errors.New("oidc id token is issued in the future")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && time.Unix(int64(nbf), 0).After(now.Add(oidcClockSkew)) {
+		return nil, errors.New("oidc id token is not valid yet")
+	}
+	return claims, nil
+}
+
+// key returns the signing key kid of the issuer, the keys are fetched again when the
+// issuer rotates them, but at most once per oidcKeysRefreshInterval so tokens with made up
+// key ids can not flood the issuer
+func (p *OIDCProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.lock.Lock()
+	key, ok := p.lookupKey(kid)
+	if ok {
+		p.lock.Unlock()
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < oidcKeysRefreshInterval {
+		p.lock.Unlock()
+		return nil, fmt.Errorf("oidc signing key %q not found", kid)
+	}
+	p.keysFetchedAt = time.Now()
+	p.lock.Unlock()
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.jwksURI, &jwks); err != nil {
+		return nil, fmt.Errorf("fetch oidc signing keys error: %v", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.keys = keys
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("oidc signing key %q not found", kid)
+}
+
+// lookupKey finds key kid, the only key is used if the token names none, callers hold the lock
+func (p *OIDCProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jsonWebKey is a public key of a JWKS document
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("ec point is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// verifySignature checks a JWS signature of the RS and ES algorithms, an ES algorithm only
+// accepts a key on its own curve
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	var curve elliptic.Curve
+	switch alg {
+	case "RS256":
+		hash = crypto.SHA256
+	case "RS384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	case "ES256":
+		hash, curve = crypto.SHA256, elliptic.P256()
+	case "ES384":
+		hash, curve = crypto.SHA384, elliptic.P384()
+	case "ES512":
+		hash, curve = crypto.SHA512, elliptic.P521()
+	default:
+		return fmt.Errorf("unsupported signing algorithm %s", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if curve != nil {
+			return fmt.Errorf("algorithm %s does not match the rsa key", alg)
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if curve != key.Curve {
+			return fmt.Errorf("algorithm %s does not match the ec key of curve %s", alg, key.Curve.Params().Name)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid ec signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("invalid ec signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported signing key")
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
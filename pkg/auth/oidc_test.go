@@ -0,0 +1,460 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer is an oidc identity provider serving the discovery document, the signing keys
+// and a token endpoint that returns the next ID token
+type testIssuer struct {
+	*httptest.Server
+
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	lock      sync.Mutex
+	jwks      []map[string]string
+	idToken   string
+	jwksFetch int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{rsaKey: rsaKey, ecKey: ecKey}
+	issuer.jwks = []map[string]string{
+		{
+			"kid": "rsa", "kty": "RSA", "use": "sig",
+			"n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+		},
+		ecJWK("ec", &ecKey.PublicKey),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer.URL,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+			"jwks_uri":               issuer.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		issuer.lock.Lock()
+		defer issuer.lock.Unlock()
+		issuer.jwksFetch++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": issuer.jwks})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code_verifier") == "" {
+			http.Error(w, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		issuer.lock.Lock()
+		defer issuer.lock.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"id_token": issuer.idToken})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (i *testIssuer) provider(t *testing.T) *OIDCProvider {
+	p, err := NewOIDCProvider(context.Background(), &OIDCConfig{
+		Issuer:        i.URL,
+		ClientID:      "image-transfer",
+		RedirectURL:   "http://localhost/oidc/callback",
+		Scopes:        []string{"openid"},
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// claims returns valid claims of a login with nonce
+func (i *testIssuer) claims(nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":                i.URL,
+		"aud":                "image-transfer",
+		"sub":                "1001",
+		"preferred_username": "alice",
+		"groups":             []string{"sre"},
+		"nonce":              nonce,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+	}
+}
+
+// sign builds a JWS of claims, sign signs the signing input with the algorithm in header
+func (i *testIssuer) sign(t *testing.T, header, claims map[string]interface{}, sign func([]byte) []byte) string {
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64(h) + "." + b64(c)
+	return signed + "." + b64(sign([]byte(signed)))
+}
+
+func (i *testIssuer) signRS256(t *testing.T) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, i.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+}
+
+func signES(t *testing.T, key *ecdsa.PrivateKey, hash crypto.Hash) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		h := hash.New()
+		h.Write(signed)
+		r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+		return signature
+	}
+}
+
+// login runs a login against the issuer which answers with the ID token made by token
+func (i *testIssuer) login(t *testing.T, p *OIDCProvider, token func(nonce string) string) (Identity, error) {
+	state, authURL, err := p.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("state") != state || u.Query().Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization url %s", authURL)
+	}
+
+	i.lock.Lock()
+	i.idToken = token(u.Query().Get("nonce"))
+	i.lock.Unlock()
+	return p.Exchange(context.Background(), state, "code")
+}
+
+func TestOIDCExchange(t *testing.T) {
+	issuer := newTestIssuer(t)
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.jwks = append(issuer.jwks, ecJWK("ec384", &p384.PublicKey))
+
+	hs256 := func(secret []byte) func([]byte) []byte {
+		return func(signed []byte) []byte {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(signed)
+			return mac.Sum(nil)
+		}
+	}
+	rsaPublicKey, err := json.Marshal(issuer.jwks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		alg     string
+		kid     string
+		sign    func([]byte) []byte
+		claims  func(claims map[string]interface{})
+		nonce   string
+		wantErr string
+	}{
+		{name: "rs256", alg: "RS256", kid: "rsa", sign: issuer.signRS256(t)},
+		{name: "es256", alg: "ES256", kid: "ec", sign: signES(t, issuer.ecKey, crypto.SHA256)},
+		{name: "es384", alg: "ES384", kid: "ec384", sign: signES(t, p384, crypto.SHA384)},
+		{
+			name: "bad signature", alg: "RS256", kid: "rsa",
+			sign: func(signed []byte) []byte {
+				signature := issuer.signRS256(t)(signed)
+				signature[0] ^= 0xff
+				return signature
+			},
+			wantErr: "verify oidc id token error",
+		},
+		{
+			name: "signature of other claims", alg: "ES256", kid: "ec",
+			sign: func(signed []byte) []byte {
+				return signES(t, issuer.ecKey, crypto.SHA256)([]byte(strings.Replace(string(signed), ".", ".x", 1)))
+			},
+			wantErr: "invalid ec signature",
+		},
+		{
+			name: "alg none", alg: "none", kid: "rsa",
+			sign:    func([]byte) []byte { return nil },
+			wantErr: "unsupported signing algorithm none",
+		},
+		{
+			name: "hs256 with the rsa public key", alg: "HS256", kid: "rsa",
+			sign:    hs256(rsaPublicKey),
+			wantErr: "unsupported signing algorithm HS256",
+		},
+		{
+			name: "hs256 with the modulus", alg: "HS256", kid: "rsa",
+			sign:    hs256(issuer.rsaKey.N.Bytes()),
+			wantErr: "unsupported signing algorithm HS256",
+		},
+		{
+			name: "es256 with a rsa key", alg: "ES256", kid: "rsa",
+			sign:    signES(t, issuer.ecKey, crypto.SHA256),
+			wantErr: "does not match the rsa key",
+		},
+		{
+			name: "es256 with a p-384 key", alg: "ES256", kid: "ec384",
+			sign:    signES(t, p384, crypto.SHA256),
+			wantErr: "does not match the ec key of curve P-384",
+		},
+		{
+			name: "es384 with a p-256 key", alg: "ES384", kid: "ec",
+			sign:    signES(t, issuer.ecKey, crypto.SHA384),
+			wantErr: "does not match the ec key of curve P-256",
+		},
+		{
+			name: "expired", alg: "RS256", kid: "rsa", sign: issuer.signRS256(t),
+			claims: func(claims map[string]interface{}) {
+				claims["exp"] = time.Now().Add(-2 * oidcClockSkew).Unix()
+			},
+			wantErr: "oidc id token is expired",
+		},
+		{
+			name: "expired within the clock skew", alg: "RS256", kid: "rsa", sign: issuer.signRS256(t),
+			claims: func(claims map[string]interface{}) {
+				claims["exp"] = time.Now().Add(-oidcClockSkew / 2).Unix()
+			},
+		},
+		{
+			name: "no exp", alg: "RS256", kid: "rsa", sign: issuer.signRS256(t),
+			claims:  func(claims map[string]interface{}) { delete(claims, "exp") },
+			wantErr: "oidc id token is expired",
+		},
+		{
+			name: "not valid yet", alg: "RS256", kid: "rsa", sign: issuer.signRS256(t),
+			claims: func(claims map[string]interface{}) {
+				claims["nbf"] = time.Now().Add(2 * oidcClockSkew).Unix()
+			},
+			wantErr: "oidc id token is not valid yet",
+		},
+		{
+			name: "issued in the future", alg: "RS256", kid: "rsa", sign: issuer.signRS256(t),
+			claims: func(claims map[string]interface{}) {
+				claims["iat"] = time.Now().Add(2 * oidcClockSkew).Unix()
+			},
+			wantErr: "oidc id token is issued in the future",
+		},
+		{
+			name: "no iat", alg: "RS256", kid: "rsa", sign: issuer.signRS256(t),
+			claims:  func(claims map[string]interface{}) { delete(claims, "iat") },
+			wantErr: "oidc id token has no issue time",
+		},
+		{
+			name: "other issuer", alg: "RS256", kid: "rsa", sign: issuer.signRS256(t),
+			claims:  func(claims map[string]interface{}) { claims["iss"] = "https://evil.example.com" },
+			wantErr: "issuer https://evil.example.com of oidc id token is unexpected",
+		},
+		{
+			name: "other audience", alg: "RS256", kid: "rsa", sign: issuer.signRS256(t),
+			claims:  func(claims map[string]interface{}) { claims["aud"] = []string{"other"} },
+			wantErr: "audience of oidc id token does not contain the client id",
+		},
+		{
+			name: "nonce mismatch", alg: "RS256", kid: "rsa", sign: issuer.signRS256(t),
+			nonce:   "replayed",
+			wantErr: "nonce of oidc id token does not match",
+		},
+		{
+			name: "no nonce", alg: "RS256", kid: "rsa", sign: issuer.signRS256(t),
+			claims:  func(claims map[string]interface{}) { delete(claims, "nonce") },
+			wantErr: "nonce of oidc id token does not match",
+		},
+		{
+			name: "unknown kid", alg: "RS256", kid: "rotated", sign: issuer.signRS256(t),
+			wantErr: `oidc signing key "rotated" not found`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := issuer.provider(t)
+			identity, err := issuer.login(t, p, func(nonce string) string {
+				if test.nonce != "" {
+					nonce = test.nonce
+				}
+				claims := issuer.claims(nonce)
+				if test.claims != nil {
+					test.claims(claims)
+				}
+				return issuer.sign(t, map[string]interface{}{"alg": test.alg, "kid": test.kid}, claims, test.sign)
+			})
+
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Name != "alice" || !identity.OIDC || len(identity.Groups) != 1 || identity.Groups[0] != "sre" {
+				t.Errorf("unexpected identity %+v", identity)
+			}
+		})
+	}
+}
+
+func TestOIDCExchangeState(t *testing.T) {
+	issuer := newTestIssuer(t)
+	p := issuer.provider(t)
+
+	if _, err := p.Exchange(context.Background(), "unknown", "code"); err == nil {
+		t.Error("exchange of an unknown state succeeded")
+	}
+
+	token := func(nonce string) string {
+		return issuer.sign(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, issuer.claims(nonce), issuer.signRS256(t))
+	}
+	state, authURL, err := p.AuthCodeURL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authURL)
+	issuer.lock.Lock()
+	issuer.idToken = token(u.Query().Get("nonce"))
+	issuer.lock.Unlock()
+	if _, err := p.Exchange(context.Background(), state, "code"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(context.Background(), state, "code"); err == nil {
+		t.Error("state of a finished login was accepted again")
+	}
+}
+
+func TestOIDCKeysRefreshRateLimit(t *testing.T) {
+	issuer := newTestIssuer(t)
+	p := issuer.provider(t)
+	ctx := context.Background()
+	fetches := func() int {
+		issuer.lock.Lock()
+		defer issuer.lock.Unlock()
+		return issuer.jwksFetch
+	}
+
+	if _, err := p.key(ctx, "rsa"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.key(ctx, "ec"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetches(); got != 1 {
+		t.Fatalf("known keys fetched %d times, want 1", got)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := p.key(ctx, "unknown"); err == nil {
+			t.Fatal("unknown key found")
+		}
+	}
+	if got := fetches(); got != 1 {
+		t.Fatalf("unknown keys fetched the keys %d times within the refresh interval, want 1", got)
+	}
+
+	// the issuer rotates its keys, the new key is found once the refresh interval is over
+	rotated, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.lock.Lock()
+	issuer.jwks = []map[string]string{ecJWK("rotated", &rotated.PublicKey)}
+	issuer.lock.Unlock()
+
+	if _, err := p.key(ctx, "rotated"); err == nil {
+		t.Fatal("rotated key fetched within the refresh interval")
+	}
+	p.lock.Lock()
+	p.keysFetchedAt = time.Now().Add(-oidcKeysRefreshInterval)
+	p.lock.Unlock()
+	if _, err := p.key(ctx, "rotated"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetches(); got != 2 {
+		t.Fatalf("keys fetched %d times, want 2", got)
+	}
+	if _, err := p.key(ctx, "rsa"); err == nil {
+		t.Error("key removed by the issuer is still used")
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	x, y := make([]byte, size), make([]byte, size)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return map[string]string{
+		"kid": kid, "kty": "EC", "use": "sig",
+		"crv": key.Curve.Params().Name, "x": b64(x), "y": b64(y),
+	}
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
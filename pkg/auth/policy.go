@@ -0,0 +1,285 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v2"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// Role grants access to the APIs of the server
+type Role string
+
+const (
+	// RoleViewer can watch the console and the logs
+	RoleViewer Role = "viewer"
+	// RoleOperator can also submit transfers within the scope of its binding
+	RoleOperator Role = "operator"
+	// RoleAdmin can do everything
+	RoleAdmin Role = "admin"
+)
+
+var roleLevels = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// Includes checks if r grants at least the permissions of role
+func (r Role) Includes(role Role) bool {
+	return roleLevels[r] >= roleLevels[role]
+}
+
+// GroupPrefix marks a subject of a binding as a group of the users file or oidc instead of a user
+const GroupPrefix = "group:"
+
+// Binding grants a role to subjects, a subject is a user name or group:<name>. Sources and
+// Targets limit the images the subjects may transfer to the matching patterns, like
+// registry.b/team-a/*, where * does not match /. A local source or target like oci:/data/* is
+// matched by its location, and is only allowed by a binding with such a pattern.
+type Binding struct {
+	Subjects []string `yaml:"subjects"`
+	Role     Role     `yaml:"role"`
+	Sources  []string `yaml:"sources"`
+	Targets  []string `yaml:"targets"`
+}
+
+// matches checks if the binding applies to identity
+func (b *Binding) matches(identity Identity) bool {
+	for _, subject := range b.Subjects {
+		if strings.HasPrefix(subject, GroupPrefix) {
+			if utils.IsContain(identity.Groups, strings.TrimPrefix(subject, GroupPrefix)) {
+				return true
+			}
+		} else if subject == identity.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy binds the users to roles, a policy file looks like
+//
+//	defaultRole: viewer
+//	bindings:
+//	- subjects: [alice, "group:sre"]
+//	  role: admin
+//	- subjects: ["group:team-a"]
+//	  role: operator
+//	  targets: ["registry.b/team-a/*"]
+type Policy struct {
+	// DefaultRole is the role of the users no binding applies to, they are denied if it is empty
+	DefaultRole Role      `yaml:"defaultRole"`
+	Bindings    []Binding `yaml:"bindings"`
+}
+
+// LoadPolicy reads the policy file
+func LoadPolicy(filePath string) (*Policy, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("open policy file %s error: %v", filePath, err)
+	}
+
+	policy := &Policy{}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("unmarshal policy file %s error: %v", filePath, err)
+	}
+
+	if _, ok := roleLevels[policy.DefaultRole]; policy.DefaultRole != "" && !ok {
+		return nil, fmt.Errorf("unknown default role %s in policy file %s", policy.DefaultRole, filePath)
+	}
+	for i, binding := range policy.Bindings {
+		if _, ok := roleLevels[binding.Role]; !ok {
+			return nil, fmt.Errorf("unknown role %q of binding %d in policy file %s", binding.Role, i, filePath)
+		}
+		if len(binding.Subjects) == 0 {
+			return nil, fmt.Errorf("no subject in binding %d of policy file %s", i, filePath)
+		}
+		for _, pattern := range append(append([]string{}, binding.Sources...), binding.Targets...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q of binding %d in policy file %s", pattern, i, filePath)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// Role returns the highest role of identity, everyone is an admin without a policy
+func (p *Policy) Role(identity Identity) Role {
+	if p == nil {
+		return RoleAdmin
+	}
+
+	role := p.DefaultRole
+	for i := range p.Bindings {
+		if p.Bindings[i].matches(identity) && !role.Includes(p.Bindings[i].Role) {
+			role = p.Bindings[i].Role
+		}
+	}
+	return role
+}
+
+// CheckImages checks if identity may transfer every source image of images to its target,
+// and returns the reasons of the denied images by their sources
+func (p *Policy) CheckImages(identity Identity, images map[string]string) map[string]string {
+	denied := map[string]string{}
+	if p == nil {
+		return denied
+	}
+
+	var bindings []*Binding
+	if p.DefaultRole.Includes(RoleOperator) {
+		bindings = append(bindings, &Binding{Role: p.DefaultRole})
+	}
+	for i := range p.Bindings {
+		if p.Bindings[i].matches(identity) && p.Bindings[i].Role.Includes(RoleOperator) {
+			bindings = append(bindings, &p.Bindings[i])
+		}
+	}
+	if len(bindings) == 0 {
+		for source := range images {
+			denied[source] = fmt.Sprintf("user %s is not allowed to submit transfers", identity.Name)
+		}
+		return denied
+	}
+
+	for source, target := range images {
+		if reason := checkImage(bindings, source, target); reason != "" {
+			denied[source] = fmt.Sprintf("user %s %s", identity.Name, reason)
+		}
+	}
+	return denied
+}
+
+// checkImage returns why none of bindings allows the transfer from source to target, it is
+// empty if the transfer is allowed
+func checkImage(bindings []*Binding, source, target string) string {
+	for _, url := range []string{source, target} {
+		if _, err := imageScope(url); err != nil {
+			return err.Error()
+		}
+	}
+	localTarget := isLocal(target)
+
+	var reasons []string
+	for _, binding := range bindings {
+		if !matchScope(binding.Sources, source) {
+			if len(binding.Sources) == 0 {
+				reasons = append(reasons, "may not copy from a local source without a binding granting its location")
+			} else {
+				reasons = append(reasons, fmt.Sprintf("may only copy from %s", strings.Join(binding.Sources, ", ")))
+			}
+			continue
+		}
+		// a local target is written on the server, it needs a binding granting its location
+		if len(binding.Targets) == 0 && !localTarget {
+			return ""
+		}
+		if target == "" || utils.IsTargetTemplate(target) {
+			reasons = append(reasons, fmt.Sprintf("must give an explicit target within %s", strings.Join(binding.Targets, ", ")))
+			continue
+		}
+		if len(binding.Targets) == 0 {
+			reasons = append(reasons, "may not copy to a local target without a binding granting its location")
+			continue
+		}
+		if !matchScope(binding.Targets, target) {
+			reasons = append(reasons, fmt.Sprintf("may only copy to %s", strings.Join(binding.Targets, ", ")))
+			continue
+		}
+		return ""
+	}
+
+	sort.Strings(reasons)
+	return strings.Join(reasons, "; or ")
+}
+
+// matchScope checks if the repository of url matches one of patterns, any registry url matches
+// if there is no pattern. A local url is read or written on the server, it only matches the
+// patterns of local locations, like oci:/data/*, and never matches if its path is invalid.
+func matchScope(patterns []string, url string) bool {
+	local := isLocal(url)
+	if len(patterns) == 0 {
+		return !local
+	}
+
+	scope, err := imageScope(url)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		if local != isLocal(pattern) {
+			continue
+		}
+		if ok, _ := path.Match(pattern, scope); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocal checks if url is an image stored in local files of the server instead of a registry
+func isLocal(url string) bool {
+	return utils.IsArchiveURL(strings.TrimPrefix(url, utils.DockerScheme))
+}
+
+// imageScope returns what the patterns of a binding are matched against, registry/namespace/repo
+// for an image in a registry, and the cleaned location for a local one. A local path with .. is
+// refused, as it could escape the locations granted.
+func imageScope(url string) (string, error) {
+	url = strings.TrimPrefix(url, utils.DockerScheme)
+	if utils.IsArchiveURL(url) {
+		location, _ := utils.ParseArchiveURL(url)
+		scheme, locationPath := utils.SplitArchiveLocation(location)
+		for _, element := range strings.Split(locationPath, "/") {
+			if element == ".." {
+				return "", fmt.Errorf("local path %s must not contain ..", locationPath)
+			}
+		}
+		return scheme + ":" + path.Clean(locationPath), nil
+	}
+
+	repoURL, err := utils.NewRepoURL(url)
+	if err != nil {
+		return url, nil
+	}
+	return repoURL.GetURLWithoutTag(), nil
+}
+
+// RequireRole rejects the requests of users without role, it runs after Middleware
+func (a *Authenticator) RequireRole(role Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity := CurrentIdentity(c)
+		if !a.Policy.Role(identity).Includes(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": fmt.Sprintf("user %s needs role %s", identity.Name, role),
+			})
+			return
+		}
+		c.Next()
+	}
+}
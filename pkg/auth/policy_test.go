@@ -0,0 +1,99 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	// registers the schemes of the local transports
+	_ "tkestack.io/image-transfer/pkg/transfer"
+)
+
+func TestCheckImage(t *testing.T) {
+	unrestricted := &Binding{Role: RoleOperator}
+	teamA := &Binding{
+		Role:    RoleOperator,
+		Sources: []string{"registry.a/team-a/*", "oci:/data/in/*"},
+		Targets: []string{"registry.b/team-a/*", "oci:/data/out/*"},
+	}
+
+	tests := []struct {
+		name     string
+		bindings []*Binding
+		source   string
+		target   string
+		wantErr  string
+	}{
+		{name: "registry to registry", bindings: []*Binding{unrestricted}, source: "registry.a/x/y:v1", target: "registry.b/x/y:v1"},
+		{
+			name: "local source without a binding granting it", bindings: []*Binding{unrestricted},
+			source: "oci:/etc/x:v1", target: "registry.b/x/y:v1",
+			wantErr: "may not copy from a local source without a binding granting its location",
+		},
+		{
+			name: "docker-archive source without a binding granting it", bindings: []*Binding{unrestricted},
+			source: "docker-archive:/root/x.tar", target: "registry.b/x/y:v1",
+			wantErr: "may not copy from a local source",
+		},
+		{
+			name: "local target without a binding granting it", bindings: []*Binding{unrestricted},
+			source: "registry.a/x/y:v1", target: "oci:/data/out/y:v1",
+			wantErr: "may not copy to a local target without a binding granting its location",
+		},
+		{name: "granted local source", bindings: []*Binding{teamA}, source: "oci:/data/in/y:v1", target: "registry.b/team-a/y:v1"},
+		{name: "granted local target", bindings: []*Binding{teamA}, source: "registry.a/team-a/y:v1", target: "oci:/data/out/y:v1"},
+		{
+			name: "local source outside the granted location", bindings: []*Binding{teamA},
+			source: "oci:/data/other/y:v1", target: "registry.b/team-a/y:v1",
+			wantErr: "may only copy from",
+		},
+		{
+			name: "local source escaping the granted location", bindings: []*Binding{teamA},
+			source: "oci:/data/in/../../etc:v1", target: "registry.b/team-a/y:v1",
+			wantErr: "must not contain ..",
+		},
+		{
+			name: "registry source outside the granted repositories", bindings: []*Binding{teamA},
+			source: "registry.a/team-b/y:v1", target: "registry.b/team-a/y:v1",
+			wantErr: "may only copy from",
+		},
+		{
+			name: "target template of a restricted binding", bindings: []*Binding{teamA},
+			source: "registry.a/team-a/y:v1", target: "registry.b/team-a/{{ .Repository }}",
+			wantErr: "must give an explicit target",
+		},
+		{
+			name: "local source granted by another binding", bindings: []*Binding{unrestricted, teamA},
+			source: "oci:/data/in/y:v1", target: "registry.b/team-a/y:v1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reason := checkImage(test.bindings, test.source, test.target)
+			if test.wantErr == "" && reason != "" {
+				t.Fatalf("transfer denied: %s", reason)
+			}
+			if !strings.Contains(reason, test.wantErr) || (test.wantErr != "" && reason == "") {
+				t.Fatalf("got reason %q, want %q", reason, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// Session is a login of the web console
+type Session struct {
+	Identity  Identity
+	ExpiresAt time.Time
+}
+
+// SessionStore keeps the login sessions in memory, they are lost when the server restarts
+type SessionStore struct {
+	ttl      time.Duration
+	lock     sync.Mutex
+	sessions map[string]Session
+}
+
+// NewSessionStore creates a session store whose sessions expire after ttl
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	return &SessionStore{
+		ttl:      ttl,
+		sessions: map[string]Session{},
+	}
+}
+
+// Create starts a session for identity and returns its id
+func (s *SessionStore) Create(identity Identity) (string, Session, error) {
+	id, err := randomHex(32)
+	if err != nil {
+		return "", Session{}, err
+	}
+	session := Session{Identity: identity, ExpiresAt: time.Now().Add(s.ttl)}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.gc()
+	s.sessions[id] = session
+	return id, session, nil
+}
+
+// Get returns the session with id if it has not expired
+func (s *SessionStore) Get(id string) (Session, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return Session{}, false
+	}
+	if time.Now().After(session.ExpiresAt) {
+		delete(s.sessions, id)
+		return Session{}, false
+	}
+	return session, true
+}
+
+// Delete ends the session with id
+func (s *SessionStore) Delete(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.sessions, id)
+}
+
+// gc drops the expired sessions, callers hold the lock
+func (s *SessionStore) gc() {
+	now := time.Now()
+	for id, session := range s.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+}
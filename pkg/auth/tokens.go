@@ -0,0 +1,224 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TokenPrefix marks the API tokens of image-transfer
+const TokenPrefix = "itk_"
+
+// Token is a long-lived API token, only the sha256 of the secret is kept. Email and Groups
+// are only kept for the tokens of oidc users, the other owners are looked up in the users file
+type Token struct {
+	ID        string     `yaml:"id" json:"id"`
+	Name      string     `yaml:"name" json:"name"`
+	Owner     string     `yaml:"owner" json:"owner"`
+	OIDC      bool       `yaml:"oidc,omitempty" json:"oidc,omitempty"`
+	Email     string     `yaml:"email,omitempty" json:"email,omitempty"`
+	Groups    []string   `yaml:"groups,omitempty" json:"groups,omitempty"`
+	Hash      string     `yaml:"hash" json:"-"`
+	CreatedAt time.Time  `yaml:"createdAt" json:"createdAt"`
+	ExpiresAt *time.Time `yaml:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+}
+
+// Expired checks if the token is no longer valid at now
+func (t *Token) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && now.After(*t.ExpiresAt)
+}
+
+// TokenStore keeps the API tokens, and persists them to a yaml file if a path is given
+type TokenStore struct {
+	path   string
+	lock   sync.Mutex
+	tokens []*Token
+}
+
+// NewTokenStore loads the tokens file at path, tokens only live in memory if path is empty
+func NewTokenStore(path string) (*TokenStore, error) {
+	store := &TokenStore{path: path}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open tokens file %s error: %v", path, err)
+	}
+	if err := yaml.Unmarshal(data, &store.tokens); err != nil {
+		return nil, fmt.Errorf("unmarshal tokens file %s error: %v", path, err)
+	}
+	return store, nil
+}
+
+// Create generates a token named name for owner, the secret is only returned here
+func (s *TokenStore) Create(name string, owner Identity, ttl time.Duration) (*Token, string, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	secret = TokenPrefix + secret
+
+	now := time.Now().UTC()
+	token := &Token{
+		ID:        id,
+		Name:      name,
+		Owner:     owner.Name,
+		Hash:      hashToken(secret),
+		CreatedAt: now,
+	}
+	if owner.OIDC {
+		token.OIDC = true
+		token.Email = owner.Email
+		token.Groups = owner.Groups
+	}
+	if ttl > 0 {
+		expiresAt := now.Add(ttl)
+		token.ExpiresAt = &expiresAt
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.tokens = append(s.tokens, token)
+	if err := s.save(); err != nil {
+		s.tokens = s.tokens[:len(s.tokens)-1]
+		return nil, "", err
+	}
+	return token, secret, nil
+}
+
+// List returns the tokens of owner, or all the tokens if owner is empty
+func (s *TokenStore) List(owner string) []Token {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tokens := []Token{}
+	for _, token := range s.tokens {
+		if owner == "" || token.Owner == owner {
+			tokens = append(tokens, *token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens
+}
+
+// Get returns the token with id
+func (s *TokenStore) Get(id string) (Token, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, token := range s.tokens {
+		if token.ID == id {
+			return *token, true
+		}
+	}
+	return Token{}, false
+}
+
+// Revoke deletes the token with id
+func (s *TokenStore) Revoke(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, token := range s.tokens {
+		if token.ID != id {
+			continue
+		}
+		tokens := append(append([]*Token{}, s.tokens[:i]...), s.tokens[i+1:]...)
+		previous := s.tokens
+		s.tokens = tokens
+		if err := s.save(); err != nil {
+			s.tokens = previous
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("token %s not found", id)
+}
+
+// Authenticate returns the token matching secret if it is valid
+func (s *TokenStore) Authenticate(secret string) (Token, bool) {
+	hash := hashToken(secret)
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, token := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(token.Hash), []byte(hash)) == 1 {
+			if token.Expired(now) {
+				return Token{}, false
+			}
+			return *token, true
+		}
+	}
+	return Token{}, false
+}
+
+// save writes the tokens file, callers hold the lock
+func (s *TokenStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := yaml.Marshal(s.tokens)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write tokens file %s error: %v", s.path, err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
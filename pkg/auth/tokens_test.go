@@ -0,0 +1,73 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package auth
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenIdentity(t *testing.T) {
+	store, err := NewTokenStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAuthenticator(Users{"alice": {Groups: []string{"sre"}}}, store, nil, "/login")
+
+	_, secret, err := store.Create("ci", Identity{Name: "alice", Groups: []string{"sre"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, oidcSecret, err := store.Create("ci", Identity{Name: "bob", Email: "bob@example.com", Groups: []string{"dev"}, OIDC: true}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity := func(secret string) (Identity, bool) {
+		token, ok := store.Authenticate(secret)
+		if !ok {
+			t.Fatalf("token %s is not valid", secret)
+		}
+		return a.tokenIdentity(token)
+	}
+
+	if got, ok := identity(secret); !ok || !reflect.DeepEqual(got.Groups, []string{"sre"}) {
+		t.Errorf("identity of alice = %+v, %v", got, ok)
+	}
+
+	a.Users["alice"] = User{Groups: []string{"viewer"}}
+	if got, ok := identity(secret); !ok || !reflect.DeepEqual(got.Groups, []string{"viewer"}) {
+		t.Errorf("token of alice keeps the groups it was created with: %+v", got)
+	}
+
+	delete(a.Users, "alice")
+	if got, ok := identity(secret); ok {
+		t.Errorf("token of deleted user alice is still valid as %+v", got)
+	}
+
+	if _, ok := identity(oidcSecret); ok {
+		t.Error("token of oidc user bob is valid without oidc configured")
+	}
+	a.OIDC = &OIDCProvider{}
+	got, ok := identity(oidcSecret)
+	want := Identity{Name: "bob", Email: "bob@example.com", Groups: []string{"dev"}, OIDC: true}
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("identity of oidc user bob = %+v, %v, want %+v", got, ok, want)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// User is an account of the web console, the password is stored as a bcrypt hash
+type User struct {
+	PasswordHash string   `yaml:"passwordHash"`
+	Groups       []string `yaml:"groups,omitempty"`
+}
+
+// Users maps user names to accounts, a users file looks like
+//
+//	admin:
+//	  passwordHash: $2a$10$...
+//	  groups: [devops]
+type Users map[string]User
+
+// LoadUsers reads the users file
+func LoadUsers(path string) (Users, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("open users file %s error: %v", path, err)
+	}
+
+	users := Users{}
+	if err := yaml.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("unmarshal users file %s error: %v", path, err)
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("no user in users file %s", path)
+	}
+	for name, user := range users {
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("password hash of user %s is invalid: %v", name, err)
+		}
+	}
+	return users, nil
+}
+
+// Verify checks the password of user name
+func (u Users) Verify(name, password string) bool {
+	user, ok := u[name]
+	if !ok {
+		// compare anyway so that unknown users take as long as wrong passwords
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil
+}
+
+// Identity returns the identity of user name with its groups in the users file
+func (u Users) Identity(name string) (Identity, bool) {
+	user, ok := u[name]
+	if !ok {
+		return Identity{}, false
+	}
+	return Identity{Name: name, Groups: user.Groups}, true
+}
+
+// HashPassword generates the bcrypt hash of a password for the users file
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// GeneratePassword generates a random password
+func GeneratePassword() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("image-transfer"), bcrypt.DefaultCost)
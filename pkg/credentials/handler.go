@@ -0,0 +1,160 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package credentials
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/auth"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// Handler serves the credentials API, a credential is visible to its owner, the members of
+// its groups and the admins
+type Handler struct {
+	// Store is nil if the server runs without a master key
+	Store  *Store
+	Policy *auth.Policy
+}
+
+// NewHandler creates a Handler
+func NewHandler(store *Store, policy *auth.Policy) *Handler {
+	return &Handler{Store: store, Policy: policy}
+}
+
+// CreateRequest is the body of POST /credentials
+type CreateRequest struct {
+	Name      string   `json:"name" binding:"required"`
+	Registry  string   `json:"registry" binding:"required"`
+	Namespace string   `json:"namespace"`
+	Username  string   `json:"username" binding:"required"`
+	Password  string   `json:"password" binding:"required"`
+	Insecure  bool     `json:"insecure"`
+	Groups    []string `json:"groups"`
+}
+
+// CanUse checks if identity may use credential
+func (h *Handler) CanUse(identity auth.Identity, credential *Credential) bool {
+	if credential.Owner == identity.Name || h.Policy.Role(identity).Includes(auth.RoleAdmin) {
+		return true
+	}
+	for _, group := range identity.Groups {
+		if utils.IsContain(credential.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver resolves the credentials names for a transfer submitted by identity
+func (h *Handler) Resolver(identity auth.Identity, names []string) (configs.SecurityResolver, error) {
+	if h.Store == nil {
+		return nil, errNotEnabled
+	}
+	return h.Store.Resolver(names, func(credential *Credential) bool {
+		return h.CanUse(identity, credential)
+	})
+}
+
+// CreateHandler stores a credential owned by the current user
+func (h *Handler) CreateHandler(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+
+	var req CreateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name, registry, username and password are required"})
+		return
+	}
+
+	user := auth.CurrentUser(c)
+	credential, err := h.Store.Create(Credential{
+		Name:      req.Name,
+		Registry:  req.Registry,
+		Namespace: req.Namespace,
+		Username:  req.Username,
+		Insecure:  req.Insecure,
+		Owner:     user,
+		Groups:    req.Groups,
+	}, req.Password)
+	if err != nil {
+		log.Errorf("create credential %s error: %v", req.Name, err)
+		if _, exist := h.Store.Get(req.Name); exist {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create credential"})
+		return
+	}
+
+	log.Infof("user %s created credential %s for %s/%s", user, credential.Name, credential.Registry, credential.Namespace)
+	c.JSON(http.StatusCreated, gin.H{"credential": credential})
+}
+
+// ListHandler lists the credentials the current user may use, without their passwords
+func (h *Handler) ListHandler(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+
+	identity := auth.CurrentIdentity(c)
+	c.JSON(http.StatusOK, gin.H{"credentials": h.Store.List(func(credential *Credential) bool {
+		return h.CanUse(identity, credential)
+	})})
+}
+
+// DeleteHandler deletes a credential of the current user, admins may delete any
+func (h *Handler) DeleteHandler(c *gin.Context) {
+	if !h.enabled(c) {
+		return
+	}
+
+	name := c.Param("name")
+	identity := auth.CurrentIdentity(c)
+	credential, ok := h.Store.Get(name)
+	if !ok || !h.CanUse(identity, &credential) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "credential not found"})
+		return
+	}
+	if credential.Owner != identity.Name && !h.Policy.Role(identity).Includes(auth.RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the owner or an admin may delete the credential"})
+		return
+	}
+
+	if err := h.Store.Delete(name); err != nil {
+		log.Errorf("delete credential %s error: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete credential"})
+		return
+	}
+
+	log.Infof("user %s deleted credential %s", identity.Name, name)
+	c.JSON(http.StatusOK, gin.H{"message": "credential deleted successfully"})
+}
+
+func (h *Handler) enabled(c *gin.Context) bool {
+	if h.Store == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": errNotEnabled.Error()})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,296 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package credentials
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	"tkestack.io/image-transfer/configs"
+)
+
+// MasterKeyEnv is the environment variable the master key is read from if no key file is given
+const MasterKeyEnv = "IMAGE_TRANSFER_MASTER_KEY"
+
+var errNotEnabled = errors.New("credentials store is not enabled, start the server with a master key")
+
+// Credential is a registry credential stored by the server, the password is encrypted at rest
+// and never returned by the API
+type Credential struct {
+	Name string `yaml:"name" json:"name"`
+	// Registry and the optional Namespace are the scope the credential is used for
+	Registry  string `yaml:"registry" json:"registry"`
+	Namespace string `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	Username  string `yaml:"username" json:"username"`
+	// EncryptedPassword is the base64 of the nonce and the AES-GCM sealed password
+	EncryptedPassword string `yaml:"encryptedPassword" json:"-"`
+	Insecure          bool   `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+	Owner             string `yaml:"owner" json:"owner"`
+	// Groups may use the credential besides its owner
+	Groups    []string  `yaml:"groups,omitempty" json:"groups,omitempty"`
+	CreatedAt time.Time `yaml:"createdAt" json:"createdAt"`
+}
+
+// Store keeps the registry credentials in a yaml file
+type Store struct {
+	path        string
+	gcm         cipher.AEAD
+	lock        sync.Mutex
+	credentials []*Credential
+}
+
+// LoadMasterKey reads the master key from keyFile, or from MasterKeyEnv if keyFile is empty,
+// it is empty if neither is given
+func LoadMasterKey(keyFile string) (string, error) {
+	if keyFile == "" {
+		return os.Getenv(MasterKeyEnv), nil
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("open master key file %s error: %v", keyFile, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// NewStore loads the credentials file at path, the passwords are encrypted with a key derived
+// from masterKey
+func NewStore(path, masterKey string) (*Store, error) {
+	if masterKey == "" {
+		return nil, errors.New("master key of the credentials store should not be empty")
+	}
+	key := sha256.Sum256([]byte(masterKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Store{path: path, gcm: gcm}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open credentials file %s error: %v", path, err)
+	}
+	if err := yaml.Unmarshal(data, &store.credentials); err != nil {
+		return nil, fmt.Errorf("unmarshal credentials file %s error: %v", path, err)
+	}
+
+	// fail at startup rather than at the first transfer if the master key has changed
+	for _, credential := range store.credentials {
+		if _, err := store.decrypt(credential.EncryptedPassword); err != nil {
+			return nil, fmt.Errorf("decrypt credential %s error, is the master key right? %v", credential.Name, err)
+		}
+	}
+	return store, nil
+}
+
+// Create stores credential with password
+func (s *Store) Create(credential Credential, password string) (*Credential, error) {
+	encrypted, err := s.encrypt(password)
+	if err != nil {
+		return nil, err
+	}
+	credential.EncryptedPassword = encrypted
+	credential.CreatedAt = time.Now().UTC()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.get(credential.Name) != nil {
+		return nil, fmt.Errorf("credential %s already exists", credential.Name)
+	}
+	s.credentials = append(s.credentials, &credential)
+	if err := s.save(); err != nil {
+		s.credentials = s.credentials[:len(s.credentials)-1]
+		return nil, err
+	}
+	return &credential, nil
+}
+
+// List returns the credentials filter accepts
+func (s *Store) List(filter func(*Credential) bool) []Credential {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	credentials := []Credential{}
+	for _, credential := range s.credentials {
+		if filter(credential) {
+			credentials = append(credentials, *credential)
+		}
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].Name < credentials[j].Name
+	})
+	return credentials
+}
+
+// Get returns the credential name
+func (s *Store) Get(name string) (Credential, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if credential := s.get(name); credential != nil {
+		return *credential, true
+	}
+	return Credential{}, false
+}
+
+// Delete removes the credential name
+func (s *Store) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, credential := range s.credentials {
+		if credential.Name != name {
+			continue
+		}
+		previous := s.credentials
+		s.credentials = append(append([]*Credential{}, previous[:i]...), previous[i+1:]...)
+		if err := s.save(); err != nil {
+			s.credentials = previous
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("credential %s not found", name)
+}
+
+// Resolver decrypts the credentials names for a transfer, canUse decides if the caller may
+// use a credential
+func (s *Store) Resolver(names []string, canUse func(*Credential) bool) (configs.SecurityResolver, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	resolver := resolver{}
+	for _, name := range names {
+		credential := s.get(name)
+		if credential == nil || !canUse(credential) {
+			return nil, fmt.Errorf("credential %s not found", name)
+		}
+		password, err := s.decrypt(credential.EncryptedPassword)
+		if err != nil {
+			return nil, fmt.Errorf("decrypt credential %s error: %v", name, err)
+		}
+		resolver = append(resolver, resolvedCredential{
+			registry:  credential.Registry,
+			namespace: credential.Namespace,
+			security: configs.Security{
+				Username: credential.Username,
+				Password: password,
+				Insecure: credential.Insecure,
+			},
+		})
+	}
+	return resolver, nil
+}
+
+// get finds the credential name, callers hold the lock
+func (s *Store) get(name string) *Credential {
+	for _, credential := range s.credentials {
+		if credential.Name == name {
+			return credential
+		}
+	}
+	return nil
+}
+
+// save writes the credentials file, callers hold the lock
+func (s *Store) save() error {
+	data, err := yaml.Marshal(s.credentials)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write credentials file %s error: %v", s.path, err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *Store) encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, s.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *Store) decrypt(encrypted string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	size := s.gcm.NonceSize()
+	if len(sealed) < size {
+		return "", errors.New("encrypted password is too short")
+	}
+	plaintext, err := s.gcm.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+type resolvedCredential struct {
+	registry  string
+	namespace string
+	security  configs.Security
+}
+
+// resolver resolves the credentials picked for a transfer, the ones scoped to the namespace
+// win over the ones of the whole registry
+type resolver []resolvedCredential
+
+func (r resolver) Resolve(registry string, namespace string) (configs.Security, bool) {
+	var found *resolvedCredential
+	for i := range r {
+		credential := &r[i]
+		if credential.registry != registry {
+			continue
+		}
+		if credential.namespace == namespace && namespace != "" {
+			return credential.security, true
+		}
+		if credential.namespace == "" && found == nil {
+			found = credential
+		}
+	}
+	if found != nil {
+		return found.security, true
+	}
+	return configs.Security{}, false
+}
@@ -21,7 +21,9 @@ package imagetransfer
 import (
 	"fmt"
 	"github.com/spf13/cobra"
+	"net/http"
 	"os"
+	"time"
 	flagUtil "tkestack.io/image-transfer/pkg/flag"
 	"tkestack.io/image-transfer/pkg/image-transfer/options"
 	"tkestack.io/image-transfer/pkg/log"
@@ -46,6 +48,52 @@ func NewImageTransferCommand(basename string) *cobra.Command {
 	return cmd
 }
 
+// NewSyncCommand creates the sync command, which transfers the images of the rules once, or
+// keeps their targets in sync with --watch
+func NewSyncCommand(basename string) *cobra.Command {
+	flagUtil.InitFlags()
+
+	opts := options.NewClientOptions()
+	var watch bool
+	var interval time.Duration
+	var healthAddr string
+	cmd := &cobra.Command{
+		Use:   basename,
+		Short: "transfer the images of the rules, and keep them in sync with --watch",
+		Run: func(cmd *cobra.Command, args []string) {
+			if !watch {
+				run(opts)(cmd, args)
+				return
+			}
+			log.InitLogger()
+			defer log.FlushLogger()
+
+			flagUtil.PrintFlags(cmd.Flags())
+
+			watcher := NewWatcher(opts, interval)
+			if healthAddr != "" {
+				go func() {
+					mux := http.NewServeMux()
+					mux.Handle("/healthz", watcher)
+					log.Infof("Serve health of the sync on %s/healthz", healthAddr)
+					if err := http.ListenAndServe(healthAddr, mux); err != nil {
+						log.Errorf("serve health error: %v", err)
+						os.Exit(1)
+					}
+				}()
+			}
+			watcher.Run()
+		},
+	}
+
+	opts.AddFlags(cmd.Flags())
+	log.AddFlags(cmd.Flags())
+	cmd.Flags().BoolVar(&watch, "watch", false, "keep running and copy the new or changed tags every interval")
+	cmd.Flags().DurationVar(&interval, "interval", 10*time.Minute, "wait between two cycles of the watch mode")
+	cmd.Flags().StringVar(&healthAddr, "healthAddr", ":8081", "address of the health endpoint of the watch mode, empty to disable it")
+	return cmd
+}
+
 func run(opts *options.ClientOptions) RunFunc {
 	return func(cmd *cobra.Command, args []string) {
 		log.InitLogger()
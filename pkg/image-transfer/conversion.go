@@ -0,0 +1,116 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package imagetransfer
+
+import (
+	"fmt"
+
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// Conversion is an image whose manifest is converted to another format by the transfer
+type Conversion struct {
+	Image        string `json:"image"`
+	Target       string `json:"target"`
+	SourceType   string `json:"sourceType"`
+	TargetType   string `json:"targetType"`
+	SourceDigest string `json:"sourceDigest"`
+	TargetDigest string `json:"targetDigest"`
+}
+
+func (c Conversion) String() string {
+	return fmt.Sprintf("%s %s (%s) to %s %s (%s)", c.Image, c.SourceDigest, c.SourceType,
+		c.Target, c.TargetDigest, c.TargetType)
+}
+
+// putConversion records the conversion of a transferred job, if its manifest is converted
+func (c *Client) putConversion(job *transfer.Job) {
+	if job.SourceDigest == job.TargetDigest {
+		return
+	}
+
+	c.conversionsMutex.Lock()
+	defer c.conversionsMutex.Unlock()
+	c.conversions = append(c.conversions, Conversion{
+		Image:        job.Source.GetRegistry() + "/" + job.Source.GetRepository() + ":" + job.Source.GetTag(),
+		Target:       job.TargetName(),
+		SourceType:   job.SourceManifestType,
+		TargetType:   job.TargetManifestType,
+		SourceDigest: job.SourceDigest.String(),
+		TargetDigest: job.TargetDigest.String(),
+	})
+}
+
+// Conversions returns the manifest conversions of the transfer
+func (c *Client) Conversions() []Conversion {
+	c.conversionsMutex.Lock()
+	defer c.conversionsMutex.Unlock()
+	return append([]Conversion(nil), c.conversions...)
+}
+
+// Recompression is an image whose layers are recompressed by the transfer
+type Recompression struct {
+	Image       string `json:"image"`
+	Target      string `json:"target"`
+	Compression string `json:"compression"`
+	Layers      int    `json:"layers"`
+	SourceSize  int64  `json:"sourceSize"`
+	TargetSize  int64  `json:"targetSize"`
+}
+
+// Saved returns the bytes saved by the recompression, it is negative if the layers grow
+func (r Recompression) Saved() int64 {
+	return r.SourceSize - r.TargetSize
+}
+
+func (r Recompression) String() string {
+	recompression := fmt.Sprintf("%s to %s: %v layers recompressed with %s, %v to %v bytes",
+		r.Image, r.Target, r.Layers, r.Compression, r.SourceSize, r.TargetSize)
+	if r.SourceSize > 0 {
+		recompression += fmt.Sprintf(" (%.1f%% saved)", float64(r.Saved())*100/float64(r.SourceSize))
+	}
+	return recompression
+}
+
+// putRecompression records the recompressed layers of a transferred job, if there are any
+func (c *Client) putRecompression(job *transfer.Job) {
+	if len(job.Recompressed) == 0 {
+		return
+	}
+
+	recompression := Recompression{
+		Image:       job.Source.GetRegistry() + "/" + job.Source.GetRepository() + ":" + job.Source.GetTag(),
+		Target:      job.TargetName(),
+		Compression: job.Compression,
+		Layers:      len(job.Recompressed),
+	}
+	for _, layer := range job.Recompressed {
+		recompression.SourceSize += layer.SourceSize
+		recompression.TargetSize += layer.Size
+	}
+	c.conversionsMutex.Lock()
+	defer c.conversionsMutex.Unlock()
+	c.recompressions = append(c.recompressions, recompression)
+}
+
+// Recompressions returns the images whose layers are recompressed by the transfer
+func (c *Client) Recompressions() []Recompression {
+	c.conversionsMutex.Lock()
+	defer c.conversionsMutex.Unlock()
+	return append([]Recompression(nil), c.recompressions...)
+}
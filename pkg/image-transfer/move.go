@@ -0,0 +1,277 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package imagetransfer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"tkestack.io/image-transfer/pkg/apis/ccrapis"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/transfer"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// DeletionMove is the reason of the source tags deleted once they are transferred
+const DeletionMove = "move"
+
+// movedImage is a source tag whose target is verified to have the same manifest digest
+type movedImage struct {
+	url    string
+	tag    string
+	digest digest.Digest
+}
+
+// IsMove checks if the source image registry/repository:tag is deleted once it is transferred,
+// it is moved by flag move or by a rule with move option
+func (c *Client) IsMove(registry, repository, tag string) bool {
+	if c.Config.FlagConf.Config.Move {
+		return true
+	}
+
+	for source, rule := range c.Config.Rules {
+		if !rule.Move {
+			continue
+		}
+		sourceURL, err := utils.NewRepoURL(source)
+		if err != nil || sourceURL.GetURLWithoutTag() != registry+"/"+repository {
+			continue
+		}
+		if sourceURL.GetTag() == "" || utils.IsContain(strings.Split(sourceURL.GetTag(), ","), tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyMove reads the digests of the source and target of a finished job again, the source is
+// only deleted if they are still the ones transferred, the target one may differ from the source
+// one as the manifest can be converted
+func (c *Client) verifyMove(job *transfer.Job) {
+	image := job.Source.GetRegistry() + "/" + job.Source.GetRepository() + ":" + job.Source.GetTag()
+
+	sourceDigest, err := job.Source.GetImageDigest()
+	if err != nil {
+		c.refuseMove(image, "", fmt.Sprintf("get source digest error: %v", err))
+		return
+	}
+	if sourceDigest != job.SourceDigest {
+		c.refuseMove(image, sourceDigest, fmt.Sprintf("source digest differs from the transferred digest %s", job.SourceDigest))
+		return
+	}
+	targetDigest, err := job.Target.GetImageDigest()
+	if err != nil {
+		c.refuseMove(image, sourceDigest, fmt.Sprintf("get target digest error: %v", err))
+		return
+	}
+	if targetDigest != job.TargetDigest {
+		c.refuseMove(image, sourceDigest, fmt.Sprintf("target digest %s differs from the pushed digest %s", targetDigest, job.TargetDigest))
+		return
+	}
+
+	c.PutMovedImage(job.Source, sourceDigest)
+}
+
+// PutMovedImage records a source image whose target has the same digest, if the image is moved
+func (c *Client) PutMovedImage(imageSource transfer.Source, sourceDigest digest.Digest) {
+	if !c.IsMove(imageSource.GetRegistry(), imageSource.GetRepository(), imageSource.GetTag()) {
+		return
+	}
+
+	c.movedImagesMutex.Lock()
+	defer c.movedImagesMutex.Unlock()
+	c.movedImages = append(c.movedImages, movedImage{
+		url:    imageSource.GetRegistry() + "/" + imageSource.GetRepository() + ":" + imageSource.GetTag(),
+		tag:    imageSource.GetTag(),
+		digest: sourceDigest,
+	})
+}
+
+// refuseMove records that a source image is not deleted
+func (c *Client) refuseMove(image string, sourceDigest digest.Digest, reason string) {
+	log.Error("Refuse to delete moved image", c.logFields(log.String(log.ImageKey, image),
+		log.String(log.DigestKey, sourceDigest.String()), log.String("reason", reason))...)
+	c.PutDeletion(Deletion{Image: image, Digest: sourceDigest.String(), Reason: DeletionMove, Error: reason})
+}
+
+// DeleteMovedSources deletes the source tags of the images moved by the transfer, a tag is kept if
+// it no longer has the digest its target was verified with
+func (c *Client) DeleteMovedSources() {
+	c.movedImagesMutex.Lock()
+	movedImages := c.movedImages
+	c.movedImages = nil
+	c.movedImagesMutex.Unlock()
+
+	repositories := map[string][]movedImage{}
+	for _, moved := range movedImages {
+		repository := strings.TrimSuffix(moved.url, ":"+moved.tag)
+		repositories[repository] = append(repositories[repository], moved)
+	}
+	if len(repositories) == 0 {
+		return
+	}
+	log.Info("Start to delete moved images", c.logFields(log.Int("images", len(movedImages)),
+		log.Int("repositories", len(repositories)))...)
+
+	repositoryChan := make(chan string, len(repositories))
+	for repository := range repositories {
+		repositoryChan <- repository
+	}
+	close(repositoryChan)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < c.Config.FlagConf.Config.RoutineNums; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for repository := range repositoryChan {
+				c.deleteMovedRepository(repository, repositories[repository])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// deleteMovedRepository deletes the moved images of a source repository
+func (c *Client) deleteMovedRepository(repository string, movedImages []movedImage) {
+	sort.Slice(movedImages, func(i, j int) bool {
+		return movedImages[i].tag < movedImages[j].tag
+	})
+
+	repoURL, err := utils.NewRepoURL(repository)
+	if err != nil {
+		for _, moved := range movedImages {
+			c.refuseMove(moved.url, moved.digest, fmt.Sprintf("url %s format error: %v", repository, err))
+		}
+		return
+	}
+	security, _ := c.Config.GetSecuritySpecific(repoURL.GetRegistry(), repoURL.GetNamespace())
+	getDigest := func(tag string) (digest.Digest, error) {
+		imageSource, err := transfer.NewImageSource(repoURL.GetRegistry(), repoURL.GetRepoWithNamespace(), tag,
+			security.Username, security.Password, security.Insecure)
+		if err != nil {
+			return "", err
+		}
+		defer imageSource.Close()
+		return imageSource.GetImageDigest()
+	}
+
+	// the tags are checked before any of them is deleted, as the tags sharing a manifest are
+	// gone with the first of them
+	var deletable []movedImage
+	for _, moved := range movedImages {
+		currentDigest, err := getDigest(moved.tag)
+		switch {
+		case err != nil:
+			c.refuseMove(moved.url, moved.digest, fmt.Sprintf("get source digest error: %v", err))
+		case currentDigest != moved.digest:
+			c.refuseMove(moved.url, moved.digest, fmt.Sprintf("source digest has changed to %s", currentDigest))
+		default:
+			deletable = append(deletable, moved)
+		}
+	}
+	if len(deletable) == 0 {
+		return
+	}
+
+	if c.Config.FlagConf.Config.CCRToTCR {
+		c.deleteMovedCcrTags(repoURL, deletable)
+		return
+	}
+
+	// deleting a manifest through the registry api deletes all its tags, the manifests still referred
+	// by tags which are not moved are kept
+	imageSource, err := transfer.NewImageSource(repoURL.GetRegistry(), repoURL.GetRepoWithNamespace(), "",
+		security.Username, security.Password, security.Insecure)
+	if err != nil {
+		for _, moved := range deletable {
+			c.refuseMove(moved.url, moved.digest, fmt.Sprintf("generate image source error: %v", err))
+		}
+		return
+	}
+	tags, err := imageSource.GetSourceRepoTags()
+	if err != nil {
+		for _, moved := range deletable {
+			c.refuseMove(moved.url, moved.digest, fmt.Sprintf("get tags error: %v", err))
+		}
+		return
+	}
+
+	movedTags := map[string]bool{}
+	for _, moved := range movedImages {
+		movedTags[moved.tag] = true
+	}
+	keptDigests := map[digest.Digest]string{}
+	for _, tag := range tags {
+		if movedTags[tag] {
+			continue
+		}
+		keptDigest, err := getDigest(tag)
+		if err != nil {
+			for _, moved := range deletable {
+				c.refuseMove(moved.url, moved.digest, fmt.Sprintf("get digest of tag %s error: %v", tag, err))
+			}
+			return
+		}
+		keptDigests[keptDigest] = tag
+	}
+
+	deletedDigests := map[digest.Digest]bool{}
+	for _, moved := range deletable {
+		if keptTag, exist := keptDigests[moved.digest]; exist {
+			c.refuseMove(moved.url, moved.digest, fmt.Sprintf("its manifest is also referred by tag %s which is not moved", keptTag))
+			continue
+		}
+		if !deletedDigests[moved.digest] {
+			if err := imageSource.DeleteManifest(moved.digest); err != nil {
+				c.refuseMove(moved.url, moved.digest, err.Error())
+				continue
+			}
+			deletedDigests[moved.digest] = true
+		}
+		log.Info("Deleted moved image", c.logFields(log.String(log.ImageKey, moved.url), log.String(log.TagKey, moved.tag),
+			log.String(log.DigestKey, moved.digest.String()))...)
+		c.PutDeletion(Deletion{Image: moved.url, Digest: moved.digest.String(), Reason: DeletionMove})
+	}
+}
+
+// deleteMovedCcrTags deletes the moved tags of a ccr repository by ccr api
+func (c *Client) deleteMovedCcrTags(repoURL *utils.RepoURL, movedImages []movedImage) {
+	secretID, secretKey, err := ccrapis.GetCcrSecret(c.Config.Secret)
+	if err != nil {
+		for _, moved := range movedImages {
+			c.refuseMove(moved.url, moved.digest, err.Error())
+		}
+		return
+	}
+
+	ccrClient := ccrapis.NewCCRAPIClient()
+	for _, moved := range movedImages {
+		if err := ccrClient.DeleteImagePersonal(secretID, secretKey, c.Config.FlagConf.Config.CCRRegion,
+			repoURL.GetRepoWithNamespace(), moved.tag); err != nil {
+			c.refuseMove(moved.url, moved.digest, err.Error())
+			continue
+		}
+		log.Info("Deleted moved image", c.logFields(log.String(log.ImageKey, moved.url), log.String(log.TagKey, moved.tag),
+			log.String(log.DigestKey, moved.digest.String()))...)
+		c.PutDeletion(Deletion{Image: moved.url, Digest: moved.digest.String(), Reason: DeletionMove})
+	}
+}
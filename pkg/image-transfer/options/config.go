@@ -37,8 +37,19 @@ type ConfigOptions struct {
 	TCRRegion        string
 	TCRName          string
 	SecretFile       string
+	// BundleIndexFile imports the images of an exported bundle instead of a rule file
+	BundleIndexFile string
 	// if target tag is exist override it
 	TagExistOverridden bool
+	// Move deletes the source tags once they are transferred
+	Move bool
+	// ManifestFormat converts the manifests of the rules without their own format
+	ManifestFormat string
+	// Compression recompresses the layers of the rules without their own compression
+	Compression string
+	// Platform chooses the image of manifest lists for the docker-archive targets of the rules
+	// without their own platform
+	Platform string
 }
 
 // NewConfigOptions creates a NewConfigOptions object with default
@@ -86,5 +97,17 @@ func (o *ConfigOptions) AddFlags(fs *pflag.FlagSet) {
 		"tcr name. this flag is used when flag ccrToTcr=true")
 	fs.StringVar(&o.SecretFile, "secretFile", o.SecretFile,
 		"Tencent Cloud secretId 、secretKey for access ccr and tcr. this flag is used when flag ccrToTcr=true")
+	fs.StringVar(&o.BundleIndexFile, "bundleIndexFile", o.BundleIndexFile,
+		"Import all the images of an exported OCI layout or docker-archive bundle from its index file "+
+			"instead of a rule file, images are pushed to the default registry given by flag registry")
 	fs.BoolVar(&o.TagExistOverridden, "tag-exist-overridden", true, "if target tag is exist, override it")
+	fs.BoolVar(&o.Move, "move", false,
+		"mode: delete every source tag once the target has the same digest, default value is false. "+
+			"ccr tags are deleted by ccr api when flag ccrToTcr=true")
+	fs.StringVar(&o.ManifestFormat, "manifest-format", o.ManifestFormat,
+		"convert image manifests to schema2 or oci while transferring, manifests are kept as they are by default")
+	fs.StringVar(&o.Compression, "compression", o.Compression,
+		"recompress image layers with gzip or zstd while transferring, manifests are converted to oci for zstd, layers are kept as they are by default")
+	fs.StringVar(&o.Platform, "platform", o.Platform,
+		"os/arch[/variant] of the image taken from a manifest list for targets which can only store a single image, like docker-archive, the platform of the host by default")
 }
@@ -0,0 +1,53 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+// WorkerPool limits the transfer jobs running at the same time across all the clients
+// sharing it, whatever their own routine numbers are
+type WorkerPool struct {
+	slots chan struct{}
+}
+
+// NewWorkerPool creates a WorkerPool of size workers
+func NewWorkerPool(size int) *WorkerPool {
+	if size < 1 {
+		size = 1
+	}
+	return &WorkerPool{slots: make(chan struct{}, size)}
+}
+
+// Acquire blocks until a worker is free
+func (p *WorkerPool) Acquire() {
+	p.slots <- struct{}{}
+}
+
+// Release frees a worker taken by Acquire
+func (p *WorkerPool) Release() {
+	<-p.slots
+}
+
+// Size returns the number of workers
+func (p *WorkerPool) Size() int {
+	return cap(p.slots)
+}
+
+// Busy returns the number of workers running a job
+func (p *WorkerPool) Busy() int {
+	return len(p.slots)
+}
@@ -0,0 +1,251 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package imagetransfer
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"tkestack.io/image-transfer/pkg/transfer"
+)
+
+// Progress aggregates the progress events of the jobs of a transfer
+type Progress struct {
+	mutex     sync.Mutex
+	startedAt time.Time
+	updatedAt time.Time
+	images    map[*transfer.Job]*imageProgress
+	// transferred counts the bytes read from the sources, including the ones of failed attempts
+	transferred int64
+	version     uint64
+}
+
+type imageProgress struct {
+	image     string
+	target    string
+	started   bool
+	done      bool
+	failed    bool
+	blobs     int
+	blobsDone int
+	// size is -1 if the manifest does not know the sizes of the blobs
+	size      int64
+	bytesDone int64
+	running   map[digest.Digest]*BlobProgress
+}
+
+// ProgressSnapshot is the progress of a transfer at a time
+type ProgressSnapshot struct {
+	Images       int   `json:"images"`
+	ImagesDone   int   `json:"imagesDone"`
+	ImagesFailed int   `json:"imagesFailed"`
+	Blobs        int   `json:"blobs"`
+	BlobsDone    int   `json:"blobsDone"`
+	Bytes        int64 `json:"bytes"`
+	BytesDone    int64 `json:"bytesDone"`
+	// Throughput is the bytes transferred per second since the first image has started
+	Throughput float64 `json:"throughput"`
+	// ETA is the estimated seconds left, it is missing until some bytes are transferred
+	ETA *float64 `json:"eta,omitempty"`
+	// Running are the images being transferred
+	Running []ImageProgress `json:"running"`
+	// Version changes whenever the progress changes
+	Version uint64 `json:"version"`
+}
+
+// ImageProgress is the progress of an image being transferred
+type ImageProgress struct {
+	Image     string         `json:"image"`
+	Target    string         `json:"target"`
+	Blobs     int            `json:"blobs"`
+	BlobsDone int            `json:"blobsDone"`
+	Bytes     int64          `json:"bytes"`
+	BytesDone int64          `json:"bytesDone"`
+	Transfers []BlobProgress `json:"transfers"`
+}
+
+// BlobProgress is the progress of a blob being transferred
+type BlobProgress struct {
+	Digest string `json:"digest"`
+	// Size is -1 if the manifest does not know it
+	Size  int64 `json:"size"`
+	Bytes int64 `json:"bytes"`
+}
+
+// NewProgress creates a Progress without images
+func NewProgress() *Progress {
+	return &Progress{
+		images: make(map[*transfer.Job]*imageProgress),
+	}
+}
+
+// Add counts the image of a job generated by the transfer
+func (p *Progress) Add(job *transfer.Job) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, exist := p.images[job]; exist {
+		return
+	}
+	p.images[job] = &imageProgress{
+		image:  job.Source.GetRegistry() + "/" + job.Source.GetRepository() + ":" + job.Source.GetTag(),
+		target: job.TargetName(),
+	}
+	p.version++
+}
+
+// Report receives a progress event of job, it is the transfer.ProgressFunc of the jobs
+func (p *Progress) Report(job *transfer.Job, event transfer.ProgressEvent) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	image, exist := p.images[job]
+	if !exist {
+		return
+	}
+	p.version++
+	p.updatedAt = time.Now()
+
+	switch event.Kind {
+	case transfer.ProgressImageStarted:
+		if p.startedAt.IsZero() {
+			p.startedAt = time.Now()
+		}
+		// a retried image starts over
+		image.started = true
+		image.done = false
+		image.failed = false
+		image.blobs = event.Blobs
+		image.blobsDone = 0
+		image.size = event.Size
+		image.bytesDone = 0
+		image.running = make(map[digest.Digest]*BlobProgress)
+	case transfer.ProgressBlobBytes:
+		p.transferred += event.Bytes
+		image.bytesDone += event.Bytes
+		blob, exist := image.running[event.Blob.Digest]
+		if !exist {
+			blob = &BlobProgress{Digest: event.Blob.Digest.String(), Size: event.Blob.Size}
+			image.running[event.Blob.Digest] = blob
+		}
+		blob.Bytes += event.Bytes
+	case transfer.ProgressBlobDone:
+		image.blobsDone++
+		if event.Skipped && event.Blob.Size > 0 {
+			image.bytesDone += event.Blob.Size
+		}
+		delete(image.running, event.Blob.Digest)
+	case transfer.ProgressImageDone:
+		image.done = true
+		image.failed = event.Error != nil
+		image.running = nil
+		if !image.failed {
+			image.blobsDone = image.blobs
+			if image.size >= 0 {
+				image.bytesDone = image.size
+			}
+		}
+	}
+}
+
+// Snapshot returns the current progress
+func (p *Progress) Snapshot() ProgressSnapshot {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	snapshot := ProgressSnapshot{
+		Images:  len(p.images),
+		Running: []ImageProgress{},
+		Version: p.version,
+	}
+	var remaining, knownSize int64
+	knownImages, waitingImages := 0, 0
+	for _, image := range p.images {
+		switch {
+		case image.done && image.failed:
+			snapshot.ImagesFailed++
+		case image.done:
+			snapshot.ImagesDone++
+		}
+		if !image.started {
+			waitingImages++
+			continue
+		}
+
+		size := image.size
+		if size < 0 || size < image.bytesDone {
+			size = image.bytesDone
+		}
+		snapshot.Blobs += image.blobs
+		snapshot.BlobsDone += image.blobsDone
+		snapshot.Bytes += size
+		snapshot.BytesDone += image.bytesDone
+		if image.size >= 0 {
+			knownImages++
+			knownSize += image.size
+		}
+		if !image.done {
+			remaining += size - image.bytesDone
+			snapshot.Running = append(snapshot.Running, image.snapshot(size))
+		}
+	}
+	sort.Slice(snapshot.Running, func(i, j int) bool {
+		return snapshot.Running[i].Image < snapshot.Running[j].Image
+	})
+
+	if !p.startedAt.IsZero() {
+		// the throughput stays as it was once no image is being transferred
+		until := time.Now()
+		if len(snapshot.Running) == 0 {
+			until = p.updatedAt
+		}
+		if elapsed := until.Sub(p.startedAt).Seconds(); elapsed > 0 {
+			snapshot.Throughput = float64(p.transferred) / elapsed
+		}
+	}
+	if snapshot.Throughput > 0 {
+		// the images not started yet are guessed as large as the started ones
+		if knownImages > 0 {
+			remaining += knownSize / int64(knownImages) * int64(waitingImages)
+		}
+		eta := float64(remaining) / snapshot.Throughput
+		snapshot.ETA = &eta
+	}
+	return snapshot
+}
+
+func (i *imageProgress) snapshot(size int64) ImageProgress {
+	progress := ImageProgress{
+		Image:     i.image,
+		Target:    i.target,
+		Blobs:     i.blobs,
+		BlobsDone: i.blobsDone,
+		Bytes:     size,
+		BytesDone: i.bytesDone,
+		Transfers: []BlobProgress{},
+	}
+	for _, blob := range i.running {
+		progress.Transfers = append(progress.Transfers, *blob)
+	}
+	sort.Slice(progress.Transfers, func(a, b int) bool {
+		return progress.Transfers[a].Digest < progress.Transfers[b].Digest
+	})
+	return progress
+}
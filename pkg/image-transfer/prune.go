@@ -0,0 +1,193 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package imagetransfer
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/transfer"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// DeletionPrune is the reason of the tags deleted from a target as they are missing in the source
+const DeletionPrune = "prune"
+
+// Deletion is a tag deleted from a registry, or only listed by a dry run
+type Deletion struct {
+	Image  string `json:"image"`
+	Digest string `json:"digest,omitempty"`
+	Reason string `json:"reason"`
+	DryRun bool   `json:"dryRun,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (d Deletion) String() string {
+	deletion := d.Reason + " " + d.Image
+	if d.Digest != "" {
+		deletion += " " + d.Digest
+	}
+	switch {
+	case d.Error != "":
+		return deletion + " failed: " + d.Error
+	case d.DryRun:
+		return deletion + " (dry run)"
+	default:
+		return deletion
+	}
+}
+
+// PutDeletion records a deletion of the transfer
+func (c *Client) PutDeletion(deletion Deletion) {
+	c.deletionsMutex.Lock()
+	defer c.deletionsMutex.Unlock()
+	c.deletions = append(c.deletions, deletion)
+}
+
+// Deletions returns the deletions of the transfer
+func (c *Client) Deletions() []Deletion {
+	c.deletionsMutex.Lock()
+	defer c.deletionsMutex.Unlock()
+	return append([]Deletion(nil), c.deletions...)
+}
+
+// GetTargetTags lists the tags of a target repository, there is none if it does not exist
+func (c *Client) GetTargetTags(targetURL *utils.RepoURL) ([]string, error) {
+	targetSecurity, _ := c.Config.GetSecuritySpecific(targetURL.GetRegistry(), targetURL.GetNamespace())
+	imageTarget, err := transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), "",
+		targetSecurity.Username, targetSecurity.Password, targetSecurity.Insecure)
+	if err != nil {
+		return nil, fmt.Errorf("generate %s image target error: %v", targetURL.GetURL(), err)
+	}
+
+	tags, err := imageTarget.GetTargetRepoTags()
+	log.Debug("Get target tags", c.logFields(log.String(log.RepositoryKey, targetURL.GetURLWithoutTag()),
+		log.Strings("tags", tags))...)
+	if err != nil {
+		return nil, fmt.Errorf("get tags failed from %s error: %v", targetURL.GetURL(), err)
+	}
+	return tags, nil
+}
+
+// PruneTarget deletes the targetTags of the repository of targetURL which are missing in sourceTags.
+// Nothing is deleted if there are more of them than the limit of options, and a tag is kept if its
+// manifest is also referred by a tag of the source, as deleting a manifest deletes all its tags.
+func (c *Client) PruneTarget(targetURL *utils.RepoURL, sourceTags, targetTags []string, options configs.PruneOptions) {
+	var staleTags, keptTags []string
+	for _, tag := range targetTags {
+		if utils.IsContain(sourceTags, tag) {
+			keptTags = append(keptTags, tag)
+		} else {
+			staleTags = append(staleTags, tag)
+		}
+	}
+	repository := targetURL.GetURLWithoutTag()
+	if len(staleTags) == 0 {
+		log.Info("Nothing to prune", c.logFields(log.String(log.RepositoryKey, repository))...)
+		return
+	}
+	sort.Strings(staleTags)
+
+	refuse := func(reason string) {
+		log.Error("Refuse to prune", c.logFields(log.String(log.RepositoryKey, repository), log.String("reason", reason))...)
+		for _, tag := range staleTags {
+			c.PutDeletion(Deletion{Image: repository + ":" + tag, Reason: DeletionPrune, DryRun: options.DryRun, Error: reason})
+		}
+	}
+
+	if maxDeletions := options.GetMaxDeletions(); len(staleTags) > maxDeletions {
+		refuse(fmt.Sprintf("%d tags to delete exceed the limit of %d deletions", len(staleTags), maxDeletions))
+		return
+	}
+
+	keptDigests := map[digest.Digest]string{}
+	for _, tag := range keptTags {
+		keptDigest, err := c.getTargetDigest(targetURL, tag)
+		if err != nil {
+			refuse(fmt.Sprintf("get digest of kept tag %s error: %v", tag, err))
+			return
+		}
+		keptDigests[keptDigest] = tag
+	}
+
+	log.Info("Prune stale tags", c.logFields(log.String(log.RepositoryKey, repository), log.Strings("tags", staleTags))...)
+	deletedDigests := map[digest.Digest]bool{}
+	for _, tag := range staleTags {
+		deletion := Deletion{Image: repository + ":" + tag, Reason: DeletionPrune, DryRun: options.DryRun}
+
+		staleDigest, err := c.getTargetDigest(targetURL, tag)
+		if err != nil {
+			deletion.Error = fmt.Sprintf("get digest error: %v", err)
+			log.Error("Prune tag error", c.logFields(log.String(log.ImageKey, deletion.Image), log.String(log.TagKey, tag),
+				log.String("error", deletion.Error))...)
+			c.PutDeletion(deletion)
+			continue
+		}
+		deletion.Digest = staleDigest.String()
+
+		if keptTag, exist := keptDigests[staleDigest]; exist {
+			log.Warn("Skip prune, the manifest is also referred by a tag of the source", c.logFields(
+				log.String(log.ImageKey, deletion.Image), log.String(log.TagKey, tag),
+				log.String(log.DigestKey, staleDigest.String()), log.String("kept_tag", keptTag))...)
+			continue
+		}
+
+		// the tags sharing a manifest are gone with the first of them
+		if !options.DryRun && !deletedDigests[staleDigest] {
+			if err := c.deleteTargetManifest(targetURL, staleDigest); err != nil {
+				deletion.Error = err.Error()
+				log.Error("Prune tag error", c.logFields(log.String(log.ImageKey, deletion.Image), log.String(log.TagKey, tag),
+					log.String(log.DigestKey, staleDigest.String()), log.Err(err))...)
+				c.PutDeletion(deletion)
+				continue
+			}
+			deletedDigests[staleDigest] = true
+		}
+
+		log.Info("Pruned tag", c.logFields(log.String(log.ImageKey, deletion.Image), log.String(log.TagKey, tag),
+			log.String(log.DigestKey, staleDigest.String()), log.Bool("dry_run", options.DryRun))...)
+		c.PutDeletion(deletion)
+	}
+}
+
+// getTargetDigest returns the manifest digest of tag in the repository of targetURL
+func (c *Client) getTargetDigest(targetURL *utils.RepoURL, tag string) (digest.Digest, error) {
+	targetSecurity, _ := c.Config.GetSecuritySpecific(targetURL.GetRegistry(), targetURL.GetNamespace())
+	imageTarget, err := transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), tag,
+		targetSecurity.Username, targetSecurity.Password, targetSecurity.Insecure)
+	if err != nil {
+		return "", err
+	}
+	defer imageTarget.Close()
+	return imageTarget.GetImageDigest()
+}
+
+// deleteTargetManifest deletes the manifest with manifestDigest from the repository of targetURL
+func (c *Client) deleteTargetManifest(targetURL *utils.RepoURL, manifestDigest digest.Digest) error {
+	targetSecurity, _ := c.Config.GetSecuritySpecific(targetURL.GetRegistry(), targetURL.GetNamespace())
+	imageTarget, err := transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), "",
+		targetSecurity.Username, targetSecurity.Password, targetSecurity.Insecure)
+	if err != nil {
+		return err
+	}
+	defer imageTarget.Close()
+	return imageTarget.DeleteManifest(manifestDigest)
+}
@@ -21,8 +21,10 @@ package imagetransfer
 import (
 	"container/list"
 	"fmt"
+	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"tkestack.io/image-transfer/configs"
@@ -48,8 +50,24 @@ type Client struct {
 	failedJobList              *list.List
 	failedJobGenerateList      *list.List
 	failedGenNormalURLPairList *list.List
+	// succeededJobs counts the jobs transferred, including the retried ones
+	succeededJobs int64
+	// deletions are the tags deleted from the registries
+	deletions []Deletion
+	// movedImages are the source tags to delete once the transfer is finished
+	movedImages []movedImage
+	// conversions are the images whose manifests are converted
+	conversions []Conversion
+	// recompressions are the images whose layers are recompressed
+	recompressions []Recompression
 
 	Config *configs.Configs
+	// Workers limits the running jobs together with other clients if it is set
+	Workers *WorkerPool
+	// Progress aggregates the progress of the jobs
+	Progress *Progress
+	// JobID is the queue job the transfer runs for, if any, it is logged with the transfer jobs
+	JobID string
 	//finished generate ccrToTcr urlPair
 	urlPairFinished bool
 	// mutex
@@ -60,12 +78,16 @@ type Client struct {
 	failedJobGenerateListMutex      sync.Mutex
 	failedGenNormalURLPairListMutex sync.Mutex
 	urlPairFinishedMutex            sync.Mutex
+	deletionsMutex                  sync.Mutex
+	movedImagesMutex                sync.Mutex
+	conversionsMutex                sync.Mutex
 }
 
 // URLPair is a pair of source and target url
 type URLPair struct {
-	source string
-	target string
+	source  string
+	target  string
+	options configs.TransferOptions
 }
 
 // Run is main function of a transfer client
@@ -177,7 +199,7 @@ func (c *Client) RetryCreateTcrNs(tcrClient *tcrapis.TCRAPIClient, retryList []s
 		c.Config.FlagConf.Config.TCRRegion, c.Config.FlagConf.Config.TCRName)
 	log.Debugf("tcr namespaces is %s", tcrNs)
 	if err != nil {
-		log.Errorf("retry create tcr ns, get tcr ns error: ", err)
+		log.Errorf("retry create tcr ns, get tcr ns error: %s", err)
 		return nil, err
 	}
 
@@ -225,6 +247,19 @@ func (c *Client) CreateTcrNs(tcrClient *tcrapis.TCRAPIClient, ccrNs, tcrNs []str
 
 // NormalTransfer is the normal mode of transfer
 func (c *Client) NormalTransfer(imageList map[string]string, ccrClient *ccrapis.CCRAPIClient, tcrClient *tcrapis.TCRAPIClient, repoChan chan string) error {
+	urlPairs := []*URLPair{}
+	for source, target := range imageList {
+		urlPairs = append(urlPairs, &URLPair{
+			source:  source,
+			target:  target,
+			options: c.Config.GetTransferOptions(source),
+		})
+	}
+	return c.transfer(urlPairs, repoChan)
+}
+
+// transfer copies the images of urlPairs, or of the ccr repositories sent to repoChan in ccrToTcr mode
+func (c *Client) transfer(urlPairs []*URLPair, repoChan chan string) error {
 	jobListChan := make(chan *transfer.Job, c.Config.FlagConf.Config.RoutineNums)
 	log.Info("Start to handle transfer jobs, please wait ...")
 	wg := sync.WaitGroup{}
@@ -246,11 +281,8 @@ func (c *Client) NormalTransfer(imageList map[string]string, ccrClient *ccrapis.
 		}()
 	} else {
 		// Normal progress is urlPairList --> NormalPairList --> jobListChan
-		for source, target := range imageList {
-			c.urlPairList.PushBack(&URLPair{
-				source: source,
-				target: target,
-			})
+		for _, urlPair := range urlPairs {
+			c.urlPairList.PushBack(urlPair)
 		}
 
 		// carry urlPair to NormalURLPair
@@ -299,13 +331,122 @@ func (c *Client) NormalTransfer(imageList map[string]string, ccrClient *ccrapis.
 		}
 	}
 
+	// sources are deleted only when all the retries are done
+	c.DeleteMovedSources()
+
+	if conversions := c.Conversions(); len(conversions) != 0 {
+		log.Infof("################# %v converted manifests: #################", len(conversions))
+		for _, conversion := range conversions {
+			log.Info(conversion.String())
+		}
+	}
+
+	if recompressions := c.Recompressions(); len(recompressions) != 0 {
+		summary := Summary{Recompressions: recompressions}
+		log.Infof("################# %v recompressed images, %v bytes saved: #################",
+			len(recompressions), summary.RecompressionSaved())
+		for _, recompression := range recompressions {
+			log.Info(recompression.String())
+		}
+	}
+
+	if deletions := c.Deletions(); len(deletions) != 0 {
+		log.Infof("################# %v tag deletions: #################", len(deletions))
+		for _, deletion := range deletions {
+			log.Infof(deletion.String())
+		}
+	}
+
 	log.Infof("################# Finished, %v transfer jobs failed, %v normal urlPair generate failed, %v jobs generate failed #################",
 		c.failedJobList.Len(), c.failedGenNormalURLPairList.Len(), c.failedJobGenerateList.Len())
 
+	// finish the docker-archive files and bundle indexes of exported images
+	if err := transfer.CloseArchives(); err != nil {
+		log.Errorf("Close archives error: %v", err)
+		return err
+	}
+
 	return nil
 
 }
 
+// Summary counts the jobs and failures of a transfer
+type Summary struct {
+	SucceededJobs      int             `json:"succeededJobs"`
+	FailedJobs         int             `json:"failedJobs"`
+	FailedURLPairs     int             `json:"failedURLPairs"`
+	FailedJobGenerates int             `json:"failedJobGenerates"`
+	DeletedTags        int             `json:"deletedTags"`
+	FailedDeletions    int             `json:"failedDeletions"`
+	Deletions          []Deletion      `json:"deletions,omitempty"`
+	Conversions        []Conversion    `json:"conversions,omitempty"`
+	Recompressions     []Recompression `json:"recompressions,omitempty"`
+}
+
+// Failed checks if anything of the transfer has failed
+func (s Summary) Failed() bool {
+	return s.FailedJobs+s.FailedURLPairs+s.FailedJobGenerates+s.FailedDeletions > 0
+}
+
+func (s Summary) String() string {
+	summary := fmt.Sprintf("%v transfer jobs succeeded, %v transfer jobs failed, %v normal urlPair generate failed, %v jobs generate failed",
+		s.SucceededJobs, s.FailedJobs, s.FailedURLPairs, s.FailedJobGenerates)
+	if len(s.Deletions) != 0 {
+		summary += fmt.Sprintf(", %v tags deleted, %v deletions failed", s.DeletedTags, s.FailedDeletions)
+	}
+	if len(s.Conversions) != 0 {
+		summary += fmt.Sprintf(", %v manifests converted", len(s.Conversions))
+	}
+	if len(s.Recompressions) != 0 {
+		summary += fmt.Sprintf(", %v images recompressed saving %v bytes", len(s.Recompressions), s.RecompressionSaved())
+	}
+	return summary
+}
+
+// RecompressionSaved returns the bytes saved by recompressing layers, it is negative if they grow
+func (s Summary) RecompressionSaved() int64 {
+	var saved int64
+	for _, recompression := range s.Recompressions {
+		saved += recompression.Saved()
+	}
+	return saved
+}
+
+// add counts the jobs and failures of other in s
+func (s *Summary) add(other Summary) {
+	s.SucceededJobs += other.SucceededJobs
+	s.FailedJobs += other.FailedJobs
+	s.FailedURLPairs += other.FailedURLPairs
+	s.FailedJobGenerates += other.FailedJobGenerates
+	s.DeletedTags += other.DeletedTags
+	s.FailedDeletions += other.FailedDeletions
+	s.Deletions = append(s.Deletions, other.Deletions...)
+	s.Conversions = append(s.Conversions, other.Conversions...)
+	s.Recompressions = append(s.Recompressions, other.Recompressions...)
+}
+
+// Summary returns the failures left after the retries of the finished transfer
+func (c *Client) Summary() Summary {
+	summary := Summary{
+		SucceededJobs:      int(atomic.LoadInt64(&c.succeededJobs)),
+		FailedJobs:         c.failedJobList.Len(),
+		FailedURLPairs:     c.failedGenNormalURLPairList.Len(),
+		FailedJobGenerates: c.failedJobGenerateList.Len(),
+		Deletions:          c.Deletions(),
+		Conversions:        c.Conversions(),
+		Recompressions:     c.Recompressions(),
+	}
+	for _, deletion := range summary.Deletions {
+		switch {
+		case deletion.Error != "":
+			summary.FailedDeletions++
+		case !deletion.DryRun:
+			summary.DeletedTags++
+		}
+	}
+	return summary
+}
+
 // Retry is retry the failed job
 func (c *Client) Retry() {
 	retryJobListChan := make(chan *transfer.Job, c.Config.FlagConf.Config.RoutineNums)
@@ -326,7 +467,7 @@ func (c *Client) Retry() {
 			if failedJob == nil {
 				break
 			}
-			log.Infof("put failed job to failedJobListChan %s/%s:%s %s/%s:%s", failedJob.Value.(*transfer.Job).Source.GetRegistry(), failedJob.Value.(*transfer.Job).Source.GetRepository(), failedJob.Value.(*transfer.Job).Source.GetTag(), failedJob.Value.(*transfer.Job).Target.GetRegistry(), failedJob.Value.(*transfer.Job).Target.GetRepository(), failedJob.Value.(*transfer.Job).Target.GetTag())
+			log.Info("Retry failed job", failedJob.Value.(*transfer.Job).LogFields()...)
 			failedJobListChan <- failedJob.Value.(*transfer.Job)
 			c.failedJobList.Remove(failedJob)
 		}
@@ -370,6 +511,11 @@ func NewTransferClient(opts *options.ClientOptions) (*Client, error) {
 		return nil, err
 	}
 
+	return NewTransferClientWithConfigs(clientConfig), nil
+}
+
+// NewTransferClientWithConfigs creates a transfer client of clientConfig
+func NewTransferClientWithConfigs(clientConfig *configs.Configs) *Client {
 	return &Client{
 		jobList:                         list.New(),
 		urlPairList:                     list.New(),
@@ -378,13 +524,14 @@ func NewTransferClient(opts *options.ClientOptions) (*Client, error) {
 		normalURLPairList:               list.New(),
 		failedGenNormalURLPairList:      list.New(),
 		Config:                          clientConfig,
+		Progress:                        NewProgress(),
 		jobListMutex:                    sync.Mutex{},
 		urlPairListMutex:                sync.Mutex{},
 		failedJobListMutex:              sync.Mutex{},
 		failedJobGenerateListMutex:      sync.Mutex{},
 		urlPairFinishedMutex:            sync.Mutex{},
 		failedGenNormalURLPairListMutex: sync.Mutex{},
-	}, nil
+	}
 }
 
 func (c *Client) rulesHandler(jobListChan chan *transfer.Job) {
@@ -399,23 +546,25 @@ func (c *Client) rulesHandler(jobListChan chan *transfer.Job) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			defer log.Debugf("exit rule handler main loop")
+			defer log.Debug("Exit rule handler main loop", c.logFields()...)
 			for {
 				urlPair, empty := c.GetNormalURLPair()
 				// no more job to generate
 				if empty && c.IsURLPairFinished() {
-					log.Debugf("url pair is empty")
+					log.Debug("URL pair is empty", c.logFields()...)
 					break
 				}
 				if empty {
-					log.Debugf("not finieshed but url pair is empty")
+					log.Debug("Not finished but url pair is empty", c.logFields()...)
 					time.Sleep(100 * time.Millisecond)
 					continue
 				}
-				log.Infof("generate job source %s, target %s", urlPair.source, urlPair.target)
-				err := c.GenerateTransferJob(jobListChan, urlPair.source, urlPair.target)
+				log.Info("Generate job", c.logFields(log.String(log.SourceKey, urlPair.source),
+					log.String(log.TargetKey, urlPair.target))...)
+				err := c.GenerateTransferJob(jobListChan, urlPair.source, urlPair.target, urlPair.options)
 				if err != nil {
-					log.Errorf("Generate transfer job %s to %s error: %v", urlPair.source, urlPair.target, err)
+					log.Error("Generate transfer job error", c.logFields(log.String(log.SourceKey, urlPair.source),
+						log.String(log.TargetKey, urlPair.target), log.Err(err))...)
 					// put to failedJobGenerateList
 					c.PutAFailedURLPair(urlPair)
 				}
@@ -438,8 +587,8 @@ func (c *Client) jobsHandler(jobListChan chan *transfer.Job) {
 				if !ok {
 					break
 				}
-				if err := job.Run(); err != nil {
-					log.Errorf("handle job failed %s/%s:%s, %s", job.Source.GetRegistry(), job.Source.GetRepository(), job.Source.GetTag(), err)
+				if err := c.runJob(job); err != nil {
+					log.Error("handle job failed", job.LogFields(log.Err(err))...)
 					c.PutAFailedJob(job)
 				}
 			}
@@ -450,6 +599,45 @@ func (c *Client) jobsHandler(jobListChan chan *transfer.Job) {
 
 }
 
+// logSecurity logs if the auth information of the image of url is found, the action, pull or
+// push, is anonymous otherwise
+func (c *Client) logSecurity(url string, security configs.Security, exist bool, action string) {
+	if exist {
+		log.Info("Find auth information", c.logFields(log.String(log.ImageKey, url),
+			log.String("username", security.Username))...)
+		return
+	}
+	log.Info("Cannot find auth information, actions will be anonymous", c.logFields(log.String(log.ImageKey, url),
+		log.String("action", action))...)
+}
+
+// logFields returns the fields of the log entries of the client followed by fields
+func (c *Client) logFields(fields ...log.Field) []log.Field {
+	if c.JobID == "" {
+		return fields
+	}
+	return append([]log.Field{log.String(log.JobIDKey, c.JobID)}, fields...)
+}
+
+// runJob runs job on a worker of the shared pool if there is one
+func (c *Client) runJob(job *transfer.Job) error {
+	if c.Workers != nil {
+		c.Workers.Acquire()
+		defer c.Workers.Release()
+	}
+	if err := job.Run(); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.succeededJobs, 1)
+	c.putConversion(job)
+	c.putRecompression(job)
+
+	if c.IsMove(job.Source.GetRegistry(), job.Source.GetRepository(), job.Source.GetTag()) {
+		c.verifyMove(job)
+	}
+	return nil
+}
+
 // GetURLPair gets a URLPair from urlPairList
 func (c *Client) GetURLPair() (*URLPair, bool) {
 	c.urlPairListMutex.Lock()
@@ -525,7 +713,7 @@ func (c *Client) PutJob(job *transfer.Job) {
 }
 
 // GenerateTransferJob creates transfer jobs from normalURLPair
-func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source string, target string) error {
+func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source string, target string, options configs.TransferOptions) error {
 	if source == "" {
 		return fmt.Errorf("source url should not be empty")
 	}
@@ -539,6 +727,10 @@ func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source stri
 		return fmt.Errorf("target url should not be empty")
 	}
 
+	if utils.IsArchiveURL(target) {
+		return c.GenerateArchiveJob(jobListChan, sourceURL, target, options)
+	}
+
 	targetURL, err := utils.NewRepoURL(target)
 	if err != nil {
 		return fmt.Errorf("url %s format error: %v", target, err)
@@ -557,19 +749,10 @@ func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source stri
 	var imageTarget *transfer.ImageTarget
 
 	sourceSecurity, exist := c.Config.GetSecuritySpecific(sourceURL.GetRegistry(), sourceURL.GetNamespace())
-	if exist {
-		log.Infof("Find auth information for %v, username: %v", sourceURL.GetURL(), sourceSecurity.Username)
-	} else {
-		log.Infof("Cannot find auth information for %v, pull actions will be anonymous", sourceURL.GetURL())
-	}
+	c.logSecurity(sourceURL.GetURL(), sourceSecurity, exist, "pull")
 
 	targetSecurity, exist := c.Config.GetSecuritySpecific(targetURL.GetRegistry(), targetURL.GetNamespace())
-	if exist {
-		log.Infof("Find auth information for %v, username: %v", targetURL.GetURL(), targetSecurity.Username)
-
-	} else {
-		log.Infof("Cannot find auth information for %v, push actions will be anonymous", targetURL.GetURL())
-	}
+	c.logSecurity(targetURL.GetURL(), targetSecurity, exist, "push")
 
 	imageSource, err = transfer.NewImageSource(sourceURL.GetRegistry(), sourceURL.GetRepoWithNamespace(), sourceURL.GetTag(), sourceSecurity.Username, sourceSecurity.Password, sourceSecurity.Insecure)
 	if err != nil {
@@ -581,12 +764,57 @@ func (c *Client) GenerateTransferJob(jobListChan chan *transfer.Job, source stri
 		return fmt.Errorf("generate %s image target error: %v", sourceURL.GetURL(), err)
 	}
 
-	jobListChan <- transfer.NewJob(imageSource, imageTarget)
+	jobListChan <- c.newJob(imageSource, imageTarget, options)
+
+	log.Info("Generate a job", c.logFields(log.String(log.SourceKey, sourceURL.GetURL()),
+		log.String(log.TargetKey, targetURL.GetURL()))...)
+	return nil
+}
+
+// GenerateArchiveJob creates a transfer job which exports an image to an OCI layout or docker-archive
+func (c *Client) GenerateArchiveJob(jobListChan chan *transfer.Job, sourceURL *utils.RepoURL, target string, options configs.TransferOptions) error {
+	if sourceURL.GetTag() == "" {
+		return fmt.Errorf("source tag empty, source: %s", sourceURL.GetURL())
+	}
+
+	location, name := utils.ParseArchiveURL(target)
+	if name == "" {
+		return fmt.Errorf("image name empty, target: %s", target)
+	}
 
-	log.Infof("Generate a job for %s to %s", sourceURL.GetURL(), targetURL.GetURL())
+	sourceSecurity, exist := c.Config.GetSecuritySpecific(sourceURL.GetRegistry(), sourceURL.GetNamespace())
+	c.logSecurity(sourceURL.GetURL(), sourceSecurity, exist, "pull")
+
+	imageSource, err := transfer.NewImageSource(sourceURL.GetRegistry(), sourceURL.GetRepoWithNamespace(), sourceURL.GetTag(), sourceSecurity.Username, sourceSecurity.Password, sourceSecurity.Insecure)
+	if err != nil {
+		return fmt.Errorf("generate %s image source error: %v", sourceURL.GetURL(), err)
+	}
+
+	repository, tag := utils.SplitArchiveName(name)
+	imageTarget, err := transfer.NewImageTarget(location, repository, tag, "", "", false)
+	if err != nil {
+		return fmt.Errorf("generate %s image target error: %v", target, err)
+	}
+
+	jobListChan <- c.newJob(imageSource, imageTarget, options)
+
+	log.Info("Generate a job", c.logFields(log.String(log.SourceKey, sourceURL.GetURL()),
+		log.String(log.TargetKey, target))...)
 	return nil
 }
 
+// newJob creates a transfer job with the transfer options of its rule
+func (c *Client) newJob(imageSource *transfer.ImageSource, imageTarget *transfer.ImageTarget, options configs.TransferOptions) *transfer.Job {
+	job := transfer.NewJob(imageSource, imageTarget)
+	job.ManifestFormat = options.ManifestFormat
+	job.Compression = options.Compression
+	job.Platform = options.Platform
+	job.Progress = c.Progress.Report
+	job.JobID = c.JobID
+	c.Progress.Add(job)
+	return job
+}
+
 // GetFailedJob gets a failed job from failedJobList
 func (c *Client) GetFailedJob() (*transfer.Job, bool) {
 	c.failedJobListMutex.Lock()
@@ -675,7 +903,7 @@ func (c *Client) PutAFailedGenNormalURLPair(failedURLPair *URLPair) {
 }
 
 // GenJobFilterTag is hornor by TagExistOverridden policy, skip generate job if tag in target and tag digest is same
-func (c *Client) GenJobFilterTag(sourceTags, targetTags []string, sourceURL, targetURL *utils.RepoURL, sourceSecurity, targetSecurity configs.Security, wg *sync.WaitGroup) {
+func (c *Client) GenJobFilterTag(sourceTags, targetTags []string, sourceURL, targetURL *utils.RepoURL, sourceSecurity, targetSecurity configs.Security, options configs.TransferOptions, wg *sync.WaitGroup) {
 	tagChan := make(chan string, len(sourceTags))
 	wg.Add(1)
 	go func() {
@@ -692,54 +920,67 @@ func (c *Client) GenJobFilterTag(sourceTags, targetTags []string, sourceURL, tar
 			defer wg.Done()
 			for tag := range tagChan {
 				urlPair := &URLPair{
-					source: sourceURL.GetURL() + ":" + tag,
-					target: targetURL.GetURL() + ":" + tag,
+					source:  sourceURL.GetURL() + ":" + tag,
+					target:  targetURL.GetURL() + ":" + tag,
+					options: options,
 				}
 
-				log.Debugf("handle tag %s", urlPair.source)
+				log.Debug("Handle tag", c.logFields(log.String(log.SourceKey, urlPair.source), log.String(log.TagKey, tag))...)
 				//source tag exist in target
 				if utils.IsContain(targetTags, tag) {
 					if !c.Config.FlagConf.Config.TagExistOverridden {
-						log.Warnf("Skip push image, target image %s/%s:%s already exist, flag \"--tag-exist-overridden\" is set so skip", targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), tag)
+						log.Warn("Skip push image, target image already exists and flag --tag-exist-overridden is false",
+							c.logFields(log.String(log.TargetKey, urlPair.target), log.String(log.TagKey, tag))...)
 						continue
 					}
 					imageSource, err := transfer.NewImageSource(sourceURL.GetRegistry(), sourceURL.GetRepoWithNamespace(),
 						tag, sourceSecurity.Username, sourceSecurity.Password, sourceSecurity.Insecure)
 					if err != nil {
-						log.Errorf("generate %s image source error: %v", sourceURL.GetURL(), err)
+						log.Error("Generate image source error", c.logFields(log.String(log.SourceKey, urlPair.source),
+							log.String(log.TagKey, tag), log.Err(err))...)
 						c.PutAFailedGenNormalURLPair(urlPair)
 						continue
 					}
 
 					imageTarget, err := transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), tag, targetSecurity.Username, targetSecurity.Password, targetSecurity.Insecure)
 					if err != nil {
-						log.Errorf("generate %s image target error: %v", targetURL.GetURL(), err)
+						log.Error("Generate image target error", c.logFields(log.String(log.TargetKey, urlPair.target),
+							log.String(log.TagKey, tag), log.Err(err))...)
 						c.PutAFailedGenNormalURLPair(urlPair)
 						continue
 					}
 					sourceDigest, err := imageSource.GetImageDigest()
 					if err != nil {
-						log.Errorf("Failed to get source image digest from %s/%s:%s error: %v", imageSource.GetRegistry(), imageSource.GetRepository(), tag, err)
+						log.Error("Failed to get source image digest", c.logFields(log.String(log.SourceKey, urlPair.source),
+							log.String(log.TagKey, tag), log.Err(err))...)
 						c.PutAFailedGenNormalURLPair(urlPair)
 						continue
 					}
 					targetDigest, err := imageTarget.GetImageDigest()
 					if err != nil {
-						log.Errorf("Failed to get target image digest from %s/%s:%s error: %v", imageTarget.GetRegistry(), imageTarget.GetRepository(), tag, err)
+						log.Error("Failed to get target image digest", c.logFields(log.String(log.TargetKey, urlPair.target),
+							log.String(log.TagKey, tag), log.Err(err))...)
 						c.PutAFailedGenNormalURLPair(urlPair)
 						continue
 					}
 
 					if sourceDigest == targetDigest {
-						log.Infof("Skip push image, target image %s/%s:%s already exist and has same digest %s", imageTarget.GetRegistry(), imageTarget.GetRepository(), imageTarget.GetTag(), sourceDigest)
+						log.Info("Skip push image, target image already exists and has the same digest", c.logFields(
+							log.String(log.SourceKey, urlPair.source), log.String(log.TargetKey, urlPair.target),
+							log.String(log.TagKey, tag), log.String(log.DigestKey, sourceDigest.String()))...)
+						c.PutMovedImage(imageSource, sourceDigest)
 						continue
 					}
 
 					if targetDigest != "" {
-						log.Warnf("Target image %s/%s:%s already exist, target digest %s to be override as source digest %s", imageTarget.GetRegistry(), imageTarget.GetRepository(), imageTarget.GetTag(), targetDigest, sourceDigest)
+						log.Warn("Target image already exists and is overridden", c.logFields(
+							log.String(log.SourceKey, urlPair.source), log.String(log.TargetKey, urlPair.target),
+							log.String(log.TagKey, tag), log.String(log.DigestKey, sourceDigest.String()),
+							log.String("target_digest", targetDigest.String()))...)
 					}
 				}
-				log.Infof("put normal url pair %v", urlPair)
+				log.Info("Put normal url pair", c.logFields(log.String(log.SourceKey, urlPair.source),
+					log.String(log.TargetKey, urlPair.target))...)
 				c.PutNormalURLPair(urlPair)
 			}
 		}()
@@ -754,18 +995,20 @@ func (c *Client) HandleCcrToTCrTags(repoChan chan string) error {
 		go func() {
 			defer wg.Done()
 			for ccrRepo := range repoChan {
-				log.Infof("ccr repo is %s", ccrRepo)
+				log.Info("Handle ccr repository", c.logFields(log.String(log.RepositoryKey, ccrRepo))...)
 				source := fmt.Sprintf("%s%s%s", ccrapis.RegionPrefix[c.Config.FlagConf.Config.CCRRegion], ".ccs.tencentyun.com/", ccrRepo)
 				target := c.Config.FlagConf.Config.TCRName + ".tencentcloudcr.com/" + ccrRepo
 				urlPair := &URLPair{
-					source: source,
-					target: target,
+					source:  source,
+					target:  target,
+					options: c.Config.GetTransferOptions(source),
 				}
 
 				err := c.GenCcrtoTcrTagURLPair(source, target, &wg)
 				if err != nil {
 					c.PutAFailedGenNormalURLPair(urlPair)
-					log.Errorf("Handle repoChan tags failed error, %s", err)
+					log.Error("Handle ccr repository tags error", c.logFields(log.String(log.SourceKey, source),
+						log.String(log.TargetKey, target), log.Err(err))...)
 				}
 			}
 		}()
@@ -789,7 +1032,7 @@ func (c *Client) IsURLPairFinished() bool {
 }
 
 // GenTagURLPair is generate normal image url that containt tag
-func (c *Client) GenTagURLPair(source string, target string, wg *sync.WaitGroup) error {
+func (c *Client) GenTagURLPair(source string, target string, options configs.TransferOptions, wg *sync.WaitGroup) error {
 	if source == "" {
 		return fmt.Errorf("source url should not be empty")
 	}
@@ -799,16 +1042,36 @@ func (c *Client) GenTagURLPair(source string, target string, wg *sync.WaitGroup)
 		return fmt.Errorf("url %s format error: %v", source, err)
 	}
 
+	if utils.IsWildcardSource(source) {
+		return c.GenWildcardURLPair(sourceURL, target, options, wg)
+	}
+
 	// if dest is not specific, use default registry and src repo
 	if target == "" {
 		if c.Config.FlagConf.Config.DefaultRegistry != "" {
+			imageURL := sourceURL
+			if sourceURL.IsArchive() {
+				// images inside an archive are named after the url they were exported from
+				imageURL, err = utils.NewRepoURL(sourceURL.GetRepoWithTag())
+				if err != nil {
+					return fmt.Errorf("url %s format error: %v", source, err)
+				}
+			}
 			target = c.Config.FlagConf.Config.DefaultRegistry + "/" +
-				sourceURL.GetNamespace() + "/" + sourceURL.GetRepoWithTag()
+				imageURL.GetNamespace() + "/" + imageURL.GetRepoWithTag()
 		} else {
 			return fmt.Errorf("the default registry and namespace should not be nil if you want to use them")
 		}
 	}
 
+	if utils.IsTargetTemplate(target) {
+		return c.GenTemplateURLPair(sourceURL, target, options, wg)
+	}
+
+	if utils.IsArchiveURL(target) {
+		return c.GenArchiveURLPair(sourceURL, target, options)
+	}
+
 	targetURL, err := utils.NewRepoURL(target)
 	if err != nil {
 		return fmt.Errorf("url %s format error: %v", target, err)
@@ -818,19 +1081,10 @@ func (c *Client) GenTagURLPair(source string, target string, wg *sync.WaitGroup)
 	var imageTarget *transfer.ImageTarget
 
 	sourceSecurity, exist := c.Config.GetSecuritySpecific(sourceURL.GetRegistry(), sourceURL.GetNamespace())
-	if exist {
-		log.Infof("Find auth information for %v, username: %v", sourceURL.GetURL(), sourceSecurity.Username)
-	} else {
-		log.Infof("Cannot find auth information for %v, pull actions will be anonymous", sourceURL.GetURL())
-	}
+	c.logSecurity(sourceURL.GetURL(), sourceSecurity, exist, "pull")
 
 	targetSecurity, exist := c.Config.GetSecuritySpecific(targetURL.GetRegistry(), targetURL.GetNamespace())
-	if exist {
-		log.Infof("Find auth information for %v, username: %v", targetURL.GetURL(), targetSecurity.Username)
-
-	} else {
-		log.Infof("Cannot find auth information for %v, push actions will be anonymous", targetURL.GetURL())
-	}
+	c.logSecurity(targetURL.GetURL(), targetSecurity, exist, "push")
 
 	// multi-tags config
 	tags := sourceURL.GetTag()
@@ -839,17 +1093,17 @@ func (c *Client) GenTagURLPair(source string, target string, wg *sync.WaitGroup)
 			return fmt.Errorf("multi-tags source should not correspond to a target with tag: %s:%s",
 				sourceURL.GetURL(), targetURL.GetURL())
 		}
-		log.Debugf("source %s tags is %s", sourceURL.GetURL(), moreTag)
+		log.Debug("Get source tags", c.logFields(log.String(log.SourceKey, sourceURL.GetURL()), log.Strings("tags", moreTag))...)
 		imageTarget, err = transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), targetURL.GetTag(), targetSecurity.Username, targetSecurity.Password, targetSecurity.Insecure)
 		if err != nil {
 			return fmt.Errorf("generate %s image target error: %v", sourceURL.GetURL(), err)
 		}
 		targetTags, err := imageTarget.GetTargetRepoTags()
-		log.Debugf("target %s tags is %s", targetURL.GetURL(), targetTags)
+		log.Debug("Get target tags", c.logFields(log.String(log.TargetKey, targetURL.GetURL()), log.Strings("tags", targetTags))...)
 		if err != nil {
 			return fmt.Errorf("get tags failed from %s error: %v", targetURL.GetURL(), err)
 		}
-		c.GenJobFilterTag(moreTag, targetTags, sourceURL, targetURL, sourceSecurity, targetSecurity, wg)
+		c.GenJobFilterTag(moreTag, targetTags, sourceURL, targetURL, sourceSecurity, targetSecurity, options, wg)
 		return nil
 	}
 
@@ -872,18 +1126,24 @@ func (c *Client) GenTagURLPair(source string, target string, wg *sync.WaitGroup)
 
 		// get all tags of this source repo
 		sourceTags, err := imageSource.GetSourceRepoTags()
-		log.Debugf("source %s tags is %s", sourceURL.GetURL(), sourceTags)
+		log.Debug("Get source tags", c.logFields(log.String(log.SourceKey, sourceURL.GetURL()), log.Strings("tags", sourceTags))...)
 		if err != nil {
 			return fmt.Errorf("get tags failed from %s error: %v", sourceURL.GetURL(), err)
 		}
 
 		targetTags, err := imageTarget.GetTargetRepoTags()
-		log.Debugf("target %s tags is %s", targetURL.GetURL(), targetTags)
+		log.Debug("Get target tags", c.logFields(log.String(log.TargetKey, targetURL.GetURL()), log.Strings("tags", targetTags))...)
 		if err != nil {
 			return fmt.Errorf("get tags failed from %s error: %v", targetURL.GetURL(), err)
 		}
 
-		c.GenJobFilterTag(sourceTags, targetTags, sourceURL, targetURL, sourceSecurity, targetSecurity, wg)
+		// prune before the copies are queued, deleting a stale manifest deletes all its tags, and a tag
+		// pushed meanwhile with the same manifest would be gone with it
+		if rule := c.Config.Rules[source]; rule.Prune.Enabled {
+			c.PruneTarget(targetURL, sourceTags, targetTags, rule.Prune)
+		}
+
+		c.GenJobFilterTag(sourceTags, targetTags, sourceURL, targetURL, sourceSecurity, targetSecurity, options, wg)
 		return nil
 	}
 
@@ -901,28 +1161,183 @@ func (c *Client) GenTagURLPair(source string, target string, wg *sync.WaitGroup)
 
 	sourceDigest, err := imageSource.GetImageDigest()
 	if err != nil {
-		log.Errorf("Failed to get source image digest from %s/%s:%s error: %v", imageSource.GetRegistry(), imageSource.GetRepository(), sourceURL.GetTag(), err)
+		log.Error("Failed to get source image digest", c.logFields(log.String(log.SourceKey, source),
+			log.String(log.TagKey, sourceURL.GetTag()), log.Err(err))...)
 		return err
 	}
 	targetDigest, err := imageTarget.GetImageDigest()
 	if err == nil {
 		if sourceDigest == targetDigest {
-			log.Infof("Skip push image, target image %s/%s:%s already exist and has same digest %s", imageTarget.GetRegistry(), imageTarget.GetRepository(), imageTarget.GetTag(), sourceDigest)
+			log.Info("Skip push image, target image already exists and has the same digest", c.logFields(
+				log.String(log.SourceKey, source), log.String(log.TargetKey, target),
+				log.String(log.TagKey, imageTarget.GetTag()), log.String(log.DigestKey, sourceDigest.String()))...)
+			c.PutMovedImage(imageSource, sourceDigest)
 			return nil
 		}
 	} else if !utils.IsDigestNotFound(err) {
-		log.Errorf("Failed to get target image digest from %s/%s:%s error: %v", imageTarget.GetRegistry(), imageTarget.GetRepository(), destTag, err)
+		log.Error("Failed to get target image digest", c.logFields(log.String(log.TargetKey, target),
+			log.String(log.TagKey, destTag), log.Err(err))...)
 		return err
 	}
 
 	c.PutNormalURLPair(&URLPair{
-		source: source,
-		target: target,
+		source:  source,
+		target:  target,
+		options: options,
 	})
-	log.Infof("put normal url pair source: %s, target: %s", source, target)
+	log.Info("Put normal url pair", c.logFields(log.String(log.SourceKey, source), log.String(log.TargetKey, target))...)
+	return nil
+}
+
+// GenArchiveURLPair generates normal image urls that export every source tag to an OCI layout or
+// docker-archive, the image is named after its source url unless the target gives a name, a name
+// without tag keeps the tag of the source
+func (c *Client) GenArchiveURLPair(sourceURL *utils.RepoURL, target string, options configs.TransferOptions) error {
+	location, name := utils.ParseArchiveURL(target)
+
+	tags, err := c.GetSourceTags(sourceURL)
+	if err != nil {
+		return err
+	}
+
+	// like a registry target, a name without tag keeps the source tag
+	repository, targetTag := utils.SplitArchiveName(name)
+	if targetTag != "" && len(tags) > 1 {
+		return fmt.Errorf("multi-tags source should not correspond to an archive target with tag: %s:%s",
+			sourceURL.GetURL(), target)
+	}
+
+	for _, tag := range tags {
+		imageName := name
+		if repository == "" {
+			imageName = sourceURL.GetURLWithoutTag() + ":" + tag
+			if sourceURL.IsArchive() {
+				// keep the name the image has inside the source archive
+				imageName = sourceURL.GetRepo() + ":" + tag
+			}
+		} else if targetTag == "" {
+			imageName = repository + ":" + tag
+		}
+		urlPair := &URLPair{
+			source:  sourceURL.GetURLWithoutTag() + ":" + tag,
+			target:  location + ":" + imageName,
+			options: options,
+		}
+		c.PutNormalURLPair(urlPair)
+		log.Info("Put normal url pair", c.logFields(log.String(log.SourceKey, urlPair.source),
+			log.String(log.TargetKey, urlPair.target))...)
+	}
+	return nil
+}
+
+// GenTemplateURLPair renders a target template for every tag of the source, the rendered targets
+// are handled by GenTagURLPair as the rules written out in full
+func (c *Client) GenTemplateURLPair(sourceURL *utils.RepoURL, target string, options configs.TransferOptions, wg *sync.WaitGroup) error {
+	tags, err := c.GetSourceTags(sourceURL)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		renderedTarget, err := utils.RenderTarget(target, sourceURL, tag)
+		if err != nil {
+			return fmt.Errorf("render target %s for %s:%s error: %v", target, sourceURL.GetURLWithoutTag(), tag, err)
+		}
+
+		source := sourceURL.GetURLWithoutTag() + ":" + tag
+		log.Debug("Render target", c.logFields(log.String(log.SourceKey, source), log.String(log.TargetKey, renderedTarget),
+			log.String("template", target))...)
+		if err := c.GenTagURLPair(source, renderedTarget, options, wg); err != nil {
+			log.Error("Generate tag url pair error", c.logFields(log.String(log.SourceKey, source),
+				log.String(log.TargetKey, renderedTarget), log.Err(err))...)
+			c.PutAFailedGenNormalURLPair(&URLPair{
+				source:  source,
+				target:  renderedTarget,
+				options: options,
+			})
+		}
+	}
+	return nil
+}
+
+// GenWildcardURLPair handles every repository matching a wildcard source, like registry.a/teamx/*,
+// by GenTagURLPair with the target of the rule, which is a template or empty
+func (c *Client) GenWildcardURLPair(sourceURL *utils.RepoURL, target string, options configs.TransferOptions, wg *sync.WaitGroup) error {
+	sources, err := c.ExpandWildcardSource(sourceURL)
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		if err := c.GenTagURLPair(source.GetURL(), target, options, wg); err != nil {
+			log.Error("Generate tag url pair error", c.logFields(log.String(log.SourceKey, source.GetURL()),
+				log.String(log.TargetKey, target), log.Err(err))...)
+			c.PutAFailedGenNormalURLPair(&URLPair{
+				source:  source.GetURL(),
+				target:  target,
+				options: options,
+			})
+		}
+	}
 	return nil
 }
 
+// ExpandWildcardSource returns the repositories of the registry catalog matching the repository
+// pattern of a wildcard source, with the tags of the source
+func (c *Client) ExpandWildcardSource(sourceURL *utils.RepoURL) ([]*utils.RepoURL, error) {
+	sourceSecurity, exist := c.Config.GetSecuritySpecific(sourceURL.GetRegistry(), sourceURL.GetNamespace())
+	c.logSecurity(sourceURL.GetURL(), sourceSecurity, exist, "pull")
+
+	repositories, err := transfer.ListRepositories(sourceURL.GetRegistry(), sourceSecurity.Username,
+		sourceSecurity.Password, sourceSecurity.Insecure)
+	if err != nil {
+		return nil, err
+	}
+
+	pattern := sourceURL.GetRepoWithNamespace()
+	var sources []*utils.RepoURL
+	for _, repository := range repositories {
+		if matched, _ := path.Match(pattern, repository); !matched {
+			continue
+		}
+		source := sourceURL.GetRegistry() + "/" + repository
+		if sourceURL.GetTag() != "" {
+			source = source + ":" + sourceURL.GetTag()
+		}
+		expanded, err := utils.NewRepoURL(source)
+		if err != nil {
+			return nil, fmt.Errorf("url %s format error: %v", source, err)
+		}
+		sources = append(sources, expanded)
+	}
+	log.Info("Expand wildcard source", c.logFields(log.String(log.SourceKey, sourceURL.GetURL()),
+		log.Int("repositories", len(sources)))...)
+	return sources, nil
+}
+
+// GetSourceTags returns the tags given by a source url, all the tags of the source repository
+// are listed if the url has no tag
+func (c *Client) GetSourceTags(sourceURL *utils.RepoURL) ([]string, error) {
+	if sourceURL.GetTag() != "" {
+		return strings.Split(sourceURL.GetTag(), ","), nil
+	}
+
+	sourceSecurity, exist := c.Config.GetSecuritySpecific(sourceURL.GetRegistry(), sourceURL.GetNamespace())
+	c.logSecurity(sourceURL.GetURL(), sourceSecurity, exist, "pull")
+
+	imageSource, err := transfer.NewImageSource(sourceURL.GetRegistry(), sourceURL.GetRepoWithNamespace(), "", sourceSecurity.Username, sourceSecurity.Password, sourceSecurity.Insecure)
+	if err != nil {
+		return nil, fmt.Errorf("generate %s image source error: %v", sourceURL.GetURL(), err)
+	}
+
+	tags, err := imageSource.GetSourceRepoTags()
+	log.Debug("Get source tags", c.logFields(log.String(log.SourceKey, sourceURL.GetURL()), log.Strings("tags", tags))...)
+	if err != nil {
+		return nil, fmt.Errorf("get tags failed from %s error: %v", sourceURL.GetURL(), err)
+	}
+	return tags, nil
+}
+
 // HandleURLPair put urlPair to normalURLPair
 func (c *Client) HandleURLPair() {
 	routineNum := c.Config.FlagConf.Config.RoutineNums
@@ -932,18 +1347,19 @@ func (c *Client) HandleURLPair() {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			defer log.Infof("exit HandleURLPair main loop")
+			defer log.Info("Exit HandleURLPair main loop", c.logFields()...)
 			for {
 				urlPair, empty := c.GetURLPair()
 				// no more job to generate
 				if empty {
-					log.Infof("HandleURLPair is empty")
+					log.Info("HandleURLPair is empty", c.logFields()...)
 					break
 				}
 
-				err := c.GenTagURLPair(urlPair.source, urlPair.target, &wg)
+				err := c.GenTagURLPair(urlPair.source, urlPair.target, urlPair.options, &wg)
 				if err != nil {
-					log.Errorf("Generate tag urlPair %s to %s error: %v", urlPair.source, urlPair.target, err)
+					log.Error("Generate tag url pair error", c.logFields(log.String(log.SourceKey, urlPair.source),
+						log.String(log.TargetKey, urlPair.target), log.Err(err))...)
 					// put to failedGenNormalURLPair
 					c.PutAFailedGenNormalURLPair(urlPair)
 				}
@@ -962,17 +1378,18 @@ func (c *Client) CcrtoTcrGenTagRetry() {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			defer log.Debugf("exit CcrtoTcrGenTagRetry main loop")
+			defer log.Debug("Exit CcrtoTcrGenTagRetry main loop", c.logFields()...)
 			for {
 				urlPair, empty := c.GetURLPair()
 				// no more job to generate
 				if empty {
-					log.Debugf("CcrtoTcrGenTagRetry url pair is empty")
+					log.Debug("CcrtoTcrGenTagRetry url pair is empty", c.logFields()...)
 					break
 				}
 				err := c.GenCcrtoTcrTagURLPair(urlPair.source, urlPair.target, &wg)
 				if err != nil {
-					log.Errorf("Generate tag urlPair %s to %s error: %v", urlPair.source, urlPair.target, err)
+					log.Error("Generate tag url pair error", c.logFields(log.String(log.SourceKey, urlPair.source),
+						log.String(log.TargetKey, urlPair.target), log.Err(err))...)
 					// put to failedGenNormalURLPair
 					c.PutAFailedGenNormalURLPair(urlPair)
 				}
@@ -985,8 +1402,9 @@ func (c *Client) CcrtoTcrGenTagRetry() {
 // GenCcrtoTcrTagURLPair is generate normal url pair
 func (c *Client) GenCcrtoTcrTagURLPair(source string, target string, wg *sync.WaitGroup) error {
 	urlPair := &URLPair{
-		source: source,
-		target: target,
+		source:  source,
+		target:  target,
+		options: c.Config.GetTransferOptions(source),
 	}
 
 	sourceURL, err := utils.NewRepoURL(source)
@@ -1000,33 +1418,25 @@ func (c *Client) GenCcrtoTcrTagURLPair(source string, target string, wg *sync.Wa
 	}
 
 	sourceSecurity, exist := c.Config.GetSecuritySpecific(sourceURL.GetRegistry(), sourceURL.GetNamespace())
-	if exist {
-		log.Infof("Find auth information for %v, username: %v", sourceURL.GetURL(), sourceSecurity.Username)
-	} else {
-		log.Infof("Cannot find auth information for %v, pull actions will be anonymous", sourceURL.GetURL())
-	}
+	c.logSecurity(sourceURL.GetURL(), sourceSecurity, exist, "pull")
 
 	targetSecurity, exist := c.Config.GetSecuritySpecific(targetURL.GetRegistry(), targetURL.GetNamespace())
-	if exist {
-		log.Infof("Find auth information for %v, username: %v", targetURL.GetURL(), targetSecurity.Username)
-
-	} else {
-		log.Infof("Cannot find auth information for %v, push actions will be anonymous", targetURL.GetURL())
-	}
+	c.logSecurity(targetURL.GetURL(), targetSecurity, exist, "push")
 
 	if sourceURL.GetTag() == "" {
 		ccrClient := ccrapis.NewCCRAPIClient()
 
 		ccrSecretID, ccrSecretKey, err := ccrapis.GetCcrSecret(c.Config.Secret)
 		if err != nil {
-			log.Errorf("GetCcrSecret error: %s", err)
+			log.Error("GetCcrSecret error", c.logFields(log.Err(err))...)
 			return err
 		}
 
 		sourceTags, err := ccrClient.GetRepoTags(ccrSecretID, ccrSecretKey, c.Config.FlagConf.Config.CCRRegion, sourceURL.GetRepoWithNamespace(), int64(c.Config.FlagConf.Config.CCRTagNums))
-		log.Debugf("ccr target %s tags is %s", sourceURL.GetOriginURL(), sourceTags)
+		log.Debug("Get source tags", c.logFields(log.String(log.SourceKey, sourceURL.GetOriginURL()), log.Strings("tags", sourceTags))...)
 		if err != nil {
-			log.Errorf("Failed get ccr repo %s tags, error: %s", sourceURL.GetRepoWithNamespace(), err)
+			log.Error("Failed to get ccr repository tags", c.logFields(log.String(log.RepositoryKey, sourceURL.GetRepoWithNamespace()),
+				log.Err(err))...)
 			return fmt.Errorf("failed get ccr repo %s tags, error: %s", sourceURL.GetRepoWithNamespace(), err)
 		}
 
@@ -1036,13 +1446,13 @@ func (c *Client) GenCcrtoTcrTagURLPair(source string, target string, wg *sync.Wa
 		}
 
 		targetTags, err := imageTarget.GetTargetRepoTags()
-		log.Debugf("target %s tags is %s", targetURL.GetURL(), targetTags)
+		log.Debug("Get target tags", c.logFields(log.String(log.TargetKey, targetURL.GetURL()), log.Strings("tags", targetTags))...)
 		if err != nil {
 			return fmt.Errorf("get tags failed from %s error: %v", targetURL.GetURL(), err)
 		}
 
-		log.Debugf("GenCcrtoTcrTagURLPair call GenJobFilterTag")
-		c.GenJobFilterTag(sourceTags, targetTags, sourceURL, targetURL, sourceSecurity, targetSecurity, wg)
+		log.Debug("GenCcrtoTcrTagURLPair call GenJobFilterTag", c.logFields(log.String(log.SourceKey, source))...)
+		c.GenJobFilterTag(sourceTags, targetTags, sourceURL, targetURL, sourceSecurity, targetSecurity, urlPair.options, wg)
 		return nil
 	}
 
@@ -1060,21 +1470,26 @@ func (c *Client) GenCcrtoTcrTagURLPair(source string, target string, wg *sync.Wa
 
 	sourceDigest, err := imageSource.GetImageDigest()
 	if err != nil {
-		log.Errorf("Failed to get source image digest from %s/%s:%s error: %v", imageSource.GetRegistry(), imageSource.GetRepository(), sourceURL.GetTag(), err)
+		log.Error("Failed to get source image digest", c.logFields(log.String(log.SourceKey, source),
+			log.String(log.TagKey, sourceURL.GetTag()), log.Err(err))...)
 		return err
 	}
 	targetDigest, err := imageTarget.GetImageDigest()
 	if err != nil {
-		log.Errorf("Failed to get target image digest from %s/%s:%s error: %v", imageTarget.GetRegistry(), imageTarget.GetRepository(), targetURL.GetTag(), err)
+		log.Error("Failed to get target image digest", c.logFields(log.String(log.TargetKey, target),
+			log.String(log.TagKey, targetURL.GetTag()), log.Err(err))...)
 		return err
 	}
 
 	if sourceDigest == targetDigest {
-		log.Infof("Skip push image, target image %s/%s:%s already exist and has same digest %s", imageTarget.GetRegistry(), imageTarget.GetRepository(), imageTarget.GetTag(), sourceDigest)
+		log.Info("Skip push image, target image already exists and has the same digest", c.logFields(
+			log.String(log.SourceKey, source), log.String(log.TargetKey, target),
+			log.String(log.TagKey, imageTarget.GetTag()), log.String(log.DigestKey, sourceDigest.String()))...)
+		c.PutMovedImage(imageSource, sourceDigest)
 		return nil
 	}
 
 	c.PutNormalURLPair(urlPair)
-	log.Infof("put normal url pair source: %s, target: %s", source, target)
+	log.Info("Put normal url pair", c.logFields(log.String(log.SourceKey, source), log.String(log.TargetKey, target))...)
 	return nil
 }
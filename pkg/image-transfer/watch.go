@@ -0,0 +1,391 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package imagetransfer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"tkestack.io/image-transfer/configs"
+	"tkestack.io/image-transfer/pkg/image-transfer/options"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/transfer"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// CycleStatus is the result of a cycle of a Watcher
+type CycleStatus struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// Tags is the number of the source tags resolved from the rules
+	Tags int `json:"tags"`
+	// Unchanged tags have the same digest as the last cycle or the target
+	Unchanged int `json:"unchanged"`
+	// Changed tags are new or changed, and copied by the cycle
+	Changed int     `json:"changed"`
+	Summary Summary `json:"summary"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// WatchStatus is the state of a Watcher reported by its health endpoint
+type WatchStatus struct {
+	Status      string       `json:"status"`
+	Cycles      int          `json:"cycles"`
+	Running     bool         `json:"running"`
+	NextCycleAt *time.Time   `json:"nextCycleAt,omitempty"`
+	LastCycle   *CycleStatus `json:"lastCycle,omitempty"`
+}
+
+// Watcher keeps the targets of the rules in sync by copying the new or changed source tags
+// every interval
+type Watcher struct {
+	opts     *options.ClientOptions
+	interval time.Duration
+
+	lock sync.Mutex
+	// synced are the source digests the targets had in the last cycle by url pair
+	synced map[URLPair]digest.Digest
+	status WatchStatus
+}
+
+// NewWatcher creates a Watcher of the rules of opts
+func NewWatcher(opts *options.ClientOptions, interval time.Duration) *Watcher {
+	return &Watcher{
+		opts:     opts,
+		interval: interval,
+		synced:   map[URLPair]digest.Digest{},
+		status:   WatchStatus{Status: "starting"},
+	}
+}
+
+// Run runs a cycle every interval after the previous one has finished, it never returns
+func (w *Watcher) Run() {
+	for {
+		w.cycle()
+
+		next := time.Now().Add(w.interval)
+		w.lock.Lock()
+		w.status.NextCycleAt = &next
+		w.lock.Unlock()
+		log.Info("Wait for the next sync cycle", log.String("next_cycle_at", next.Format(time.RFC3339)))
+		time.Sleep(w.interval)
+	}
+}
+
+// Status returns the state of the watcher
+func (w *Watcher) Status() WatchStatus {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.status
+}
+
+// ServeHTTP reports the state of the watcher, it responds 503 if the last cycle has failed
+func (w *Watcher) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	status := w.Status()
+	code := http.StatusOK
+	if status.Status == "failing" {
+		code = http.StatusServiceUnavailable
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	// nolint: errcheck
+	json.NewEncoder(rw).Encode(status)
+}
+
+func (w *Watcher) cycle() {
+	w.lock.Lock()
+	w.status.Running = true
+	w.status.NextCycleAt = nil
+	cycle := log.Int("cycle", w.status.Cycles+1)
+	w.lock.Unlock()
+
+	result := &CycleStatus{StartedAt: time.Now().UTC()}
+	log.Info("Start sync cycle", cycle)
+	if err := w.sync(result); err != nil {
+		log.Error("Sync cycle error", cycle, log.Err(err))
+		result.Error = err.Error()
+	}
+	result.FinishedAt = time.Now().UTC()
+	log.Info("Finished sync cycle", cycle, log.Int("tags", result.Tags), log.Int("unchanged", result.Unchanged),
+		log.Int("changed", result.Changed), log.Stringer("summary", result.Summary))
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.status.Cycles++
+	w.status.Running = false
+	w.status.LastCycle = result
+	w.status.Status = "ok"
+	if result.Error != "" || result.Summary.Failed() {
+		w.status.Status = "failing"
+	}
+}
+
+// sync resolves the tags of the rules, which are read again in case they have changed, and
+// copies the tags whose digests differ from both the last cycle and the target
+func (w *Watcher) sync(result *CycleStatus) error {
+	clientConfig, err := configs.NewConfigs(w.opts)
+	if err != nil {
+		return err
+	}
+	if clientConfig.FlagConf.Config.CCRToTCR {
+		return errors.New("watch mode does not support ccrToTcr")
+	}
+	client := NewTransferClientWithConfigs(clientConfig)
+
+	var pairs []URLPair
+	for source, target := range clientConfig.ImageList {
+		resolved, err := w.resolve(client, source, target)
+		if err != nil {
+			log.Error("Resolve tags error", log.String(log.SourceKey, source), log.Err(err))
+			result.Summary.FailedURLPairs++
+			continue
+		}
+		pairs = append(pairs, resolved...)
+	}
+	result.Tags = len(pairs)
+
+	synced := map[URLPair]digest.Digest{}
+	changed := []*URLPair{}
+	var lock sync.Mutex
+	pairChan := make(chan URLPair, len(pairs))
+	for _, pair := range pairs {
+		pairChan <- pair
+	}
+	close(pairChan)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < clientConfig.FlagConf.Config.RoutineNums; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pair := range pairChan {
+				sourceDigest, unchanged, err := w.check(client, pair)
+
+				lock.Lock()
+				switch {
+				case err != nil:
+					log.Error("Check image error", log.String(log.SourceKey, pair.source),
+						log.String(log.TargetKey, pair.target), log.Err(err))
+					result.Summary.FailedURLPairs++
+				case unchanged:
+					synced[pair] = sourceDigest
+					result.Unchanged++
+				default:
+					changed = append(changed, &URLPair{
+						source:  pair.source,
+						target:  pair.target,
+						options: pair.options,
+					})
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the changed tags are checked again by the next cycle, once they are in the target
+	w.synced = synced
+	result.Changed = len(changed)
+	if len(changed) != 0 {
+		err = client.transfer(changed, nil)
+		// a converted target never has the source digest, the source digest is kept instead
+		for _, conversion := range client.Conversions() {
+			for _, pair := range changed {
+				if pair.source == conversion.Image && pair.target == conversion.Target {
+					synced[*pair] = digest.Digest(conversion.SourceDigest)
+				}
+			}
+		}
+	} else {
+		// the transfer deletes the moved sources otherwise
+		client.DeleteMovedSources()
+	}
+	result.Summary.add(client.Summary())
+	return err
+}
+
+// resolve lists the source tags of a rule with the targets they are copied to
+func (w *Watcher) resolve(client *Client, source, target string) ([]URLPair, error) {
+	sourceURL, err := utils.NewRepoURL(source)
+	if err != nil {
+		return nil, fmt.Errorf("url %s format error: %v", source, err)
+	}
+	if sourceURL.IsArchive() || utils.IsArchiveURL(target) {
+		return nil, errors.New("watch mode does not support archives")
+	}
+	options := client.Config.GetTransferOptions(source)
+
+	if utils.IsWildcardSource(source) {
+		sources, err := client.ExpandWildcardSource(sourceURL)
+		if err != nil {
+			return nil, err
+		}
+		pairs := []URLPair{}
+		for _, expanded := range sources {
+			resolved, err := w.resolveTags(client, expanded, target, options)
+			if err != nil {
+				return nil, err
+			}
+			pairs = append(pairs, resolved...)
+		}
+		return pairs, nil
+	}
+
+	tags, err := client.GetSourceTags(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if rule := client.Config.Rules[source]; rule.Prune.Enabled {
+		if err := w.prune(client, sourceURL, target, tags, rule.Prune); err != nil {
+			return nil, err
+		}
+	}
+
+	return w.pairs(sourceURL, tags, target, options)
+}
+
+// resolveTags resolves the tags of a source to their targets
+func (w *Watcher) resolveTags(client *Client, sourceURL *utils.RepoURL, target string, options configs.TransferOptions) ([]URLPair, error) {
+	tags, err := client.GetSourceTags(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	return w.pairs(sourceURL, tags, target, options)
+}
+
+// pairs returns the url pairs of the tags of a source and their targets
+func (w *Watcher) pairs(sourceURL *utils.RepoURL, tags []string, target string, options configs.TransferOptions) ([]URLPair, error) {
+	pairs := []URLPair{}
+	for _, tag := range tags {
+		resolved, err := w.resolveTarget(sourceURL, tag, target)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, URLPair{
+			source:  sourceURL.GetURLWithoutTag() + ":" + tag,
+			target:  resolved,
+			options: options,
+		})
+	}
+	return pairs, nil
+}
+
+// prune deletes the tags of the target repository of a rule which are missing in the source tags
+func (w *Watcher) prune(client *Client, sourceURL *utils.RepoURL, target string, tags []string, options configs.PruneOptions) error {
+	// the target of a pruned rule is a repository without tag
+	if target == "" {
+		if w.opts.Config.DefaultRegistry == "" {
+			return errors.New("the default registry and namespace should not be nil if you want to use them")
+		}
+		target = w.opts.Config.DefaultRegistry + "/" + sourceURL.GetNamespace() + "/" + sourceURL.GetRepo()
+	}
+	targetURL, err := utils.NewRepoURL(target)
+	if err != nil {
+		return fmt.Errorf("url %s format error: %v", target, err)
+	}
+
+	targetTags, err := client.GetTargetTags(targetURL)
+	if err != nil {
+		return err
+	}
+	client.PruneTarget(targetURL, tags, targetTags, options)
+	return nil
+}
+
+// resolveTarget returns the target of a source tag the way GenTagURLPair does
+func (w *Watcher) resolveTarget(sourceURL *utils.RepoURL, tag, target string) (string, error) {
+	if target == "" {
+		defaultRegistry := w.opts.Config.DefaultRegistry
+		if defaultRegistry == "" {
+			return "", errors.New("the default registry and namespace should not be nil if you want to use them")
+		}
+		return defaultRegistry + "/" + sourceURL.GetNamespace() + "/" + sourceURL.GetRepo() + ":" + tag, nil
+	}
+
+	if utils.IsTargetTemplate(target) {
+		return utils.RenderTarget(target, sourceURL, tag)
+	}
+
+	targetURL, err := utils.NewRepoURL(target)
+	if err != nil {
+		return "", fmt.Errorf("url %s format error: %v", target, err)
+	}
+	// a target tag only belongs to a rule of a single source tag
+	if targetURL.GetTag() != "" && !strings.Contains(sourceURL.GetTag(), ",") {
+		return targetURL.GetURL(), nil
+	}
+	return targetURL.GetURLWithoutTag() + ":" + tag, nil
+}
+
+// check returns the source digest of pair, and if it is unchanged since the last cycle or is
+// already in the target
+func (w *Watcher) check(client *Client, pair URLPair) (digest.Digest, bool, error) {
+	sourceURL, err := utils.NewRepoURL(pair.source)
+	if err != nil {
+		return "", false, err
+	}
+	targetURL, err := utils.NewRepoURL(pair.target)
+	if err != nil {
+		return "", false, err
+	}
+
+	sourceSecurity, _ := client.Config.GetSecuritySpecific(sourceURL.GetRegistry(), sourceURL.GetNamespace())
+	imageSource, err := transfer.NewImageSource(sourceURL.GetRegistry(), sourceURL.GetRepoWithNamespace(), sourceURL.GetTag(),
+		sourceSecurity.Username, sourceSecurity.Password, sourceSecurity.Insecure)
+	if err != nil {
+		return "", false, err
+	}
+	sourceDigest, err := imageSource.GetImageDigest()
+	if err != nil {
+		return "", false, err
+	}
+	if w.synced[pair] == sourceDigest {
+		return sourceDigest, true, nil
+	}
+
+	targetSecurity, _ := client.Config.GetSecuritySpecific(targetURL.GetRegistry(), targetURL.GetNamespace())
+	imageTarget, err := transfer.NewImageTarget(targetURL.GetRegistry(), targetURL.GetRepoWithNamespace(), targetURL.GetTag(),
+		targetSecurity.Username, targetSecurity.Password, targetSecurity.Insecure)
+	if err != nil {
+		return "", false, err
+	}
+	targetDigest, err := imageTarget.GetImageDigest()
+	if err != nil {
+		if utils.IsDigestNotFound(err) {
+			return sourceDigest, false, nil
+		}
+		return "", false, err
+	}
+	if targetDigest == sourceDigest {
+		client.PutMovedImage(imageSource, sourceDigest)
+		return sourceDigest, true, nil
+	}
+	if !client.Config.FlagConf.Config.TagExistOverridden {
+		return sourceDigest, true, nil
+	}
+	return sourceDigest, false, nil
+}
@@ -38,6 +38,12 @@ const (
 	IgnoreCallerFlagName = "log-ignore-caller"
 	// OutputPathsName path name
 	OutputPathsName = "log-output-paths"
+	// MaxSizeFlagName flag name
+	MaxSizeFlagName = "log-max-size"
+	// MaxBackupsFlagName flag name
+	MaxBackupsFlagName = "log-max-backups"
+	// MaxAgeFlagName flag name
+	MaxAgeFlagName = "log-max-age"
 )
 
 var (
@@ -47,18 +53,24 @@ var (
 	logFormat = pflag.String(FormatFlagName, "plain", "Log output `FORMAT`")
 	//logWithColor    = pflag.Bool(WithColorFlagName, false, "Whether to output colored log")
 	//logIgnoreCaller = pflag.Bool(IgnoreCallerFlagName, false, "Ignore the output of caller information in the log")
-	logOutputPaths = pflag.StringSlice(OutputPathsName, []string{}, "Log output paths, comma separated.")
+	logOutputPaths = pflag.StringSlice(OutputPathsName, []string{}, "Log output paths, comma separated, "+
+		"stdout, stderr or files rotated by size. Defaults to "+defaultLogFilePath)
+	logMaxSize    = pflag.Int(MaxSizeFlagName, 10240, "Maximum `MEGABYTES` of a log file before it is rotated")
+	logMaxBackups = pflag.Int(MaxBackupsFlagName, 0, "Maximum number of rotated log files to keep, 0 keeps all")
+	logMaxAge     = pflag.Int(MaxAgeFlagName, 0, "Maximum `DAYS` to keep rotated log files, 0 keeps them forever")
 )
 
 // AddFlags registers this package's flags on arbitrary FlagSets, such that they
 // point to the same value as the global flags.
 func AddFlags(fs *pflag.FlagSet) {
-	fs.AddFlag(pflag.Lookup(LevelFlagName))
-	fs.AddFlag(pflag.Lookup(FormatFlagName))
-	fs.AddFlag(pflag.Lookup(WithColorFlagName))
-	fs.AddFlag(pflag.Lookup(IgnoreCallerFlagName))
-	fs.AddFlag(pflag.Lookup(SamplingFreqFlagName))
-	fs.AddFlag(pflag.Lookup(OutputPathsName))
+	for _, name := range []string{LevelFlagName, FormatFlagName, WithColorFlagName,
+		IgnoreCallerFlagName, SamplingFreqFlagName, OutputPathsName, MaxSizeFlagName,
+		MaxBackupsFlagName, MaxAgeFlagName} {
+		// some of the flags are not registered
+		if flag := pflag.Lookup(name); flag != nil {
+			fs.AddFlag(flag)
+		}
+	}
 }
 
 // SetLevel to change the log level flag
@@ -129,6 +141,8 @@ func parseLevel() (string, error) {
 	switch *logLevel {
 	case "DEBUG", "debug", "dbg", "DBG":
 		return "DEBUG", nil
+	case "INFO", "info":
+		return "INFO", nil
 	case "WARN", "warn", "warning", "WARNING":
 		return "WARN", nil
 	case "ERROR", "error", "ERR", "err":
@@ -149,3 +163,24 @@ func MustParseLevel() string {
 	}
 	return "INFO"
 }
+
+// OutputPaths returns the log output paths, stdout, stderr or files
+func OutputPaths() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+	if len(*logOutputPaths) == 0 {
+		return []string{defaultLogFilePath}
+	}
+	return append([]string{}, *logOutputPaths...)
+}
+
+// OutputFiles returns the log output paths which are files
+func OutputFiles() []string {
+	var files []string
+	for _, path := range OutputPaths() {
+		if path != "stdout" && path != "stderr" {
+			files = append(files, path)
+		}
+	}
+	return files
+}
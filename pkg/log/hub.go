@@ -0,0 +1,233 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package log
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// hubSize is the number of recent entries kept for the subscribers resuming
+	hubSize = 1000
+	// subscriptionBuffer is the number of entries a subscriber may fall behind before entries are dropped
+	subscriptionBuffer = 256
+)
+
+// Entry is a log entry published to the subscribers of a Hub
+type Entry struct {
+	// ID increases from 1 with every entry published
+	ID      uint64
+	Time    time.Time
+	Level   zapcore.Level
+	Message string
+	// JobID is the job_id field of the entry, if any
+	JobID string
+	// Line is the entry in the console format
+	Line string
+	// Cleared marks the entry sent to the subscribers once the log is cleared, it carries no message
+	Cleared bool
+}
+
+// Filter chooses the entries sent to a subscriber
+type Filter struct {
+	// Level is the minimum level of the entries
+	Level zapcore.Level
+	// JobID matches the entries of a job if it is set
+	JobID string
+}
+
+// Match returns if the entry passes the filter, the cleared entries always pass
+func (f Filter) Match(entry Entry) bool {
+	if entry.Cleared {
+		return true
+	}
+	return entry.Level >= f.Level && (f.JobID == "" || entry.JobID == f.JobID)
+}
+
+// Hub fans the log entries out to its subscribers. Every subscriber has a bounded buffer, the entries
+// a subscriber is too slow to receive are dropped and counted instead of blocking the logging.
+type Hub struct {
+	mutex       sync.Mutex
+	entries     []Entry
+	lastID      uint64
+	subscribers map[*Subscription]struct{}
+}
+
+// Subscription receives the entries published to a Hub matching its filter
+type Subscription struct {
+	// C receives the entries
+	C       <-chan Entry
+	entries chan Entry
+	filter  Filter
+	dropped uint64
+	hub     *Hub
+}
+
+// NewHub creates a Hub without subscribers
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe receives the entries published from now on
+func (h *Hub) Subscribe(filter Filter) *Subscription {
+	subscription, _ := h.subscribe(filter, nil)
+	return subscription
+}
+
+// Resume receives the entries published from now on and returns the kept entries after the entry
+// after, so that a subscriber reconnecting misses nothing. An ID newer than the last entry, e.g. from
+// before a restart, is taken as the last one.
+func (h *Hub) Resume(filter Filter, after uint64) (*Subscription, []Entry) {
+	return h.subscribe(filter, &after)
+}
+
+func (h *Hub) subscribe(filter Filter, after *uint64) (*Subscription, []Entry) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	entries := make(chan Entry, subscriptionBuffer)
+	subscription := &Subscription{C: entries, entries: entries, filter: filter, hub: h}
+	h.subscribers[subscription] = struct{}{}
+
+	var missed []Entry
+	if after != nil {
+		for _, entry := range h.entries {
+			if entry.ID > *after && filter.Match(entry) {
+				missed = append(missed, entry)
+			}
+		}
+	}
+	return subscription, missed
+}
+
+// Publish sends an entry to the subscribers, its ID is set by the hub
+func (h *Hub) Publish(entry Entry) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.lastID++
+	entry.ID = h.lastID
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > hubSize {
+		h.entries = h.entries[len(h.entries)-hubSize:]
+	}
+	for subscription := range h.subscribers {
+		if !subscription.filter.Match(entry) {
+			continue
+		}
+		select {
+		case subscription.entries <- entry:
+		default:
+			atomic.AddUint64(&subscription.dropped, 1)
+		}
+	}
+}
+
+// Clear forgets the kept entries and tells the subscribers that the log is cleared
+func (h *Hub) Clear() {
+	h.mutex.Lock()
+	h.entries = nil
+	h.mutex.Unlock()
+	h.Publish(Entry{Time: time.Now(), Cleared: true})
+}
+
+// Dropped returns the number of entries dropped because the subscriber has fallen behind
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops the subscription, C is not closed
+func (s *Subscription) Close() {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+	delete(s.hub.subscribers, s)
+}
+
+// hubCore is a zapcore.Core publishing the entries to a Hub
+type hubCore struct {
+	zapcore.LevelEnabler
+	hub     *Hub
+	encoder zapcore.Encoder
+	jobID   string
+}
+
+func newHubCore(hub *Hub, encoder zapcore.Encoder, enabler zapcore.LevelEnabler) zapcore.Core {
+	return &hubCore{LevelEnabler: enabler, hub: hub, encoder: encoder}
+}
+
+func (c *hubCore) With(fields []zapcore.Field) zapcore.Core {
+	clone := *c
+	clone.encoder = c.encoder.Clone()
+	for _, field := range fields {
+		field.AddTo(clone.encoder)
+	}
+	if jobID := jobIDField(fields); jobID != "" {
+		clone.jobID = jobID
+	}
+	return &clone
+}
+
+func (c *hubCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *hubCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	line, err := c.encoder.EncodeEntry(entry, fields)
+	if err != nil {
+		return err
+	}
+	jobID := jobIDField(fields)
+	if jobID == "" {
+		jobID = c.jobID
+	}
+	c.hub.Publish(Entry{
+		Time:    entry.Time,
+		Level:   entry.Level,
+		Message: entry.Message,
+		JobID:   jobID,
+		Line:    strings.TrimRight(line.String(), "\n"),
+	})
+	line.Free()
+	return nil
+}
+
+func (c *hubCore) Sync() error {
+	return nil
+}
+
+// jobIDField returns the value of the last job_id string field
+func jobIDField(fields []zapcore.Field) string {
+	jobID := ""
+	for _, field := range fields {
+		if field.Key == JobIDKey && field.Type == zapcore.StringType {
+			jobID = field.String
+		}
+	}
+	return jobID
+}
@@ -20,6 +20,7 @@ package log
 
 import (
 	"fmt"
+	"os"
 	"sync"
 	"time"
 
@@ -31,12 +32,17 @@ import (
 var (
 	logger          *zap.Logger
 	once            sync.Once
-	logFilePath     = "./logs/app.log" // 指定日志文件路径
 	logWithColor    = false            // 是否启用彩色日志
 	logIgnoreCaller = false            // 是否忽略调用者信息
 	logSamplingFreq = time.Millisecond // 采样频率
 )
 
+// defaultLogFilePath is the log output when no output path is given
+const defaultLogFilePath = "./logs/app.log"
+
+// hub publishes the log entries to the subscribers of the live logs
+var hub = NewHub()
+
 // InitLogger initializes logger the way we want for tke.
 func InitLogger() {
 	once.Do(func() {
@@ -56,7 +62,8 @@ func FlushLogger() {
 
 // ZapLogger returns zap logger instance.
 func ZapLogger() *zap.Logger {
-	return getLogger()
+	// the callers use the zap logger directly instead of the functions of this package
+	return getLogger().WithOptions(zap.AddCallerSkip(-1))
 }
 
 // Reset to recreate the logger by changed flag params
@@ -110,32 +117,48 @@ func Fatal(msg string, fields ...zapcore.Field) {
 
 // Debugf uses fmt.Sprintf to log a templated message.
 func Debugf(template string, args ...interface{}) {
-	Debug(fmt.Sprintf(template, args...))
+	getLogger().Debug(fmt.Sprintf(template, args...))
 }
 
 // Infof uses fmt.Sprintf to log a templated message.
 func Infof(template string, args ...interface{}) {
-	Info(fmt.Sprintf(template, args...))
+	getLogger().Info(fmt.Sprintf(template, args...))
 }
 
 // Warnf uses fmt.Sprintf to log a templated message.
 func Warnf(template string, args ...interface{}) {
-	Warn(fmt.Sprintf(template, args...))
+	getLogger().Warn(fmt.Sprintf(template, args...))
 }
 
 // Errorf uses fmt.Sprintf to log a templated message.
 func Errorf(template string, args ...interface{}) {
-	Error(fmt.Sprintf(template, args...))
+	getLogger().Error(fmt.Sprintf(template, args...))
 }
 
 // Panicf uses fmt.Sprintf to log a templated message, then panics.
 func Panicf(template string, args ...interface{}) {
-	Panic(fmt.Sprintf(template, args...))
+	getLogger().Panic(fmt.Sprintf(template, args...))
 }
 
 // Fatalf uses fmt.Sprintf to log a templated message, then calls os.Exit.
 func Fatalf(template string, args ...interface{}) {
-	Fatal(fmt.Sprintf(template, args...))
+	getLogger().Fatal(fmt.Sprintf(template, args...))
+}
+
+// Subscribe receives the log entries matching filter logged from now on
+func Subscribe(filter Filter) *Subscription {
+	return hub.Subscribe(filter)
+}
+
+// Resume receives the log entries matching filter logged from now on and returns the recent ones
+// logged after the entry after
+func Resume(filter Filter, after uint64) (*Subscription, []Entry) {
+	return hub.Resume(filter, after)
+}
+
+// ClearEntries forgets the recent log entries and tells the subscribers that the log is cleared
+func ClearEntries() {
+	hub.Clear()
 }
 
 func getLogger() *zap.Logger {
@@ -160,23 +183,45 @@ func newLogger() *zap.Logger {
 		EncodeCaller:   zapcore.ShortCallerEncoder,
 	}
 
-	// 创建一个自定义编码器
-	writer := zapcore.AddSync(&lumberjack.Logger{
-		Filename:   logFilePath,
-		MaxSize:    10240, // megabytes
-		MaxBackups: 0,
-		MaxAge:     0, // days
-	})
+	encoder := zapcore.NewConsoleEncoder(encoderConfig)
+	if MustParseFormat() == "json" {
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	}
+	level := zap.NewAtomicLevelAt(mustLevel())
 
-	core := zapcore.NewCore(
-		zapcore.NewConsoleEncoder(encoderConfig), // 使用控制台编码器
-		writer,                                   // 输出到文件
-		zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
-			return lvl >= zapcore.InfoLevel
-		}),
+	core := zapcore.NewTee(
+		zapcore.NewCore(encoder, newWriter(), level),
+		// 同时发布给实时日志的订阅者，web 界面显示的日志总是控制台格式
+		newHubCore(hub, zapcore.NewConsoleEncoder(encoderConfig), level),
 	)
 
-	l := zap.New(core, zap.AddStacktrace(zapcore.PanicLevel), zap.AddCaller())
+	// Debugf 等函数与 Debug 等函数都经过一层调用，调用者需要跳过这一层
+	l := zap.New(core, zap.AddStacktrace(zapcore.PanicLevel), zap.AddCaller(), zap.AddCallerSkip(1))
 
 	return l
 }
+
+// newWriter writes to the log output paths, the files are rotated by size
+func newWriter() zapcore.WriteSyncer {
+	lock.RLock()
+	maxSize, maxBackups, maxAge := *logMaxSize, *logMaxBackups, *logMaxAge
+	lock.RUnlock()
+
+	var writers []zapcore.WriteSyncer
+	for _, path := range OutputPaths() {
+		switch path {
+		case "stdout":
+			writers = append(writers, zapcore.Lock(os.Stdout))
+		case "stderr":
+			writers = append(writers, zapcore.Lock(os.Stderr))
+		default:
+			writers = append(writers, zapcore.AddSync(&lumberjack.Logger{
+				Filename:   path,
+				MaxSize:    maxSize, // megabytes
+				MaxBackups: maxBackups,
+				MaxAge:     maxAge, // days
+			}))
+		}
+	}
+	return zapcore.NewMultiWriteSyncer(writers...)
+}
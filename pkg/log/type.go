@@ -26,6 +26,29 @@ import (
 // Field is an alias for the field structure in the underlying log frame
 type Field = zapcore.Field
 
+// The keys of the fields of the transfer log entries
+const (
+	// JobIDKey is the ID of the queue job the entry is logged for
+	JobIDKey = "job_id"
+	// SourceKey is the source image
+	SourceKey = "source"
+	// TargetKey is the target image
+	TargetKey = "target"
+	// DigestKey is the digest of a blob or a manifest
+	DigestKey = "digest"
+	// BytesKey is the size of a blob
+	BytesKey = "bytes"
+	// ImageKey is an image which is neither the source nor the target of a transfer, like a tag
+	// pruned or deleted
+	ImageKey = "image"
+	// RepositoryKey is a repository of images
+	RepositoryKey = "repository"
+	// TagKey is a tag of an image
+	TagKey = "tag"
+	// UserKey is the user a job is submitted or an action is taken by
+	UserKey = "user"
+)
+
 // nolint: golint
 var (
 	Any         = zap.Any
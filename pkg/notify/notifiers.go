@@ -0,0 +1,208 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the hex HMAC-SHA256 of the payload of the webhook notifier keyed
+	// by its secret, as sha256=<hex>
+	SignatureHeader = "X-Image-Transfer-Signature"
+	// EventHeader carries the outcome of the job
+	EventHeader = "X-Image-Transfer-Event"
+)
+
+// webhookNotifier posts the events as json
+type webhookNotifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func newWebhookNotifier(url, secret string, timeout time.Duration) *webhookNotifier {
+	return &webhookNotifier{url: url, secret: secret, client: &http.Client{Timeout: timeout}}
+}
+
+func (n *webhookNotifier) Notify(event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set(EventHeader, event.Outcome)
+	if n.secret != "" {
+		header.Set(SignatureHeader, "sha256="+Sign(n.secret, payload))
+	}
+	return post(n.client, n.url, payload, header)
+}
+
+// Sign returns the hex HMAC-SHA256 of payload keyed by secret, receivers of the webhook
+// notifier compare it with the SignatureHeader
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// slackNotifier posts the rendered events to Slack-compatible incoming webhooks
+type slackNotifier struct {
+	url    string
+	text   *template.Template
+	client *http.Client
+}
+
+func newSlackNotifier(url string, text *template.Template, timeout time.Duration) *slackNotifier {
+	return &slackNotifier{url: url, text: text, client: &http.Client{Timeout: timeout}}
+}
+
+func (n *slackNotifier) Notify(event Event) error {
+	text, err := render(n.text, event)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	return post(n.client, n.url, payload, http.Header{})
+}
+
+// emailNotifier sends the rendered events through SMTP, upgraded by STARTTLS if the server
+// supports it
+type emailNotifier struct {
+	config  SMTPConfig
+	subject *template.Template
+	text    *template.Template
+	timeout time.Duration
+}
+
+func newEmailNotifier(config SMTPConfig, subject, text *template.Template, timeout time.Duration) *emailNotifier {
+	if config.Port == 0 {
+		config.Port = 25
+	}
+	return &emailNotifier{config: config, subject: subject, text: text, timeout: timeout}
+}
+
+func (n *emailNotifier) Notify(event Event) error {
+	subject, err := render(n.subject, event)
+	if err != nil {
+		return err
+	}
+	text, err := render(n.text, event)
+	if err != nil {
+		return err
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(n.config.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject)))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.Replace(text, "\n", "\r\n", -1))
+
+	address := net.JoinHostPort(n.config.Host, strconv.Itoa(n.config.Port))
+	conn, err := net.DialTimeout("tcp", address, n.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(n.timeout)); err != nil {
+		return err
+	}
+	return sendMail(conn, n.config, message.Bytes())
+}
+
+// sendMail sends message over conn like smtp.SendMail, which has no timeout
+func sendMail(conn net.Conn, config SMTPConfig, message []byte) error {
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: config.Host}); err != nil {
+			return err
+		}
+	}
+	if config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", config.Username, config.Password, config.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(config.From); err != nil {
+		return err
+	}
+	for _, to := range config.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func post(client *http.Client, url string, payload []byte, header http.Header) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
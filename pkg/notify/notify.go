@@ -0,0 +1,330 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v2"
+	"tkestack.io/image-transfer/pkg/auth"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/queue"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+const (
+	// TypeWebhook notifiers post the event as json signed by HMAC-SHA256
+	TypeWebhook = "webhook"
+	// TypeSlack notifiers post a text message to a Slack-compatible incoming webhook
+	TypeSlack = "slack"
+	// TypeEmail notifiers send a text mail through SMTP
+	TypeEmail = "email"
+)
+
+// defaultText is the message of the slack and email notifiers without template
+const defaultText = `Image transfer job {{.JobID}}{{if .Sync}} of sync {{.Sync}}{{end}} submitted by {{.User}} {{.Outcome}}
+images: {{.Images}}, succeeded jobs: {{.SucceededJobs}}, failed jobs: {{.FailedJobs}}, failed url pairs: {{.FailedURLPairs}}, failed job generations: {{.FailedJobGenerates}}
+{{- if .Error}}
+error: {{.Error}}{{end}}`
+
+// defaultSubject is the subject of the email notifiers without subject template
+const defaultSubject = `[image-transfer] job {{.JobID}} {{.Outcome}}`
+
+// Config is the notifiers file
+type Config struct {
+	Notifiers []NotifierConfig `yaml:"notifiers"`
+	// Retries is the number of the retries of a failed delivery, 3 by default
+	Retries *int `yaml:"retries"`
+	// RetryInterval is the wait before the first retry, doubled by every retry, 10s by default
+	RetryInterval string `yaml:"retryInterval"`
+	// Timeout is the timeout of a delivery, 10s by default
+	Timeout string `yaml:"timeout"`
+}
+
+// NotifierConfig configures a notifier
+type NotifierConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// On are the outcomes notified, all of them by default
+	On []string `yaml:"on"`
+	// URL is the address of the webhook and slack notifiers
+	URL string `yaml:"url"`
+	// Secret signs the payload of the webhook notifier
+	Secret string `yaml:"secret"`
+	// Template renders the text of the slack and email notifiers with an Event
+	Template string `yaml:"template"`
+	// Subject renders the subject of the email notifier with an Event
+	Subject string     `yaml:"subject"`
+	SMTP    SMTPConfig `yaml:"smtp"`
+}
+
+// SMTPConfig is the mail server of the email notifier
+type SMTPConfig struct {
+	Host     string   `yaml:"host"`
+	Port     int      `yaml:"port"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// Event is what the notifiers are told when a job has finished
+type Event struct {
+	JobID string `json:"jobID"`
+	User  string `json:"user"`
+	Email string `json:"email,omitempty"`
+	Sync  string `json:"sync,omitempty"`
+	// Outcome is succeeded, partial or failed
+	Outcome            string    `json:"outcome"`
+	Error              string    `json:"error,omitempty"`
+	Images             int       `json:"images"`
+	SucceededJobs      int       `json:"succeededJobs"`
+	FailedJobs         int       `json:"failedJobs"`
+	FailedURLPairs     int       `json:"failedURLPairs"`
+	FailedJobGenerates int       `json:"failedJobGenerates"`
+	SubmittedAt        time.Time `json:"submittedAt"`
+	StartedAt          time.Time `json:"startedAt"`
+	FinishedAt         time.Time `json:"finishedAt"`
+}
+
+// NewEvent creates the Event of a finished job
+func NewEvent(job queue.Job) Event {
+	event := Event{
+		JobID:       job.ID,
+		User:        job.User,
+		Email:       job.Email,
+		Sync:        job.Sync,
+		Outcome:     string(job.State),
+		Error:       job.Error,
+		Images:      job.Images,
+		SubmittedAt: job.SubmittedAt,
+	}
+	if job.StartedAt != nil {
+		event.StartedAt = *job.StartedAt
+	}
+	if job.FinishedAt != nil {
+		event.FinishedAt = *job.FinishedAt
+	}
+	if job.Summary != nil {
+		event.SucceededJobs = job.Summary.SucceededJobs
+		event.FailedJobs = job.Summary.FailedJobs
+		event.FailedURLPairs = job.Summary.FailedURLPairs
+		event.FailedJobGenerates = job.Summary.FailedJobGenerates
+	}
+	return event
+}
+
+// Notifier delivers an event once
+type Notifier interface {
+	Notify(event Event) error
+}
+
+// Dispatcher delivers the events of the finished jobs to the notifiers, retrying the failed
+// deliveries in the background
+type Dispatcher struct {
+	notifiers     []namedNotifier
+	retries       int
+	retryInterval time.Duration
+	// sleep waits between the retries, tests replace time.Sleep to skip the waits
+	sleep func(time.Duration)
+}
+
+type namedNotifier struct {
+	Notifier
+	name string
+	on   []string
+}
+
+// LoadConfig reads the notifiers file at path
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("open notifiers file %s error: %v", path, err)
+	}
+
+	config := &Config{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("unmarshal notifiers file %s error: %v", path, err)
+	}
+	return config, nil
+}
+
+// NewDispatcher creates a Dispatcher of the notifiers of config
+func NewDispatcher(config *Config) (*Dispatcher, error) {
+	retries := 3
+	if config.Retries != nil {
+		retries = *config.Retries
+	}
+	retryInterval, err := parseDuration(config.RetryInterval, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("retryInterval: %v", err)
+	}
+	timeout, err := parseDuration(config.Timeout, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("timeout: %v", err)
+	}
+
+	dispatcher := &Dispatcher{retries: retries, retryInterval: retryInterval, sleep: time.Sleep}
+	for _, notifierConfig := range config.Notifiers {
+		notifier, err := newNotifier(notifierConfig, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %v", notifierConfig.Name, err)
+		}
+		for _, outcome := range notifierConfig.On {
+			if !utils.IsContain(outcomes, outcome) {
+				return nil, fmt.Errorf("notifier %s: unknown outcome %s, expect one of %v", notifierConfig.Name, outcome, outcomes)
+			}
+		}
+		dispatcher.notifiers = append(dispatcher.notifiers, namedNotifier{
+			Notifier: notifier,
+			name:     notifierConfig.Name,
+			on:       notifierConfig.On,
+		})
+	}
+	return dispatcher, nil
+}
+
+// outcomes are the states of the finished jobs which are notified
+var outcomes = []string{string(queue.StateSucceeded), string(queue.StatePartial), string(queue.StateFailed)}
+
+// OnFinish notifies the finished job, it is registered by Queue.OnFinish
+func (d *Dispatcher) OnFinish(job queue.Job) {
+	event := NewEvent(job)
+	if !utils.IsContain(outcomes, event.Outcome) {
+		return
+	}
+	for _, notifier := range d.notifiers {
+		if len(notifier.on) > 0 && !utils.IsContain(notifier.on, event.Outcome) {
+			continue
+		}
+		go d.deliver(notifier, event)
+	}
+}
+
+// Test delivers event to every notifier once and returns the errors by notifier name
+func (d *Dispatcher) Test(event Event) map[string]string {
+	errs := map[string]string{}
+	for _, notifier := range d.notifiers {
+		if err := notifier.Notify(event); err != nil {
+			errs[notifier.name] = err.Error()
+		}
+	}
+	return errs
+}
+
+func (d *Dispatcher) deliver(notifier namedNotifier, event Event) {
+	interval := d.retryInterval
+	for attempt := 0; ; attempt++ {
+		err := notifier.Notify(event)
+		if err == nil {
+			log.Infof("notified %s of job %s %s", notifier.name, event.JobID, event.Outcome)
+			return
+		}
+		if attempt >= d.retries {
+			log.Errorf("notify %s of job %s error, give up after %d retries: %v", notifier.name, event.JobID, d.retries, err)
+			return
+		}
+		log.Warnf("notify %s of job %s error, retry in %v: %v", notifier.name, event.JobID, interval, err)
+		d.sleep(interval)
+		interval *= 2
+	}
+}
+
+func newNotifier(config NotifierConfig, timeout time.Duration) (Notifier, error) {
+	switch config.Type {
+	case TypeWebhook:
+		if config.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		return newWebhookNotifier(config.URL, config.Secret, timeout), nil
+	case TypeSlack:
+		if config.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		text, err := parseTemplate(config.Template, defaultText)
+		if err != nil {
+			return nil, err
+		}
+		return newSlackNotifier(config.URL, text, timeout), nil
+	case TypeEmail:
+		if config.SMTP.Host == "" || config.SMTP.From == "" || len(config.SMTP.To) == 0 {
+			return nil, fmt.Errorf("smtp host, from and to are required")
+		}
+		subject, err := parseTemplate(config.Subject, defaultSubject)
+		if err != nil {
+			return nil, err
+		}
+		text, err := parseTemplate(config.Template, defaultText)
+		if err != nil {
+			return nil, err
+		}
+		return newEmailNotifier(config.SMTP, subject, text, timeout), nil
+	default:
+		return nil, fmt.Errorf("unknown type %q, expect %s, %s or %s", config.Type, TypeWebhook, TypeSlack, TypeEmail)
+	}
+}
+
+func parseTemplate(text, defaultText string) (*template.Template, error) {
+	if text == "" {
+		text = defaultText
+	}
+	return template.New("notification").Parse(text)
+}
+
+func render(tmpl *template.Template, event Event) (string, error) {
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, event); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+func parseDuration(value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// TestHandler serves POST /notifiers/test, it delivers a made-up event to every notifier once
+// and reports the failed ones
+func (d *Dispatcher) TestHandler(c *gin.Context) {
+	now := time.Now().UTC()
+	errs := d.Test(Event{
+		JobID:         "test",
+		User:          auth.CurrentUser(c),
+		Outcome:       string(queue.StateSucceeded),
+		Images:        1,
+		SucceededJobs: 1,
+		SubmittedAt:   now,
+		StartedAt:     now,
+		FinishedAt:    now,
+	})
+	if len(errs) > 0 {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to notify some notifiers", "failed": errs})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("notified %d notifiers", len(d.notifiers))})
+}
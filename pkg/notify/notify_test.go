@@ -0,0 +1,275 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/queue"
+)
+
+func TestMain(m *testing.M) {
+	// keep the logs of the deliveries out of the package directory
+	pflag.Set(log.OutputPathsName, "stderr")
+	os.Exit(m.Run())
+}
+
+// receiver is a notified endpoint, it answers the statuses in turn and 200 after them
+type receiver struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		if len(r.statuses) > 0 {
+			w.WriteHeader(r.statuses[0])
+			r.statuses = r.statuses[1:]
+		}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) received() ([]*http.Request, [][]byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.requests, r.bodies
+}
+
+func newTestDispatcher(t *testing.T, config *Config) (*Dispatcher, *[]time.Duration) {
+	dispatcher, err := NewDispatcher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var waits []time.Duration
+	dispatcher.sleep = func(d time.Duration) { waits = append(waits, d) }
+	return dispatcher, &waits
+}
+
+func testEvent(outcome queue.State) Event {
+	return Event{JobID: "job-1", User: "alice", Sync: "mirror", Outcome: string(outcome), Images: 3, SucceededJobs: 2, FailedJobs: 1}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	r := newReceiver(t)
+	dispatcher, _ := newTestDispatcher(t, &Config{Notifiers: []NotifierConfig{
+		{Name: "hook", Type: TypeWebhook, URL: r.URL, Secret: "s3cret"},
+	}})
+
+	event := testEvent(queue.StatePartial)
+	if errs := dispatcher.Test(event); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	requests, bodies := r.received()
+	if len(requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(requests))
+	}
+	if got, want := requests[0].Header.Get(SignatureHeader), "sha256="+Sign("s3cret", bodies[0]); got != want {
+		t.Errorf("signature header %q, want %q", got, want)
+	}
+	// the digest of the well known example of HMAC-SHA256
+	if got := Sign("key", []byte("The quick brown fox jumps over the lazy dog")); got != "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8" {
+		t.Errorf("Sign = %s", got)
+	}
+	if got := requests[0].Header.Get(EventHeader); got != string(queue.StatePartial) {
+		t.Errorf("event header %q, want partial", got)
+	}
+
+	var got Event
+	if err := json.Unmarshal(bodies[0], &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, event) {
+		t.Errorf("payload %+v, want %+v", got, event)
+	}
+}
+
+func TestWebhookWithoutSecret(t *testing.T) {
+	r := newReceiver(t)
+	dispatcher, _ := newTestDispatcher(t, &Config{Notifiers: []NotifierConfig{{Name: "hook", Type: TypeWebhook, URL: r.URL}}})
+	if errs := dispatcher.Test(testEvent(queue.StateSucceeded)); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if requests, _ := r.received(); requests[0].Header.Get(SignatureHeader) != "" {
+		t.Error("payload signed without secret")
+	}
+}
+
+func TestSlackTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name:     "template",
+			template: "{{.JobID}} of {{.User}} {{.Outcome}}: {{.SucceededJobs}}/{{.Images}}",
+			want:     "job-1 of alice failed: 2/3",
+		},
+		{
+			name: "default",
+			want: "Image transfer job job-1 of sync mirror submitted by alice failed\n" +
+				"images: 3, succeeded jobs: 2, failed jobs: 1, failed url pairs: 0, failed job generations: 0",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newReceiver(t)
+			dispatcher, _ := newTestDispatcher(t, &Config{Notifiers: []NotifierConfig{
+				{Name: "slack", Type: TypeSlack, URL: r.URL, Template: test.template},
+			}})
+			if errs := dispatcher.Test(testEvent(queue.StateFailed)); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+
+			_, bodies := r.received()
+			var message map[string]string
+			if err := json.Unmarshal(bodies[0], &message); err != nil {
+				t.Fatal(err)
+			}
+			if message["text"] != test.want {
+				t.Errorf("text %q, want %q", message["text"], test.want)
+			}
+		})
+	}
+
+	if _, err := NewDispatcher(&Config{Notifiers: []NotifierConfig{
+		{Name: "slack", Type: TypeSlack, URL: "http://localhost", Template: "{{.JobID"},
+	}}); err == nil {
+		t.Error("invalid template accepted")
+	}
+}
+
+func TestDeliverRetries(t *testing.T) {
+	retries := 3
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantCalls int
+		wantWaits []time.Duration
+	}{
+		{name: "delivered", wantCalls: 1},
+		{
+			name:      "delivered after retries",
+			statuses:  []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+			wantCalls: 3,
+			wantWaits: []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:      "retries exhausted",
+			statuses:  []int{500, 500, 500, 500, 500},
+			wantCalls: 4,
+			wantWaits: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newReceiver(t, test.statuses...)
+			dispatcher, waits := newTestDispatcher(t, &Config{
+				Notifiers:     []NotifierConfig{{Name: "hook", Type: TypeWebhook, URL: r.URL}},
+				Retries:       &retries,
+				RetryInterval: "1s",
+			})
+			dispatcher.deliver(dispatcher.notifiers[0], testEvent(queue.StateSucceeded))
+
+			if requests, _ := r.received(); len(requests) != test.wantCalls {
+				t.Errorf("got %d requests, want %d", len(requests), test.wantCalls)
+			}
+			if !reflect.DeepEqual(*waits, test.wantWaits) {
+				t.Errorf("waited %v, want %v", *waits, test.wantWaits)
+			}
+		})
+	}
+}
+
+// recorder is a notifier passing the events it is told to a channel
+type recorder chan Event
+
+func (r recorder) Notify(event Event) error {
+	r <- event
+	return nil
+}
+
+func TestOnFinishOutcomes(t *testing.T) {
+	failures, all := make(recorder, 10), make(recorder, 10)
+	dispatcher := &Dispatcher{notifiers: []namedNotifier{
+		{Notifier: failures, name: "failures", on: []string{string(queue.StatePartial), string(queue.StateFailed)}},
+		{Notifier: all, name: "all"},
+	}}
+
+	next := func(r recorder) Event {
+		select {
+		case event := <-r:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("no notification")
+		}
+		return Event{}
+	}
+
+	// cancelled jobs never ran and are not notified
+	for _, state := range []queue.State{queue.StateCancelled, queue.StateSucceeded, queue.StateFailed} {
+		dispatcher.OnFinish(queue.Job{ID: string(state), State: state})
+	}
+	// the deliveries run concurrently
+	got := map[string]bool{next(all).Outcome: true, next(all).Outcome: true}
+	if want := map[string]bool{string(queue.StateSucceeded): true, string(queue.StateFailed): true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("notifier all was told %v, want %v", got, want)
+	}
+	if event := next(failures); event.Outcome != string(queue.StateFailed) {
+		t.Errorf("notifier of failures was told %s", event.Outcome)
+	}
+	select {
+	case event := <-all:
+		t.Errorf("notifier all was told %s once more", event.Outcome)
+	case event := <-failures:
+		t.Errorf("notifier of failures was told %s once more", event.Outcome)
+	default:
+	}
+
+	if _, err := NewDispatcher(&Config{Notifiers: []NotifierConfig{
+		{Name: "hook", Type: TypeWebhook, URL: "http://localhost", On: []string{"done"}},
+	}}); err == nil {
+		t.Error("unknown outcome accepted")
+	}
+}
@@ -0,0 +1,252 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"tkestack.io/image-transfer/pkg/auth"
+	imagetransfer "tkestack.io/image-transfer/pkg/image-transfer"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// progressInterval is how often the progress stream checks for changes
+const progressInterval = time.Second
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// Handler serves the queue API
+type Handler struct {
+	Queue  *Queue
+	Policy *auth.Policy
+}
+
+// NewHandler creates a Handler
+func NewHandler(queue *Queue, policy *auth.Policy) *Handler {
+	return &Handler{Queue: queue, Policy: policy}
+}
+
+// StatusHandler serves GET /queue with the waiting, running and recently finished jobs
+func (h *Handler) StatusHandler(c *gin.Context) {
+	waiting, running, finished := h.Queue.Status()
+	c.JSON(http.StatusOK, gin.H{
+		"maxRunning": h.Queue.MaxRunning(),
+		"waiting":    waiting,
+		"running":    running,
+		"finished":   finished,
+	})
+}
+
+// GetHandler serves GET /jobs/:id
+func (h *Handler) GetHandler(c *gin.Context) {
+	job, ok := h.Queue.Get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrJobNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
+
+// ProgressHandler serves GET /jobs/:id/progress
+func (h *Handler) ProgressHandler(c *gin.Context) {
+	job, ok := h.Queue.Get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrJobNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, jobProgress(job))
+}
+
+// ProgressWSHandler serves GET /ws/jobs/:id/progress, the progress of the job is sent whenever it
+// changes, at most once per second, until the job has finished
+func (h *Handler) ProgressWSHandler(c *gin.Context) {
+	id := c.Param("id")
+	if _, ok := h.Queue.Get(id); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrJobNotFound.Error()})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Errorf("Failed to upgrade connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// the client only closes the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	finished, err := h.watchProgress(id, "", closed, func(eventID string, progress JobProgress) error {
+		return conn.WriteJSON(progress)
+	}, nil)
+	if err != nil {
+		log.Warnf("Failed to write progress of job %s: %v", id, err)
+		return
+	}
+	if finished {
+		// nolint: errcheck
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "job finished"))
+	}
+}
+
+// ProgressSSEHandler serves GET /sse/jobs/:id/progress, the progress stream of ProgressWSHandler as
+// server-sent progress events followed by an end event once the job has finished. A client resuming with
+// the Last-Event-ID of the final progress gets 204 No Content, which stops an EventSource reconnecting.
+func (h *Handler) ProgressSSEHandler(c *gin.Context) {
+	id := c.Param("id")
+	job, ok := h.Queue.Get(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrJobNotFound.Error()})
+		return
+	}
+	lastEventID := utils.LastEventID(c)
+	if job.FinishedAt != nil && lastEventID == progressEventID(jobProgress(job)) {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	utils.StartSSE(c)
+	keepAlive := time.NewTicker(utils.SSEKeepAlive)
+	defer keepAlive.Stop()
+	lastSent := time.Now()
+	finished, err := h.watchProgress(id, lastEventID, c.Request.Context().Done(), func(eventID string, progress JobProgress) error {
+		data, err := json.Marshal(progress)
+		if err != nil {
+			return err
+		}
+		lastSent = time.Now()
+		return utils.WriteSSE(c, eventID, "progress", string(data))
+	}, func() error {
+		if time.Since(lastSent) < utils.SSEKeepAlive {
+			return nil
+		}
+		lastSent = time.Now()
+		return utils.WriteSSEComment(c, "keep-alive")
+	})
+	if err != nil {
+		log.Warnf("Failed to write progress of job %s: %v", id, err)
+		return
+	}
+	if finished {
+		// nolint: errcheck
+		utils.WriteSSE(c, "", "end", id)
+	}
+}
+
+// watchProgress calls send with the progress of the job whenever it changes, at most once per
+// progressInterval, until the job has finished or done is closed. The progress with the event ID
+// lastEventID is not sent again, idle is called at every interval nothing is sent, if it is set.
+func (h *Handler) watchProgress(id, lastEventID string, done <-chan struct{},
+	send func(eventID string, progress JobProgress) error, idle func() error) (bool, error) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		job, ok := h.Queue.Get(id)
+		if !ok {
+			return false, nil
+		}
+		progress := jobProgress(job)
+		if eventID := progressEventID(progress); eventID != lastEventID {
+			if err := send(eventID, progress); err != nil {
+				return false, err
+			}
+			lastEventID = eventID
+		} else if idle != nil {
+			if err := idle(); err != nil {
+				return false, err
+			}
+		}
+		if job.FinishedAt != nil {
+			return true, nil
+		}
+
+		select {
+		case <-done:
+			return false, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// progressEventID identifies a progress of a job, it changes with the progress and the state
+func progressEventID(progress JobProgress) string {
+	return fmt.Sprintf("%d-%s", progress.Progress.Version, progress.State)
+}
+
+// JobProgress is the progress of a job served by the API
+type JobProgress struct {
+	ID       string                         `json:"id"`
+	State    State                          `json:"state"`
+	Progress imagetransfer.ProgressSnapshot `json:"progress"`
+}
+
+func jobProgress(job Job) JobProgress {
+	progress := JobProgress{ID: job.ID, State: job.State}
+	if job.Progress != nil {
+		progress.Progress = job.Progress.Snapshot()
+	} else {
+		progress.Progress.Running = []imagetransfer.ImageProgress{}
+	}
+	return progress
+}
+
+// CancelHandler serves DELETE /jobs/:id, users may cancel their own waiting jobs and admins any
+func (h *Handler) CancelHandler(c *gin.Context) {
+	id := c.Param("id")
+	identity := auth.CurrentIdentity(c)
+
+	job, ok := h.Queue.Get(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrJobNotFound.Error()})
+		return
+	}
+	if job.User != identity.Name && !h.Policy.Role(identity).Includes(auth.RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the submitter or an admin may cancel the job"})
+		return
+	}
+
+	job, err := h.Queue.Cancel(id)
+	switch err {
+	case nil:
+		log.Info("Cancel job", log.String(log.JobIDKey, id), log.String(log.UserKey, identity.Name))
+		c.JSON(http.StatusOK, gin.H{"job": job})
+	case ErrJobRunning:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,342 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	imagetransfer "tkestack.io/image-transfer/pkg/image-transfer"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// State is the state of a job in the queue
+type State string
+
+const (
+	// StateWaiting jobs wait for a free slot
+	StateWaiting State = "waiting"
+	// StateRunning jobs are transferring images
+	StateRunning State = "running"
+	// StateSucceeded jobs have finished without error
+	StateSucceeded State = "succeeded"
+	// StatePartial jobs have finished with some images failed
+	StatePartial State = "partial"
+	// StateFailed jobs have finished with an error, or without any image transferred
+	StateFailed State = "failed"
+	// StateCancelled jobs were cancelled before they started
+	StateCancelled State = "cancelled"
+)
+
+// RunFunc runs a job, it is called once the job leaves the queue and returns the summary of
+// the transfer if it has run one
+type RunFunc func(job *Job) (*imagetransfer.Summary, error)
+
+// Job is a transfer submitted to the server
+type Job struct {
+	ID    string `json:"id"`
+	User  string `json:"user"`
+	Email string `json:"email,omitempty"`
+	// Sync is the name of the scheduled sync the job runs, if any
+	Sync string `json:"sync,omitempty"`
+	// Priority orders the waiting jobs, higher first, and the jobs of a priority by submission
+	Priority int    `json:"priority"`
+	Images   int    `json:"images"`
+	State    State  `json:"state"`
+	Error    string `json:"error,omitempty"`
+	// Summary counts the jobs and failures of the transfer once the job has finished
+	Summary     *imagetransfer.Summary `json:"summary,omitempty"`
+	SubmittedAt time.Time              `json:"submittedAt"`
+	StartedAt   *time.Time             `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time             `json:"finishedAt,omitempty"`
+	// Position is the place of a waiting job in the queue, starting from 1
+	Position int `json:"position,omitempty"`
+	// Progress is the progress of the transfer of the job, if it reports any
+	Progress *imagetransfer.Progress `json:"-"`
+
+	seq  uint64
+	run  RunFunc
+	done chan struct{}
+}
+
+// logFields returns the fields of the log entries of the job followed by fields
+func (j *Job) logFields(fields ...log.Field) []log.Field {
+	jobFields := []log.Field{log.String(log.JobIDKey, j.ID), log.String(log.UserKey, j.User)}
+	if j.Sync != "" {
+		jobFields = append(jobFields, log.String("sync", j.Sync))
+	}
+	return append(jobFields, fields...)
+}
+
+// Queue runs the submitted jobs, at most maxRunning at a time
+type Queue struct {
+	maxRunning int
+	history    int
+
+	lock     sync.Mutex
+	seq      uint64
+	waiting  []*Job
+	running  map[string]*Job
+	finished []*Job
+	// onFinish is called after a job has finished
+	onFinish []func(job Job)
+}
+
+// NewQueue creates a Queue running at most maxRunning jobs and remembering the last history
+// finished jobs
+func NewQueue(maxRunning, history int) *Queue {
+	if maxRunning < 1 {
+		maxRunning = 1
+	}
+	return &Queue{
+		maxRunning: maxRunning,
+		history:    history,
+		running:    map[string]*Job{},
+	}
+}
+
+// OnFinish registers fn to be called with every finished job
+func (q *Queue) OnFinish(fn func(job Job)) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.onFinish = append(q.onFinish, fn)
+}
+
+// Submit queues job to be run by run, and returns the queued job
+func (q *Queue) Submit(job Job, run RunFunc) (Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.seq++
+	job.ID = id
+	job.State = StateWaiting
+	job.SubmittedAt = time.Now().UTC()
+	job.seq = q.seq
+	job.run = run
+	job.done = make(chan struct{})
+
+	queued := &job
+	q.waiting = append(q.waiting, queued)
+	sort.SliceStable(q.waiting, func(i, j int) bool {
+		if q.waiting[i].Priority != q.waiting[j].Priority {
+			return q.waiting[i].Priority > q.waiting[j].Priority
+		}
+		return q.waiting[i].seq < q.waiting[j].seq
+	})
+	log.Info("Job queued", job.logFields(log.Int("priority", job.Priority))...)
+
+	q.dispatch()
+	return q.snapshot(queued), nil
+}
+
+// Cancel removes a waiting job from the queue, running jobs can not be cancelled
+func (q *Queue) Cancel(id string) (Job, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for i, job := range q.waiting {
+		if job.ID != id {
+			continue
+		}
+		q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+		now := time.Now().UTC()
+		job.State = StateCancelled
+		job.FinishedAt = &now
+		q.remember(job)
+		close(job.done)
+		log.Info("Job cancelled", job.logFields()...)
+		return *job, nil
+	}
+
+	if _, ok := q.running[id]; ok {
+		return Job{}, ErrJobRunning
+	}
+	return Job{}, ErrJobNotFound
+}
+
+// Get returns the job id
+func (q *Queue) Get(id string) (Job, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if job := q.find(id); job != nil {
+		return q.snapshot(job), true
+	}
+	return Job{}, false
+}
+
+// Wait blocks until the job id has finished or been cancelled, and returns it
+func (q *Queue) Wait(id string) (Job, bool) {
+	q.lock.Lock()
+	job := q.find(id)
+	q.lock.Unlock()
+	if job == nil {
+		return Job{}, false
+	}
+
+	<-job.done
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return *job, true
+}
+
+// Status lists the waiting jobs in order, the running jobs and the recently finished jobs
+func (q *Queue) Status() (waiting, running, finished []Job) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	waiting, running, finished = []Job{}, []Job{}, []Job{}
+	for _, job := range q.waiting {
+		waiting = append(waiting, q.snapshot(job))
+	}
+	for _, job := range q.running {
+		running = append(running, *job)
+	}
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].StartedAt.Before(*running[j].StartedAt)
+	})
+	for i := len(q.finished) - 1; i >= 0; i-- {
+		finished = append(finished, *q.finished[i])
+	}
+	return waiting, running, finished
+}
+
+// MaxRunning returns the number of jobs run at a time
+func (q *Queue) MaxRunning() int {
+	return q.maxRunning
+}
+
+// dispatch starts the waiting jobs while there are free slots, callers hold the lock
+func (q *Queue) dispatch() {
+	for len(q.running) < q.maxRunning && len(q.waiting) > 0 {
+		job := q.waiting[0]
+		q.waiting = q.waiting[1:]
+
+		now := time.Now().UTC()
+		job.State = StateRunning
+		job.StartedAt = &now
+		q.running[job.ID] = job
+		log.Info("Job started", job.logFields()...)
+
+		go q.runJob(job)
+	}
+}
+
+func (q *Queue) runJob(job *Job) {
+	summary, err := job.run(job)
+
+	q.lock.Lock()
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	job.Summary = summary
+	switch {
+	case err != nil:
+		job.State = StateFailed
+		job.Error = err.Error()
+		log.Error("Job failed", job.logFields(log.Err(err))...)
+	case summary != nil && summary.Failed():
+		job.State = StatePartial
+		if summary.SucceededJobs == 0 {
+			job.State = StateFailed
+		}
+		job.Error = summary.String()
+		log.Error("Job finished with failed images", job.logFields(log.String("state", string(job.State)),
+			log.Stringer("summary", summary))...)
+	default:
+		job.State = StateSucceeded
+		log.Info("Job succeeded", job.logFields()...)
+	}
+	delete(q.running, job.ID)
+	q.remember(job)
+	close(job.done)
+	finished := *job
+	onFinish := append([]func(Job){}, q.onFinish...)
+	q.dispatch()
+	q.lock.Unlock()
+
+	for _, fn := range onFinish {
+		fn(finished)
+	}
+}
+
+// find finds the job id, callers hold the lock
+func (q *Queue) find(id string) *Job {
+	for _, job := range q.waiting {
+		if job.ID == id {
+			return job
+		}
+	}
+	if job, ok := q.running[id]; ok {
+		return job
+	}
+	for _, job := range q.finished {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// remember keeps a finished job in the history, callers hold the lock
+func (q *Queue) remember(job *Job) {
+	q.finished = append(q.finished, job)
+	if len(q.finished) > q.history {
+		q.finished = q.finished[len(q.finished)-q.history:]
+	}
+}
+
+// snapshot copies a job with its position if it is waiting, callers hold the lock
+func (q *Queue) snapshot(job *Job) Job {
+	snapshot := *job
+	if job.State == StateWaiting {
+		for i, waiting := range q.waiting {
+			if waiting == job {
+				snapshot.Position = i + 1
+				break
+			}
+		}
+	}
+	return snapshot
+}
+
+var (
+	// ErrJobNotFound means there is no such job in the queue
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobRunning means the job has already started
+	ErrJobRunning = errors.New("job is already running")
+)
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,406 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package schedule
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"tkestack.io/image-transfer/pkg/auth"
+	"tkestack.io/image-transfer/pkg/credentials"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+// Handler serves the syncs API, every user may see the syncs, and only their owners and the
+// admins may change them
+type Handler struct {
+	Scheduler   *Scheduler
+	Policy      *auth.Policy
+	Credentials *credentials.Handler
+}
+
+// NewHandler creates a Handler
+func NewHandler(scheduler *Scheduler, policy *auth.Policy, credentials *credentials.Handler) *Handler {
+	return &Handler{Scheduler: scheduler, Policy: policy, Credentials: credentials}
+}
+
+// SyncRequest is the body of POST /syncs and PUT /syncs/:name
+type SyncRequest struct {
+	Name        string            `json:"name"`
+	Cron        string            `json:"cron" binding:"required"`
+	Images      map[string]string `json:"images" binding:"required"`
+	Credentials []string          `json:"credentials"`
+	RoutineNums int               `json:"routine_nums"`
+	RetryNums   int               `json:"retry_nums"`
+	Priority    int               `json:"priority"`
+	// Enabled is true if it is not given
+	Enabled       *bool `json:"enabled"`
+	SkipIfRunning bool  `json:"skip_if_running"`
+}
+
+// SyncStatus is a sync with the state of its schedule
+type SyncStatus struct {
+	Sync
+	NextRun *time.Time `json:"nextRun,omitempty"`
+	Running int        `json:"running"`
+	// Webhook is set if the push events of registries may trigger the sync
+	Webhook bool `json:"webhook"`
+}
+
+// ListHandler serves GET /syncs
+func (h *Handler) ListHandler(c *gin.Context) {
+	statuses := []SyncStatus{}
+	for _, definition := range h.Scheduler.Store.List() {
+		statuses = append(statuses, h.status(definition))
+	}
+	c.JSON(http.StatusOK, gin.H{"syncs": statuses})
+}
+
+// GetHandler serves GET /syncs/:name
+func (h *Handler) GetHandler(c *gin.Context) {
+	definition, ok := h.Scheduler.Store.Get(c.Param("name"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrSyncNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sync": h.status(definition)})
+}
+
+// CreateHandler serves POST /syncs, the sync is owned by the current user and runs as them
+func (h *Handler) CreateHandler(c *gin.Context) {
+	var req SyncRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name, cron and images are required"})
+		return
+	}
+
+	identity := auth.CurrentIdentity(c)
+	if !h.validate(c, identity, req) {
+		return
+	}
+
+	definition := Sync{
+		Owner:  identity.Name,
+		Email:  identity.Email,
+		Groups: identity.Groups,
+	}
+	req.apply(&definition)
+	created, err := h.Scheduler.Store.Create(definition)
+	if err != nil {
+		log.Errorf("create sync %s error: %v", req.Name, err)
+		if _, exist := h.Scheduler.Store.Get(req.Name); exist {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create sync"})
+		return
+	}
+
+	log.Infof("user %s created sync %s scheduled at %q", identity.Name, created.Name, created.Cron)
+	c.JSON(http.StatusCreated, gin.H{"sync": h.status(*created)})
+}
+
+// UpdateHandler serves PUT /syncs/:name, it replaces the definition and keeps the owner and
+// the last run
+func (h *Handler) UpdateHandler(c *gin.Context) {
+	name := c.Param("name")
+	identity, definition, ok := h.authorize(c, name)
+	if !ok {
+		return
+	}
+
+	var req SyncRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cron and images are required"})
+		return
+	}
+	req.Name = name
+	// the runs act as the owner even if an admin changes the sync
+	if !h.validate(c, definition.Identity(), req) {
+		return
+	}
+
+	h.update(c, identity, name, "updated", req.apply)
+}
+
+// EnableHandler serves POST /syncs/:name/enable
+func (h *Handler) EnableHandler(c *gin.Context) {
+	h.setEnabled(c, true)
+}
+
+// DisableHandler serves POST /syncs/:name/disable, the started runs go on
+func (h *Handler) DisableHandler(c *gin.Context) {
+	h.setEnabled(c, false)
+}
+
+// RunHandler serves POST /syncs/:name/run, it runs the sync now whether it is enabled or not
+func (h *Handler) RunHandler(c *gin.Context) {
+	name := c.Param("name")
+	identity, _, ok := h.authorize(c, name)
+	if !ok {
+		return
+	}
+
+	run, err := h.Scheduler.Trigger(name, TriggerManual)
+	switch err {
+	case nil:
+		log.Infof("user %s started sync %s", identity.Name, name)
+		c.JSON(http.StatusAccepted, gin.H{"run": run})
+	case ErrSyncRunning:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	}
+}
+
+// DeleteHandler serves DELETE /syncs/:name, the started runs go on
+func (h *Handler) DeleteHandler(c *gin.Context) {
+	name := c.Param("name")
+	identity, _, ok := h.authorize(c, name)
+	if !ok {
+		return
+	}
+
+	if err := h.Scheduler.Store.Delete(name); err != nil {
+		log.Errorf("delete sync %s error: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete sync"})
+		return
+	}
+
+	log.Infof("user %s deleted sync %s", identity.Name, name)
+	c.JSON(http.StatusOK, gin.H{"message": "sync deleted successfully"})
+}
+
+// CreateWebhookHandler serves POST /syncs/:name/webhook, it generates the secret of the webhook
+// of the sync, which replaces the previous one and is only shown once. Registries should send
+// the secret in the Authorization header to url, as a query it ends up in the access logs of
+// proxies. tokenURL carries it in the token query only for the registries that can not set
+// headers on their webhooks, such as Docker Hub.
+func (h *Handler) CreateWebhookHandler(c *gin.Context) {
+	name := c.Param("name")
+	identity, _, ok := h.authorize(c, name)
+	if !ok {
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate webhook secret"})
+		return
+	}
+	token := hex.EncodeToString(secret)
+	if _, err := h.Scheduler.Store.Update(name, func(definition *Sync) {
+		definition.WebhookHash = hashSecret(token)
+	}); err != nil {
+		log.Errorf("update sync %s error: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update sync"})
+		return
+	}
+
+	log.Infof("user %s created the webhook of sync %s", identity.Name, name)
+	c.JSON(http.StatusCreated, gin.H{
+		"secret":        token,
+		"url":           "/hooks/" + name,
+		"authorization": "Bearer " + token,
+		"tokenURL":      "/hooks/" + name + "?token=" + token,
+	})
+}
+
+// DeleteWebhookHandler serves DELETE /syncs/:name/webhook
+func (h *Handler) DeleteWebhookHandler(c *gin.Context) {
+	name := c.Param("name")
+	identity, _, ok := h.authorize(c, name)
+	if !ok {
+		return
+	}
+
+	h.update(c, identity, name, "deleted the webhook of", func(definition *Sync) {
+		definition.WebhookHash = ""
+	})
+}
+
+// HookHandler serves POST /hooks/:name, the push events of registries authenticated by the
+// secret of the webhook in the Authorization header, or in the token query for the registries
+// that can not send headers, and transfers the pushed tags matching the rules of the sync
+func (h *Handler) HookHandler(c *gin.Context) {
+	name := c.Param("name")
+	definition, ok := h.Scheduler.Store.Get(name)
+	if !ok || definition.WebhookHash == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrSyncNotFound.Error()})
+		return
+	}
+	if !checkSecret(definition.WebhookHash, webhookSecret(c)) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid webhook secret"})
+		return
+	}
+
+	payload, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read payload"})
+		return
+	}
+	pushed, err := ParsePushEvent(payload)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// registries retry the events which are not accepted, so the ignored ones succeed
+	if !definition.Enabled {
+		c.JSON(http.StatusOK, gin.H{"message": "sync is disabled, event ignored"})
+		return
+	}
+	images := map[string]string{}
+	for _, image := range pushed {
+		for source, target := range MatchImages(definition.Images, image) {
+			images[source] = target
+		}
+	}
+	if len(images) == 0 {
+		c.JSON(http.StatusOK, gin.H{"message": "no rule of the sync matches the event, event ignored"})
+		return
+	}
+
+	run, err := h.Scheduler.TriggerImages(name, TriggerWebhook, images)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	log.Infof("webhook of sync %s transfers %d pushed images", name, len(images))
+	c.JSON(http.StatusAccepted, gin.H{"run": run})
+}
+
+func (h *Handler) setEnabled(c *gin.Context, enabled bool) {
+	name := c.Param("name")
+	identity, _, ok := h.authorize(c, name)
+	if !ok {
+		return
+	}
+
+	action := "disabled"
+	if enabled {
+		action = "enabled"
+	}
+	h.update(c, identity, name, action, func(definition *Sync) {
+		definition.Enabled = enabled
+	})
+}
+
+func (h *Handler) update(c *gin.Context, identity auth.Identity, name, action string, change func(*Sync)) {
+	updated, err := h.Scheduler.Store.Update(name, change)
+	if err != nil {
+		log.Errorf("update sync %s error: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update sync"})
+		return
+	}
+
+	log.Infof("user %s %s sync %s", identity.Name, action, name)
+	c.JSON(http.StatusOK, gin.H{"sync": h.status(updated)})
+}
+
+// authorize checks if the current user may change the sync name
+func (h *Handler) authorize(c *gin.Context, name string) (auth.Identity, Sync, bool) {
+	identity := auth.CurrentIdentity(c)
+	definition, ok := h.Scheduler.Store.Get(name)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrSyncNotFound.Error()})
+		return identity, definition, false
+	}
+	if definition.Owner != identity.Name && !h.Policy.Role(identity).Includes(auth.RoleAdmin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "only the owner or an admin may change the sync"})
+		return identity, definition, false
+	}
+	return identity, definition, true
+}
+
+// validate checks the cron expression, and that identity may transfer the images with the
+// credentials
+func (h *Handler) validate(c *gin.Context, identity auth.Identity, req SyncRequest) bool {
+	if _, err := ParseCron(req.Cron); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	if len(req.Images) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "images should not be empty"})
+		return false
+	}
+	if denied := h.Policy.CheckImages(identity, req.Images); len(denied) > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "transfer of some images is not allowed", "denied": denied})
+		return false
+	}
+	if len(req.Credentials) > 0 {
+		if _, err := h.Credentials.Resolver(identity, req.Credentials); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Handler) status(definition Sync) SyncStatus {
+	status := SyncStatus{
+		Sync:    definition,
+		Running: h.Scheduler.Running(definition.Name),
+		Webhook: definition.WebhookHash != "",
+	}
+	if cron, err := ParseCron(definition.Cron); err == nil && definition.Enabled {
+		if next := cron.Next(time.Now()); !next.IsZero() {
+			status.NextRun = &next
+		}
+	}
+	return status
+}
+
+// apply sets the definition of the request to definition
+func (req SyncRequest) apply(definition *Sync) {
+	definition.Name = req.Name
+	definition.Cron = req.Cron
+	definition.Images = req.Images
+	definition.Credentials = req.Credentials
+	definition.RoutineNums = req.RoutineNums
+	definition.RetryNums = req.RetryNums
+	definition.Priority = req.Priority
+	definition.Enabled = req.Enabled == nil || *req.Enabled
+	definition.SkipIfRunning = req.SkipIfRunning
+}
+
+// webhookSecret returns the secret of a push event, which registries send in the
+// Authorization header, as a Bearer token or verbatim, or Docker Hub in the url
+func webhookSecret(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); header != "" {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return c.Query("token")
+}
+
+func checkSecret(hash, secret string) bool {
+	return secret != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(hashSecret(secret))) == 1
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,181 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package schedule
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	// TriggerSchedule runs are started by the cron expression of the sync
+	TriggerSchedule = "schedule"
+	// TriggerManual runs are started through the API
+	TriggerManual = "manual"
+	// TriggerWebhook runs are started by the push events of the source registries
+	TriggerWebhook = "webhook"
+)
+
+// ErrSyncRunning means the previous run of a sync skipping overlapped runs has not finished
+var ErrSyncRunning = errors.New("previous run of the sync has not finished")
+
+// RunFunc transfers the images of a sync and returns once they are transferred
+type RunFunc func(definition Sync) error
+
+// Scheduler runs the enabled syncs of a Store when their cron expressions are due
+type Scheduler struct {
+	Store *Store
+	run   RunFunc
+
+	lock sync.Mutex
+	// running counts the unfinished runs of every sync
+	running map[string]int
+	stop    chan struct{}
+}
+
+// NewScheduler creates a Scheduler running the syncs of store by run
+func NewScheduler(store *Store, run RunFunc) *Scheduler {
+	return &Scheduler{
+		Store:   store,
+		run:     run,
+		running: map[string]int{},
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start checks the syncs at the beginning of every minute until Stop is called
+func (s *Scheduler) Start() {
+	go func() {
+		for {
+			next := time.Now().Truncate(time.Minute).Add(time.Minute)
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-s.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+				s.tick(next)
+			}
+		}
+	}()
+}
+
+// Stop stops scheduling, the started runs go on
+func (s *Scheduler) Stop() {
+	close(s.stop)
+}
+
+// Trigger starts a run of the sync name, the run goes on in the background
+func (s *Scheduler) Trigger(name, trigger string) (Run, error) {
+	definition, ok := s.Store.Get(name)
+	if !ok {
+		return Run{}, ErrSyncNotFound
+	}
+	return s.start(definition, trigger, definition.SkipIfRunning)
+}
+
+// TriggerImages starts a run of the sync name transferring images instead of all the images
+// of the sync, it is never skipped since the images may differ from the running ones
+func (s *Scheduler) TriggerImages(name, trigger string, images map[string]string) (Run, error) {
+	definition, ok := s.Store.Get(name)
+	if !ok {
+		return Run{}, ErrSyncNotFound
+	}
+	definition.Images = images
+	return s.start(definition, trigger, false)
+}
+
+func (s *Scheduler) start(definition Sync, trigger string, skipIfRunning bool) (Run, error) {
+	name := definition.Name
+
+	s.lock.Lock()
+	if skipIfRunning && s.running[name] > 0 {
+		s.lock.Unlock()
+		return Run{}, ErrSyncRunning
+	}
+	s.running[name]++
+	s.lock.Unlock()
+
+	run := Run{Trigger: trigger, Images: len(definition.Images), State: RunRunning, StartedAt: time.Now().UTC()}
+	s.setLastRun(name, run)
+	log.Infof("sync %s started by %s", name, trigger)
+
+	go func() {
+		err := s.run(definition)
+
+		now := time.Now().UTC()
+		run.FinishedAt = &now
+		if err != nil {
+			run.State = RunFailed
+			run.Error = err.Error()
+			log.Errorf("sync %s failed: %v", name, err)
+		} else {
+			run.State = RunSucceeded
+			log.Infof("sync %s succeeded", name)
+		}
+		s.setLastRun(name, run)
+
+		s.lock.Lock()
+		s.running[name]--
+		if s.running[name] == 0 {
+			delete(s.running, name)
+		}
+		s.lock.Unlock()
+	}()
+	return run, nil
+}
+
+// Running returns the number of unfinished runs of the sync name
+func (s *Scheduler) Running(name string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.running[name]
+}
+
+// tick starts the enabled syncs due at the minute now
+func (s *Scheduler) tick(now time.Time) {
+	for _, definition := range s.Store.List() {
+		if !definition.Enabled {
+			continue
+		}
+		cron, err := ParseCron(definition.Cron)
+		if err != nil {
+			log.Errorf("sync %s: %v", definition.Name, err)
+			continue
+		}
+		if !cron.Matches(now) {
+			continue
+		}
+		if _, err := s.Trigger(definition.Name, TriggerSchedule); err != nil {
+			log.Warnf("skip scheduled run of sync %s: %v", definition.Name, err)
+		}
+	}
+}
+
+func (s *Scheduler) setLastRun(name string, run Run) {
+	if _, err := s.Store.Update(name, func(definition *Sync) {
+		definition.LastRun = &run
+	}); err != nil && err != ErrSyncNotFound {
+		log.Errorf("save last run of sync %s error: %v", name, err)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	"tkestack.io/image-transfer/pkg/auth"
+)
+
+// ErrSyncNotFound means there is no sync of the name
+var ErrSyncNotFound = errors.New("sync not found")
+
+// RunState is the state of a run of a sync
+type RunState string
+
+const (
+	// RunRunning runs are waiting in the queue or transferring images
+	RunRunning RunState = "running"
+	// RunSucceeded runs have transferred all the images
+	RunSucceeded RunState = "succeeded"
+	// RunFailed runs have failed to transfer some images
+	RunFailed RunState = "failed"
+)
+
+// Run is the status of a run of a sync
+type Run struct {
+	// Trigger is what started the run, such as schedule or manual
+	Trigger string `yaml:"trigger" json:"trigger"`
+	// Images is the number of the images transferred, a webhook transfers the pushed ones only
+	Images     int        `yaml:"images" json:"images"`
+	State      RunState   `yaml:"state" json:"state"`
+	Error      string     `yaml:"error,omitempty" json:"error,omitempty"`
+	StartedAt  time.Time  `yaml:"startedAt" json:"startedAt"`
+	FinishedAt *time.Time `yaml:"finishedAt,omitempty" json:"finishedAt,omitempty"`
+}
+
+// Sync is a named set of images transferred on a cron schedule
+type Sync struct {
+	Name   string            `yaml:"name" json:"name"`
+	Cron   string            `yaml:"cron" json:"cron"`
+	Images map[string]string `yaml:"images" json:"images"`
+	// Credentials are the names of the stored credentials used by the runs
+	Credentials []string `yaml:"credentials,omitempty" json:"credentials,omitempty"`
+	RoutineNums int      `yaml:"routineNums,omitempty" json:"routine_nums,omitempty"`
+	RetryNums   int      `yaml:"retryNums,omitempty" json:"retry_nums,omitempty"`
+	Priority    int      `yaml:"priority,omitempty" json:"priority,omitempty"`
+	Enabled     bool     `yaml:"enabled" json:"enabled"`
+	// SkipIfRunning skips a scheduled run while the previous one has not finished
+	SkipIfRunning bool `yaml:"skipIfRunning" json:"skip_if_running"`
+	// Owner, Email and Groups are the identity the runs act as
+	Owner     string    `yaml:"owner" json:"owner"`
+	Email     string    `yaml:"email,omitempty" json:"email,omitempty"`
+	Groups    []string  `yaml:"groups,omitempty" json:"groups,omitempty"`
+	CreatedAt time.Time `yaml:"createdAt" json:"createdAt"`
+	// WebhookHash is the sha256 of the secret the push events of the webhook carry
+	WebhookHash string `yaml:"webhookHash,omitempty" json:"-"`
+	LastRun     *Run   `yaml:"lastRun,omitempty" json:"lastRun,omitempty"`
+}
+
+// Identity returns the identity the runs of the sync act as
+func (s *Sync) Identity() auth.Identity {
+	return auth.Identity{Name: s.Owner, Email: s.Email, Groups: s.Groups}
+}
+
+// Store keeps the syncs in a yaml file
+type Store struct {
+	path  string
+	lock  sync.Mutex
+	syncs []*Sync
+}
+
+// NewStore loads the syncs file at path, it is created by the first change if it does not exist
+func NewStore(path string) (*Store, error) {
+	store := &Store{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open syncs file %s error: %v", path, err)
+	}
+	if err := yaml.Unmarshal(data, &store.syncs); err != nil {
+		return nil, fmt.Errorf("unmarshal syncs file %s error: %v", path, err)
+	}
+	for _, definition := range store.syncs {
+		if _, err := ParseCron(definition.Cron); err != nil {
+			return nil, fmt.Errorf("sync %s: %v", definition.Name, err)
+		}
+		// the server stopped during the run
+		if definition.LastRun != nil && definition.LastRun.State == RunRunning {
+			definition.LastRun.State = RunFailed
+			definition.LastRun.Error = "interrupted by a restart of the server"
+		}
+	}
+	return store, nil
+}
+
+// Create stores the sync definition
+func (s *Store) Create(definition Sync) (*Sync, error) {
+	definition.CreatedAt = time.Now().UTC()
+	definition.LastRun = nil
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.get(definition.Name) != nil {
+		return nil, fmt.Errorf("sync %s already exists", definition.Name)
+	}
+	s.syncs = append(s.syncs, &definition)
+	if err := s.save(); err != nil {
+		s.syncs = s.syncs[:len(s.syncs)-1]
+		return nil, err
+	}
+	return &definition, nil
+}
+
+// Update changes the sync name by change
+func (s *Store) Update(name string, change func(*Sync)) (Sync, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	definition := s.get(name)
+	if definition == nil {
+		return Sync{}, ErrSyncNotFound
+	}
+	previous := *definition
+	change(definition)
+	if err := s.save(); err != nil {
+		*definition = previous
+		return Sync{}, err
+	}
+	return *definition, nil
+}
+
+// List returns all the syncs ordered by name
+func (s *Store) List() []Sync {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	syncs := []Sync{}
+	for _, definition := range s.syncs {
+		syncs = append(syncs, *definition)
+	}
+	sort.Slice(syncs, func(i, j int) bool {
+		return syncs[i].Name < syncs[j].Name
+	})
+	return syncs
+}
+
+// Get returns the sync name
+func (s *Store) Get(name string) (Sync, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if definition := s.get(name); definition != nil {
+		return *definition, true
+	}
+	return Sync{}, false
+}
+
+// Delete removes the sync name
+func (s *Store) Delete(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i, definition := range s.syncs {
+		if definition.Name != name {
+			continue
+		}
+		previous := s.syncs
+		s.syncs = append(append([]*Sync{}, previous[:i]...), previous[i+1:]...)
+		if err := s.save(); err != nil {
+			s.syncs = previous
+			return err
+		}
+		return nil
+	}
+	return ErrSyncNotFound
+}
+
+// get finds the sync name, callers hold the lock
+func (s *Store) get(name string) *Sync {
+	for _, definition := range s.syncs {
+		if definition.Name == name {
+			return definition
+		}
+	}
+	return nil
+}
+
+// save writes the syncs file, callers hold the lock
+func (s *Store) save() error {
+	data, err := yaml.Marshal(s.syncs)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("write syncs file %s error: %v", s.path, err)
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,203 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package schedule
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// dockerHubRegistry is the registry the images of Docker Hub are named after by NewRepoURL
+const dockerHubRegistry = "registry.hub.docker.com"
+
+// dockerHubAliases are the other names of Docker Hub
+var dockerHubAliases = []string{"docker.io", "index.docker.io", "registry-1.docker.io", dockerHubRegistry}
+
+// PushedImage is an image a push event of a registry reports
+type PushedImage struct {
+	// Registry is empty if the event does not tell it
+	Registry   string `json:"registry,omitempty"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+}
+
+// harborEvent is the push event of Harbor, the enterprise edition of TCR sends it as well
+type harborEvent struct {
+	Type      string `json:"type"`
+	EventData struct {
+		Resources []struct {
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+		Repository struct {
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+// distributionEnvelope holds the notifications of the distribution registry
+type distributionEnvelope struct {
+	Events []struct {
+		Action string `json:"action"`
+		Target struct {
+			Repository string `json:"repository"`
+			Tag        string `json:"tag"`
+		} `json:"target"`
+		Request struct {
+			Host string `json:"host"`
+		} `json:"request"`
+	} `json:"events"`
+}
+
+// dockerHubEvent is the webhook payload of Docker Hub
+type dockerHubEvent struct {
+	PushData *struct {
+		Tag string `json:"tag"`
+	} `json:"push_data"`
+	Repository struct {
+		RepoName string `json:"repo_name"`
+	} `json:"repository"`
+}
+
+// ParsePushEvent returns the tagged images pushed according to the payload of Harbor, TCR,
+// the distribution registry or Docker Hub, the other events such as pulls and deletions
+// report nothing
+func ParsePushEvent(payload []byte) ([]PushedImage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+
+	pushed := []PushedImage{}
+	switch {
+	case fields["event_data"] != nil:
+		var event harborEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		// PUSH_ARTIFACT of harbor and pushImage of TCR
+		if !strings.Contains(strings.ToLower(event.Type), "push") {
+			return pushed, nil
+		}
+		for _, resource := range event.EventData.Resources {
+			if resource.Tag == "" {
+				continue
+			}
+			registry := ""
+			if i := strings.Index(resource.ResourceURL, "/"); i > 0 {
+				registry = resource.ResourceURL[:i]
+			}
+			pushed = append(pushed, PushedImage{
+				Registry:   registry,
+				Repository: event.EventData.Repository.RepoFullName,
+				Tag:        resource.Tag,
+			})
+		}
+	case fields["events"] != nil:
+		var envelope distributionEnvelope
+		if err := json.Unmarshal(payload, &envelope); err != nil {
+			return nil, err
+		}
+		for _, event := range envelope.Events {
+			// blobs are pushed without tag
+			if event.Action != "push" || event.Target.Tag == "" {
+				continue
+			}
+			pushed = append(pushed, PushedImage{
+				Registry:   event.Request.Host,
+				Repository: event.Target.Repository,
+				Tag:        event.Target.Tag,
+			})
+		}
+	case fields["push_data"] != nil:
+		var event dockerHubEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		if event.PushData == nil {
+			return nil, errors.New("no push_data in docker hub webhook payload")
+		}
+		if event.PushData.Tag != "" {
+			pushed = append(pushed, PushedImage{
+				Registry:   dockerHubRegistry,
+				Repository: event.Repository.RepoName,
+				Tag:        event.PushData.Tag,
+			})
+		}
+	default:
+		return nil, errors.New("unknown webhook payload, expect a push event of harbor, tcr, distribution or docker hub")
+	}
+	return pushed, nil
+}
+
+// MatchImages returns the rules of images narrowed down to the pushed image, a rule matches if
+// its source is the pushed repository and it transfers every tag or the pushed one
+func MatchImages(images map[string]string, pushed PushedImage) map[string]string {
+	matched := map[string]string{}
+	for source, target := range images {
+		sourceURL, err := utils.NewRepoURL(source)
+		if err != nil || sourceURL.IsArchive() {
+			continue
+		}
+		if !sameRegistry(sourceURL.GetRegistry(), pushed.Registry) ||
+			sourceURL.GetRepoWithNamespace() != pushed.repository() {
+			continue
+		}
+
+		tags := sourceURL.GetTag()
+		if tags != "" && !utils.IsContain(strings.Split(tags, ","), pushed.Tag) {
+			continue
+		}
+
+		// a target tag belongs to a rule of the single tag, the other targets get the pushed tag
+		if tags != pushed.Tag && target != "" && !utils.IsTargetTemplate(target) && !utils.IsArchiveURL(target) {
+			targetURL, err := utils.NewRepoURL(target)
+			if err != nil {
+				continue
+			}
+			target = targetURL.GetURLWithoutTag()
+		}
+		matched[sourceURL.GetURLWithoutTag()+":"+pushed.Tag] = target
+	}
+	return matched
+}
+
+// repository returns the repository with the implicit library namespace of Docker Hub
+func (p PushedImage) repository() string {
+	if isDockerHub(p.Registry) && !strings.Contains(p.Repository, "/") {
+		return "library/" + p.Repository
+	}
+	return p.Repository
+}
+
+// sameRegistry checks if the registry of a rule is pushed, which is any registry if the event
+// does not tell
+func sameRegistry(registry, pushed string) bool {
+	if pushed == "" || registry == pushed {
+		return true
+	}
+	return isDockerHub(registry) && isDockerHub(pushed)
+}
+
+func isDockerHub(registry string) bool {
+	return utils.IsContain(dockerHubAliases, registry)
+}
@@ -0,0 +1,77 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package schedule
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePushEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    []PushedImage
+		wantErr bool
+	}{
+		{
+			name: "harbor",
+			payload: `{"type": "PUSH_ARTIFACT", "event_data": {"resources": [{"tag": "v1", "resource_url": "harbor.a/library/nginx:v1"}],
+				"repository": {"repo_full_name": "library/nginx"}}}`,
+			want: []PushedImage{{Registry: "harbor.a", Repository: "library/nginx", Tag: "v1"}},
+		},
+		{
+			name:    "harbor pull",
+			payload: `{"type": "PULL_ARTIFACT", "event_data": {"resources": [{"tag": "v1"}]}}`,
+			want:    []PushedImage{},
+		},
+		{
+			name: "distribution",
+			payload: `{"events": [{"action": "push", "target": {"repository": "library/nginx", "tag": "v1"}, "request": {"host": "registry.a"}},
+				{"action": "push", "target": {"repository": "library/nginx"}, "request": {"host": "registry.a"}}]}`,
+			want: []PushedImage{{Registry: "registry.a", Repository: "library/nginx", Tag: "v1"}},
+		},
+		{
+			name:    "docker hub",
+			payload: `{"push_data": {"tag": "v1"}, "repository": {"repo_name": "alice/nginx"}}`,
+			want:    []PushedImage{{Registry: dockerHubRegistry, Repository: "alice/nginx", Tag: "v1"}},
+		},
+		{name: "docker hub without push data", payload: `{"push_data": null, "repository": {"repo_name": "alice/nginx"}}`, wantErr: true},
+		{name: "unknown payload", payload: `{"foo": "bar"}`, wantErr: true},
+		{name: "not json", payload: `push`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pushed, err := ParsePushEvent([]byte(test.payload))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", pushed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(pushed, test.want) {
+				t.Errorf("got %+v, want %+v", pushed, test.want)
+			}
+		})
+	}
+}
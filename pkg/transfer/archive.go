@@ -0,0 +1,394 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"gopkg.in/yaml.v2"
+	"tkestack.io/image-transfer/pkg/log"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+const (
+	// BundleIndexFile is the name of the bundle index inside a directory, e.g. an OCI layout
+	BundleIndexFile = "image-transfer-index.yaml"
+	// BundleIndexSuffix is appended to the path of a tarball, e.g. a docker-archive, to name its bundle index
+	BundleIndexSuffix = ".index.yaml"
+)
+
+// BundleIndex describes the images an exported bundle contains
+type BundleIndex struct {
+	Transport string        `json:"transport" yaml:"transport"`
+	Images    []BundleImage `json:"images" yaml:"images"`
+}
+
+// BundleImage is an image inside a bundle
+type BundleImage struct {
+	// Name is the reference of the image inside the bundle
+	Name string `json:"name" yaml:"name"`
+	// Source is the image url the image was exported from
+	Source string `json:"source" yaml:"source"`
+	Digest string `json:"digest" yaml:"digest"`
+}
+
+var (
+	archivesMutex sync.Mutex
+	// docker-archive writers shared by all the images exported to the same file
+	archiveWriters = make(map[string]*archive.Writer)
+	// docker-archive readers shared by all the images imported from the same file
+	archiveReaders = make(map[string]*archive.Reader)
+	// locks serializing the update of index.json of an OCI layout
+	layoutLocks = make(map[string]*sync.Mutex)
+	// image written to every single image archive, e.g. an oci-archive
+	singleImageArchives = make(map[string]string)
+	// bundle index of every archive location written by this process
+	bundleIndexes = make(map[string]*BundleIndex)
+)
+
+// dockerArchiveTransport stores images in a tarball in the format of docker save
+type dockerArchiveTransport struct{}
+
+func (dockerArchiveTransport) Name() string {
+	return "docker-archive"
+}
+
+func (dockerArchiveTransport) SourceReference(location, repository, tag string) (types.ImageReference, error) {
+	name := archiveImageName(repository, tag)
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image name %s for docker-archive: %v", name, err)
+	}
+	named = reference.TagNameOnly(named)
+
+	reader, err := getArchiveReader(location)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := reader.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, imageRefs := range refs {
+		for _, ref := range imageRefs {
+			if ref.DockerReference() != nil && ref.DockerReference().String() == named.String() {
+				return ref, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("image %s not found in %s", name, location)
+}
+
+func (dockerArchiveTransport) TargetReference(location, repository, tag string) (types.ImageReference, error) {
+	name := archiveImageName(repository, tag)
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image name %s for docker-archive: %v", name, err)
+	}
+	tagged, ok := reference.TagNameOnly(named).(reference.NamedTagged)
+	if !ok {
+		return nil, fmt.Errorf("docker-archive image name %s should have a tag", name)
+	}
+	writer, err := getArchiveWriter(location)
+	if err != nil {
+		return nil, err
+	}
+	return writer.NewReference(tagged)
+}
+
+func (dockerArchiveTransport) RepoTags(ctx context.Context, sysctx *types.SystemContext, location, repository string) ([]string, error) {
+	reader, err := getArchiveReader(location)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := reader.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, imageRefs := range refs {
+		for _, ref := range imageRefs {
+			if named := ref.DockerReference(); named != nil {
+				names = append(names, reference.FamiliarString(named), named.String())
+			}
+		}
+	}
+	return filterRepoTags(names, repository), nil
+}
+
+func (dockerArchiveTransport) ImageDigest(ctx context.Context, sysctx *types.SystemContext, ref types.ImageReference) (digest.Digest, error) {
+	return localImageDigest(ctx, sysctx, ref)
+}
+
+func (dockerArchiveTransport) BundleIndexPath(location string) string {
+	return location + BundleIndexSuffix
+}
+
+// BundleIndexPath returns the path of the bundle index of an archive location like oci:/path/dir
+func BundleIndexPath(location string) string {
+	transport, path, err := LookupTransport(location)
+	if err != nil {
+		return ""
+	}
+	return transport.BundleIndexPath(path)
+}
+
+// BundleLocation returns the archive location of a bundle exported by transport from the path of
+// its index, the bundle sits next to its index file wherever it has been carried to
+func BundleLocation(transportName, indexPath string) (string, error) {
+	transport, err := GetTransport(transportName)
+	if err != nil {
+		return "", err
+	}
+
+	if dir := filepath.Dir(indexPath); transport.BundleIndexPath(dir) == indexPath {
+		return transportName + ":" + dir, nil
+	}
+	if path := strings.TrimSuffix(indexPath, BundleIndexSuffix); transport.BundleIndexPath(path) == indexPath {
+		return transportName + ":" + path, nil
+	}
+	return "", fmt.Errorf("transport %s does not export a bundle index %s", transportName, indexPath)
+}
+
+// archiveImageName returns the name of image repository:tag inside an archive
+func archiveImageName(repository, tag string) string {
+	if tag == "" {
+		return repository
+	}
+	return repository + ":" + tag
+}
+
+// filterRepoTags returns the tags of the image names inside an archive which belong to repository
+func filterRepoTags(names []string, repository string) []string {
+	var tags []string
+	for _, name := range names {
+		repo, tag := utils.SplitArchiveName(name)
+		if repo == repository && tag != "" && !utils.IsContain(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// localImageDigest computes the manifest digest of an image stored in local files
+func localImageDigest(ctx context.Context, sysctx *types.SystemContext, ref types.ImageReference) (digest.Digest, error) {
+	if ref == nil {
+		return "", fmt.Errorf("can not get image digest without specfied a tag")
+	}
+
+	source, err := ref.NewImageSource(ctx, sysctx)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+
+	manifestByte, _, err := source.GetManifest(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	return manifest.Digest(manifestByte)
+}
+
+// getArchiveWriter returns the writer of a docker-archive file, creates it if not exist
+func getArchiveWriter(path string) (*archive.Writer, error) {
+	archivesMutex.Lock()
+	defer archivesMutex.Unlock()
+
+	if writer, exist := archiveWriters[path]; exist {
+		return writer, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	writer, err := archive.NewWriter(nil, path)
+	if err != nil {
+		return nil, err
+	}
+	archiveWriters[path] = writer
+	return writer, nil
+}
+
+// getArchiveReader returns the reader of a docker-archive file, opens it if not opened yet
+func getArchiveReader(path string) (*archive.Reader, error) {
+	archivesMutex.Lock()
+	defer archivesMutex.Unlock()
+
+	if reader, exist := archiveReaders[path]; exist {
+		return reader, nil
+	}
+
+	reader, err := archive.NewReader(nil, path)
+	if err != nil {
+		return nil, err
+	}
+	archiveReaders[path] = reader
+	return reader, nil
+}
+
+// getLayoutLock returns the lock of an OCI layout directory
+func getLayoutLock(dir string) *sync.Mutex {
+	archivesMutex.Lock()
+	defer archivesMutex.Unlock()
+
+	lock, exist := layoutLocks[dir]
+	if !exist {
+		lock = &sync.Mutex{}
+		layoutLocks[dir] = lock
+	}
+	return lock
+}
+
+// claimSingleImageArchive makes sure an archive holding a single image, e.g. an oci-archive, is only
+// written with the image name, a retry of the same image is allowed
+func claimSingleImageArchive(path, name string) error {
+	archivesMutex.Lock()
+	defer archivesMutex.Unlock()
+
+	claimed, exist := singleImageArchives[path]
+	if exist && claimed != name {
+		return fmt.Errorf("%s holds a single image, %s is already written to it", path, claimed)
+	}
+	if !exist {
+		if info, err := os.Stat(path); err == nil && info.Size() != 0 {
+			return fmt.Errorf("%s already exists, modifying an existing archive is not supported", path)
+		}
+		singleImageArchives[path] = name
+	}
+	return nil
+}
+
+// recordBundleImage adds an exported image to the bundle index of location
+func recordBundleImage(location string, image BundleImage) {
+	archivesMutex.Lock()
+	defer archivesMutex.Unlock()
+
+	index, exist := bundleIndexes[location]
+	if !exist {
+		transport, _ := utils.SplitArchiveLocation(location)
+		index = &BundleIndex{Transport: transport}
+		bundleIndexes[location] = index
+	}
+	index.Images = mergeBundleImages(index.Images, image)
+}
+
+func mergeBundleImages(images []BundleImage, more ...BundleImage) []BundleImage {
+	for _, image := range more {
+		replaced := false
+		for i := range images {
+			if images[i].Name == image.Name {
+				images[i] = image
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// CloseArchives finishes all the docker-archive files and writes the bundle index
+// of every archive location, it should be called after all the jobs are done.
+// Imported docker-archive files are closed as well.
+func CloseArchives() error {
+	archivesMutex.Lock()
+	defer archivesMutex.Unlock()
+
+	var errs []string
+	for path, writer := range archiveWriters {
+		if err := writer.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("close docker-archive %s error: %v", path, err))
+		}
+	}
+	for path, reader := range archiveReaders {
+		if err := reader.Close(); err != nil {
+			errs = append(errs, fmt.Sprintf("close docker-archive %s error: %v", path, err))
+		}
+	}
+
+	for location, index := range bundleIndexes {
+		if err := writeBundleIndex(location, index); err != nil {
+			errs = append(errs, fmt.Sprintf("write bundle index of %s error: %v", location, err))
+			continue
+		}
+		log.Infof("Write bundle index of %s with %v images to %s", location, len(index.Images), BundleIndexPath(location))
+	}
+
+	archiveWriters = make(map[string]*archive.Writer)
+	archiveReaders = make(map[string]*archive.Reader)
+	layoutLocks = make(map[string]*sync.Mutex)
+	singleImageArchives = make(map[string]string)
+	bundleIndexes = make(map[string]*BundleIndex)
+
+	if len(errs) != 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// writeBundleIndex writes index of location, an existing index inside a directory like an OCI
+// layout is merged since a directory can be exported to more than once
+func writeBundleIndex(location string, index *BundleIndex) error {
+	indexPath := BundleIndexPath(location)
+	_, path := utils.SplitArchiveLocation(location)
+
+	if filepath.Dir(indexPath) == path {
+		if existing, err := ReadBundleIndex(indexPath); err == nil {
+			index.Images = mergeBundleImages(existing.Images, index.Images...)
+		}
+	}
+	sort.Slice(index.Images, func(i, j int) bool {
+		return index.Images[i].Name < index.Images[j].Name
+	})
+
+	data, err := yaml.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(indexPath, data, 0644)
+}
+
+// ReadBundleIndex reads a bundle index file
+func ReadBundleIndex(indexPath string) (*BundleIndex, error) {
+	data, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &BundleIndex{}
+	if err := yaml.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("unmarshal bundle index %s error: %v", indexPath, err)
+	}
+	return index, nil
+}
@@ -0,0 +1,209 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// catalogPageSize is the number of repositories asked for by a request of the catalog API
+const catalogPageSize = 1000
+
+// ListRepositories lists the repositories of a registry by its catalog API, a registry usually
+// only lists the repositories the user can pull, and some registries like Docker Hub have no
+// catalog at all. An insecure registry is tried with plain http if https fails.
+func ListRepositories(registry, username, password string, insecure bool) ([]string, error) {
+	client := &catalogClient{
+		client:   &http.Client{Timeout: 60 * time.Second},
+		username: username,
+		password: password,
+	}
+	if insecure {
+		client.client.Transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			// nolint: gosec
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+
+	repositories, err := client.list("https://" + registry)
+	if err != nil && insecure {
+		if httpRepositories, httpErr := client.list("http://" + registry); httpErr == nil {
+			return httpRepositories, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list repositories of %s error: %v", registry, err)
+	}
+	return repositories, nil
+}
+
+// catalogClient pages through the catalog of a registry, it answers the auth challenges of the
+// registry with the basic auth of the user or a bearer token issued for it
+type catalogClient struct {
+	client             *http.Client
+	username, password string
+	authorization      string
+}
+
+// nextLinkPattern finds the next page in a Link header like </v2/_catalog?last=a&n=1000>; rel="next"
+var nextLinkPattern = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+func (c *catalogClient) list(base string) ([]string, error) {
+	var repositories []string
+	next := fmt.Sprintf("%s/v2/_catalog?n=%d", base, catalogPageSize)
+	for next != "" {
+		resp, err := c.get(next)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decode catalog error: %v", err)
+		}
+		repositories = append(repositories, page.Repositories...)
+
+		next = ""
+		if match := nextLinkPattern.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+			link, err := url.Parse(match[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid catalog link %s: %v", match[1], err)
+			}
+			next = resp.Request.URL.ResolveReference(link).String()
+		}
+	}
+	return repositories, nil
+}
+
+// get requests url, answering an auth challenge once
+func (c *catalogClient) get(url string) (*http.Response, error) {
+	resp, err := c.do(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && c.authorization == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := c.authorize(challenge); err != nil {
+			return nil, err
+		}
+		if resp, err = c.do(url); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("get %s: %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func (c *catalogClient) do(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.authorization != "" {
+		req.Header.Set("Authorization", c.authorization)
+	}
+	return c.client.Do(req)
+}
+
+// challengeParamPattern finds the parameters of a challenge like Bearer realm="...",service="..."
+var challengeParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authorize answers a Basic or Bearer challenge of the registry
+func (c *catalogClient) authorize(challenge string) error {
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	switch scheme {
+	case "basic":
+		if c.username == "" {
+			return fmt.Errorf("registry requires basic auth, but no credentials are given")
+		}
+		c.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported auth challenge %q", challenge)
+	}
+
+	params := map[string]string{}
+	for _, match := range challengeParamPattern.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+	if params["realm"] == "" {
+		return fmt.Errorf("no realm in auth challenge %q", challenge)
+	}
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil {
+		return fmt.Errorf("invalid realm in auth challenge %q: %v", challenge, err)
+	}
+	query := tokenURL.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", "registry:catalog:*")
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("get registry token error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("get registry token error: %s", resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("decode registry token error: %v", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return fmt.Errorf("no token in the response of %s", params["realm"])
+	}
+	c.authorization = "Bearer " + token.Token
+	return nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newCatalogRegistry serves a catalog of repositories in pages of two behind a bearer token
+func newCatalogRegistry(t *testing.T, repositories []string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			username, password, ok := r.BasicAuth()
+			if !ok || username != "alice" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if scope := r.URL.Query().Get("scope"); scope != "registry:catalog:*" {
+				t.Errorf("token scope = %q, want registry:catalog:*", scope)
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": "t0ken"})
+		case "/v2/_catalog":
+			if r.Header.Get("Authorization") != "Bearer t0ken" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, server.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			start := 0
+			if last := r.URL.Query().Get("last"); last != "" {
+				for i, repository := range repositories {
+					if repository == last {
+						start = i + 1
+					}
+				}
+			}
+			end := start + 2
+			if end < len(repositories) {
+				w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?last=%s&n=2>; rel="next"`, repositories[end-1]))
+			} else {
+				end = len(repositories)
+			}
+			json.NewEncoder(w).Encode(map[string][]string{"repositories": repositories[start:end]})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server
+}
+
+func TestListRepositories(t *testing.T) {
+	repositories := []string{"teamx/a", "teamx/b", "teamy/c", "teamx/d/e", "teamz/f"}
+	server := newCatalogRegistry(t, repositories)
+	defer server.Close()
+	registry := strings.TrimPrefix(server.URL, "https://")
+
+	listed, err := ListRepositories(registry, "alice", "secret", true)
+	if err != nil {
+		t.Fatalf("ListRepositories() error = %v", err)
+	}
+	if !reflect.DeepEqual(listed, repositories) {
+		t.Errorf("ListRepositories() = %v, want %v", listed, repositories)
+	}
+
+	if _, err := ListRepositories(registry, "alice", "wrong", true); err == nil {
+		t.Error("ListRepositories() with a wrong password error = nil, want an error")
+	}
+}
@@ -0,0 +1,300 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	// ManifestFormatSchema2 converts manifests to docker schema2 manifests and manifest lists
+	ManifestFormatSchema2 = "schema2"
+	// ManifestFormatOCI converts manifests to OCI manifests and indexes
+	ManifestFormatOCI = "oci"
+)
+
+// ConvertedManifest is a manifest rebuilt to another manifest type
+type ConvertedManifest struct {
+	Manifest     []byte
+	ManifestType string
+	// Config is the rebuilt config blob, the conversion may change it
+	Config     []byte
+	ConfigInfo types.BlobInfo
+}
+
+// ConvertManifest converts the manifest of an image instance to manifestType and replaces its
+// layers which are recompressed, instanceDigest selects an image of a manifest list and is nil for
+// the top level manifest
+func (i *ImageSource) ConvertManifest(instanceDigest *digest.Digest, manifestType string,
+	recompressed map[digest.Digest]RecompressedLayer) (*ConvertedManifest, error) {
+	if i.source == nil {
+		return nil, fmt.Errorf("can not convert manifest without specfied a tag")
+	}
+	img, err := image.FromUnparsedImage(i.ctx, i.sysctx, image.UnparsedInstance(i.source, instanceDigest))
+	if err != nil {
+		return nil, err
+	}
+	_, sourceType, err := img.Manifest(i.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	options := types.ManifestUpdateOptions{}
+	// an image is not converted to its own manifest type
+	if manifestType != sourceType {
+		options.ManifestMIMEType = manifestType
+	}
+	layerInfos := img.LayerInfos()
+	if len(recompressed) != 0 {
+		options.LayerInfos = recompressedLayerInfos(layerInfos, recompressed)
+	}
+	// a schema1 manifest does not know the sizes and the uncompressed digests of its layers
+	if img.UpdatedImageNeedsLayerDiffIDs(options) {
+		options.InformationOnly.LayerInfos, options.InformationOnly.LayerDiffIDs, err = i.inspectLayers(layerInfos, recompressed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	updated := types.Image(img)
+	// the layers are replaced after the conversion, but zstd layers of an OCI manifest converted to
+	// schema2 are replaced before as docker manifests can not describe them
+	if options.LayerInfos != nil && options.ManifestMIMEType == manifest.DockerV2Schema2MediaType && !isSchema1(sourceType) {
+		updated, err = img.UpdatedImage(i.ctx, types.ManifestUpdateOptions{LayerInfos: options.LayerInfos})
+		if err != nil {
+			return nil, err
+		}
+		options.LayerInfos = nil
+	}
+	updated, err = updated.UpdatedImage(i.ctx, options)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestByte, _, err := updated.Manifest(i.ctx)
+	if err != nil {
+		return nil, err
+	}
+	config, err := updated.ConfigBlob(i.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := i.verifyDiffIDs(sourceType, layerInfos, recompressed, updated); err != nil {
+		return nil, err
+	}
+
+	return &ConvertedManifest{
+		Manifest:     manifestByte,
+		ManifestType: manifestType,
+		Config:       config,
+		ConfigInfo:   updated.ConfigInfo(),
+	}, nil
+}
+
+// isSchema1 checks if manifestType is a docker schema1 manifest
+func isSchema1(manifestType string) bool {
+	normalized := manifest.NormalizedMIMEType(manifestType)
+	return normalized == manifest.DockerV2Schema1MediaType || normalized == manifest.DockerV2Schema1SignedMediaType
+}
+
+// recompressedLayerInfos returns layerInfos with the layers which are recompressed replaced
+func recompressedLayerInfos(layerInfos []types.BlobInfo, recompressed map[digest.Digest]RecompressedLayer) []types.BlobInfo {
+	updated := make([]types.BlobInfo, 0, len(layerInfos))
+	for _, layerInfo := range layerInfos {
+		layer, exist := recompressed[layerInfo.Digest]
+		if !exist {
+			updated = append(updated, layerInfo)
+			continue
+		}
+		algorithm, err := compression.AlgorithmByName(layer.Compression)
+		if err != nil {
+			updated = append(updated, layerInfo)
+			continue
+		}
+		layerInfo.Digest = layer.Digest
+		layerInfo.Size = layer.Size
+		layerInfo.CompressionOperation = types.Compress
+		layerInfo.CompressionAlgorithm = &algorithm
+		updated = append(updated, layerInfo)
+	}
+	return updated
+}
+
+// verifyDiffIDs checks that the recompressed layers have the uncompressed digests which the config
+// of the updated image records
+func (i *ImageSource) verifyDiffIDs(sourceType string, layerInfos []types.BlobInfo,
+	recompressed map[digest.Digest]RecompressedLayer, updated types.Image) error {
+	// the diffIDs of a converted schema1 image are the ones computed from its layers
+	if len(recompressed) == 0 || isSchema1(sourceType) {
+		return nil
+	}
+	config, err := updated.OCIConfig(i.ctx)
+	if err != nil {
+		return err
+	}
+	if len(config.RootFS.DiffIDs) != len(layerInfos) {
+		return fmt.Errorf("config records %d diffIDs for %d layers", len(config.RootFS.DiffIDs), len(layerInfos))
+	}
+	for index, layerInfo := range layerInfos {
+		layer, exist := recompressed[layerInfo.Digest]
+		if exist && layer.DiffID != config.RootFS.DiffIDs[index] {
+			return fmt.Errorf("layer %s is %s uncompressed but the config records diffID %s",
+				layerInfo.Digest, layer.DiffID, config.RootFS.DiffIDs[index])
+		}
+	}
+	return nil
+}
+
+// inspectLayers reads the layers of source to return their sizes and the digests of their
+// uncompressed contents, in the order of layerInfos, the diffIDs of the recompressed layers are known
+func (i *ImageSource) inspectLayers(layerInfos []types.BlobInfo, recompressed map[digest.Digest]RecompressedLayer) ([]types.BlobInfo, []digest.Digest, error) {
+	type inspected struct {
+		size   int64
+		diffID digest.Digest
+	}
+	// a schema1 manifest repeats the empty layer for every history entry without content
+	known := map[digest.Digest]inspected{}
+
+	sizes := make([]types.BlobInfo, 0, len(layerInfos))
+	diffIDs := make([]digest.Digest, 0, len(layerInfos))
+	for _, layerInfo := range layerInfos {
+		layer, ok := known[layerInfo.Digest]
+		if recompressedLayer, exist := recompressed[layerInfo.Digest]; exist && !ok {
+			layer = inspected{size: recompressedLayer.SourceSize, diffID: recompressedLayer.DiffID}
+			known[layerInfo.Digest] = layer
+			ok = true
+		}
+		if !ok {
+			size, diffID, err := i.inspectLayer(layerInfo)
+			if err != nil {
+				return nil, nil, fmt.Errorf("inspect layer %s of %s/%s:%s error: %v", layerInfo.Digest,
+					i.GetRegistry(), i.GetRepository(), i.GetTag(), err)
+			}
+			layer = inspected{size: size, diffID: diffID}
+			known[layerInfo.Digest] = layer
+			log.Debug("Inspect layer", log.String(log.SourceKey, i.GetRegistry()+"/"+i.GetRepository()+":"+i.GetTag()),
+				log.String(log.DigestKey, layerInfo.Digest.String()), log.Int64(log.BytesKey, size),
+				log.String("diff_id", diffID.String()))
+		}
+
+		sizeInfo := layerInfo
+		sizeInfo.Size = layer.size
+		sizes = append(sizes, sizeInfo)
+		diffIDs = append(diffIDs, layer.diffID)
+	}
+	return sizes, diffIDs, nil
+}
+
+// inspectLayer downloads a layer to return its size and the digest of its uncompressed content
+func (i *ImageSource) inspectLayer(layerInfo types.BlobInfo) (int64, digest.Digest, error) {
+	blob, _, err := i.GetABlob(layerInfo)
+	if err != nil {
+		return 0, "", err
+	}
+	verifiedBlob, err := NewVerifyingReader(blob, layerInfo)
+	if err != nil {
+		blob.Close()
+		return 0, "", err
+	}
+	defer verifiedBlob.Close()
+
+	counter := &countingReader{reader: verifiedBlob}
+	uncompressed, _, err := compression.AutoDecompress(counter)
+	if err != nil {
+		return 0, "", err
+	}
+	defer uncompressed.Close()
+
+	diffID, err := digest.Canonical.FromReader(uncompressed)
+	if err != nil {
+		return 0, "", err
+	}
+	// the blob is verified only once it is read to its end
+	if _, err := io.Copy(ioutil.Discard, counter); err != nil {
+		return 0, "", err
+	}
+	return counter.size, diffID, nil
+}
+
+// countingReader counts the bytes read from reader
+type countingReader struct {
+	reader io.Reader
+	size   int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// formatManifestType returns the manifest type of format for a manifest of manifestType, it is
+// manifestType itself if format is empty
+func formatManifestType(format, manifestType string) string {
+	isList := manifest.MIMETypeIsMultiImage(manifestType)
+	switch {
+	case format == ManifestFormatSchema2 && isList:
+		return manifest.DockerV2ListMediaType
+	case format == ManifestFormatSchema2:
+		return manifest.DockerV2Schema2MediaType
+	case format == ManifestFormatOCI && isList:
+		return imgspecv1.MediaTypeImageIndex
+	case format == ManifestFormatOCI:
+		return imgspecv1.MediaTypeImageManifest
+	default:
+		return manifestType
+	}
+}
+
+// SupportedManifestTypes returns the manifest types a target accepts, nil means any type
+func (i *ImageTarget) SupportedManifestTypes() []string {
+	return i.target.SupportedManifestMIMETypes()
+}
+
+// chooseManifestType returns the manifest type a manifest of manifestType should be pushed as to a
+// target supporting supportedTypes, it is manifestType itself if no conversion is needed and empty
+// if the target can not store such a manifest at all
+func chooseManifestType(manifestType string, supportedTypes []string) string {
+	if len(supportedTypes) == 0 {
+		return manifestType
+	}
+
+	isList := manifest.MIMETypeIsMultiImage(manifestType)
+	for _, supportedType := range supportedTypes {
+		if supportedType == manifestType {
+			return manifestType
+		}
+	}
+	for _, supportedType := range supportedTypes {
+		if manifest.MIMETypeIsMultiImage(supportedType) == isList {
+			return supportedType
+		}
+	}
+	return ""
+}
@@ -0,0 +1,380 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testLayer is a layer blob with one file
+type testLayer struct {
+	blob   []byte
+	digest digest.Digest
+	diffID digest.Digest
+}
+
+func newTestLayer(t *testing.T, content string, algorithm compression.Algorithm) testLayer {
+	var uncompressed bytes.Buffer
+	tw := tar.NewWriter(&uncompressed)
+	if content != "" {
+		if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	compressor, err := compression.CompressStream(&compressed, algorithm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compressor.Write(uncompressed.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressor.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return testLayer{
+		blob:   compressed.Bytes(),
+		digest: digest.FromBytes(compressed.Bytes()),
+		diffID: digest.FromBytes(uncompressed.Bytes()),
+	}
+}
+
+// openDirImage stores an image with manifest and blobs in the layout of the dir transport, and
+// opens it as dir:<temp dir>/library/test:v1
+func openDirImage(t *testing.T, manifestByte []byte, blobs ...[]byte) *ImageSource {
+	root := t.TempDir()
+	imageDir := dirImagePath(root, "library/test", "v1")
+	if err := os.MkdirAll(imageDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(imageDir, "manifest.json"), manifestByte, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range blobs {
+		if err := ioutil.WriteFile(filepath.Join(imageDir, digest.FromBytes(blob).Encoded()), blob, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	source, err := NewImageSource("dir:"+root, "library/test", "v1", "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { source.Close() })
+	return source
+}
+
+// schema2Image returns the schema2 manifest and config of an image of layers
+func schema2Image(t *testing.T, layers ...testLayer) ([]byte, []byte) {
+	config := manifest.Schema2Image{
+		Schema2V1Image: manifest.Schema2V1Image{Architecture: "amd64", OS: "linux"},
+		RootFS:         &manifest.Schema2RootFS{Type: "layers"},
+	}
+	var descriptors []manifest.Schema2Descriptor
+	for _, layer := range layers {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layer.diffID)
+		config.History = append(config.History, manifest.Schema2History{CreatedBy: "ADD file /"})
+		descriptors = append(descriptors, manifest.Schema2Descriptor{
+			MediaType: manifest.DockerV2Schema2LayerMediaType,
+			Size:      int64(len(layer.blob)),
+			Digest:    layer.digest,
+		})
+	}
+	configByte := mustMarshal(t, config)
+	manifestByte, err := manifest.Schema2FromComponents(manifest.Schema2Descriptor{
+		MediaType: manifest.DockerV2Schema2ConfigMediaType,
+		Size:      int64(len(configByte)),
+		Digest:    digest.FromBytes(configByte),
+	}, descriptors).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifestByte, configByte
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// checkConfigDescriptor checks that the converted manifest refers to the config it reports
+func checkConfigDescriptor(t *testing.T, converted *ConvertedManifest, descriptor imgspecv1.Descriptor) {
+	if converted.ConfigInfo.Digest != digest.FromBytes(converted.Config) || converted.ConfigInfo.Size != int64(len(converted.Config)) {
+		t.Errorf("config info %s/%d does not describe the config blob", converted.ConfigInfo.Digest, converted.ConfigInfo.Size)
+	}
+	if descriptor.Digest != converted.ConfigInfo.Digest || descriptor.Size != converted.ConfigInfo.Size {
+		t.Errorf("manifest refers to config %s/%d, reported %s/%d", descriptor.Digest, descriptor.Size,
+			converted.ConfigInfo.Digest, converted.ConfigInfo.Size)
+	}
+}
+
+func TestConvertSchema1ToSchema2(t *testing.T) {
+	layer := newTestLayer(t, "hello", compression.Gzip)
+	empty := newTestLayer(t, "", compression.Gzip)
+
+	baseID, topID := digest.FromString("base").Encoded(), digest.FromString("top").Encoded()
+	schema1 := map[string]interface{}{
+		"schemaVersion": 1,
+		"name":          "library/test",
+		"tag":           "v1",
+		"architecture":  "amd64",
+		// the top of the image comes first
+		"fsLayers": []map[string]string{{"blobSum": empty.digest.String()}, {"blobSum": layer.digest.String()}},
+		"history": []map[string]string{
+			{"v1Compatibility": string(mustMarshal(t, map[string]interface{}{
+				"id": topID, "parent": baseID, "created": "2020-01-02T00:00:00Z", "throwaway": true,
+				"architecture": "amd64", "os": "linux",
+				"config":           map[string]interface{}{"Cmd": []string{"/bin/sh"}},
+				"container_config": map[string]interface{}{"Cmd": []string{"/bin/sh", "-c", "#(nop) CMD [\"/bin/sh\"]"}},
+			}))},
+			{"v1Compatibility": string(mustMarshal(t, map[string]interface{}{
+				"id": baseID, "created": "2020-01-01T00:00:00Z",
+				"container_config": map[string]interface{}{"Cmd": []string{"/bin/sh", "-c", "#(nop) ADD file /"}},
+			}))},
+		},
+	}
+	source := openDirImage(t, mustMarshal(t, schema1), layer.blob, empty.blob)
+
+	_, sourceType, err := source.GetManifest(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSchema1(sourceType) {
+		t.Fatalf("source manifest type %s, want schema1", sourceType)
+	}
+
+	converted, err := source.ConvertManifest(nil, manifest.DockerV2Schema2MediaType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted.ManifestType != manifest.DockerV2Schema2MediaType {
+		t.Errorf("manifest type %s", converted.ManifestType)
+	}
+	if got := manifest.GuessMIMEType(converted.Manifest); got != manifest.DockerV2Schema2MediaType {
+		t.Errorf("converted manifest is %s", got)
+	}
+
+	schema2, err := manifest.Schema2FromManifest(converted.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfigDescriptor(t, converted, imgspecv1.Descriptor{Digest: schema2.ConfigDescriptor.Digest, Size: schema2.ConfigDescriptor.Size})
+	if schema2.ConfigDescriptor.MediaType != manifest.DockerV2Schema2ConfigMediaType {
+		t.Errorf("config media type %s", schema2.ConfigDescriptor.MediaType)
+	}
+	// the empty layer of the CMD is dropped, the size unknown to schema1 is filled in
+	wantLayers := []manifest.Schema2Descriptor{{
+		MediaType: manifest.DockerV2Schema2LayerMediaType,
+		Size:      int64(len(layer.blob)),
+		Digest:    layer.digest,
+	}}
+	if !reflect.DeepEqual(schema2.LayersDescriptors, wantLayers) {
+		t.Errorf("layers %+v, want %+v", schema2.LayersDescriptors, wantLayers)
+	}
+
+	// the config is rebuilt from the history with the diffIDs of the layers
+	config := manifest.Schema2Image{}
+	if err := json.Unmarshal(converted.Config, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.RootFS == nil || !reflect.DeepEqual(config.RootFS.DiffIDs, []digest.Digest{layer.diffID}) {
+		t.Errorf("rootfs %+v, want diffID %s", config.RootFS, layer.diffID)
+	}
+	if config.Architecture != "amd64" || config.OS != "linux" || !reflect.DeepEqual([]string(config.Config.Cmd), []string{"/bin/sh"}) {
+		t.Errorf("config %+v lost the image config of schema1", config.Schema2V1Image)
+	}
+	if len(config.History) != 2 || config.History[0].EmptyLayer || !config.History[1].EmptyLayer {
+		t.Errorf("history %+v, want the base layer and the empty CMD layer", config.History)
+	}
+}
+
+func TestConvertSchema2ToOCI(t *testing.T) {
+	layers := []testLayer{newTestLayer(t, "base", compression.Gzip), newTestLayer(t, "app", compression.Gzip)}
+	manifestByte, configByte := schema2Image(t, layers...)
+	source := openDirImage(t, manifestByte, configByte, layers[0].blob, layers[1].blob)
+
+	converted, err := source.ConvertManifest(nil, imgspecv1.MediaTypeImageManifest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := manifest.GuessMIMEType(converted.Manifest); got != imgspecv1.MediaTypeImageManifest {
+		t.Errorf("converted manifest is %s", got)
+	}
+
+	oci, err := manifest.OCI1FromManifest(converted.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfigDescriptor(t, converted, oci.Config)
+	if oci.Config.MediaType != imgspecv1.MediaTypeImageConfig {
+		t.Errorf("config media type %s", oci.Config.MediaType)
+	}
+	if len(oci.Layers) != len(layers) {
+		t.Fatalf("%d layers, want %d", len(oci.Layers), len(layers))
+	}
+	for i, layer := range oci.Layers {
+		if layer.MediaType != imgspecv1.MediaTypeImageLayerGzip || layer.Digest != layers[i].digest || layer.Size != int64(len(layers[i].blob)) {
+			t.Errorf("layer %d is %s %s/%d, want the gzip layer %s/%d", i, layer.MediaType, layer.Digest, layer.Size,
+				layers[i].digest, len(layers[i].blob))
+		}
+	}
+
+	// the config is rebuilt as an OCI image config, which keeps the layers and the platform
+	if bytes.Equal(converted.Config, configByte) {
+		t.Error("config is not rebuilt")
+	}
+	config := imgspecv1.Image{}
+	if err := json.Unmarshal(converted.Config, &config); err != nil {
+		t.Fatal(err)
+	}
+	if want := []digest.Digest{layers[0].diffID, layers[1].diffID}; !reflect.DeepEqual(config.RootFS.DiffIDs, want) {
+		t.Errorf("diffIDs %v, want %v", config.RootFS.DiffIDs, want)
+	}
+	if config.Architecture != "amd64" || config.OS != "linux" {
+		t.Errorf("platform %s/%s, want linux/amd64", config.OS, config.Architecture)
+	}
+
+	// converted back to schema2, the manifest refers to the same layers again
+	back, err := openDirImage(t, converted.Manifest, converted.Config, layers[0].blob, layers[1].blob).
+		ConvertManifest(nil, manifest.DockerV2Schema2MediaType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema2, err := manifest.Schema2FromManifest(back.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source2, err := manifest.Schema2FromManifest(manifestByte)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(schema2.LayersDescriptors, source2.LayersDescriptors) {
+		t.Errorf("round trip manifest %s, want the layers of %s", back.Manifest, manifestByte)
+	}
+	checkConfigDescriptor(t, back, imgspecv1.Descriptor{Digest: schema2.ConfigDescriptor.Digest, Size: schema2.ConfigDescriptor.Size})
+}
+
+func TestConvertManifestList(t *testing.T) {
+	amd64, arm64 := digest.FromString("amd64"), digest.FromString("arm64")
+	list := manifest.Schema2ListFromComponents([]manifest.Schema2ManifestDescriptor{
+		{
+			Schema2Descriptor: manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2MediaType, Size: 100, Digest: amd64},
+			Platform:          manifest.Schema2PlatformSpec{Architecture: "amd64", OS: "linux"},
+		},
+		{
+			Schema2Descriptor: manifest.Schema2Descriptor{MediaType: manifest.DockerV2Schema2MediaType, Size: 200, Digest: arm64},
+			Platform:          manifest.Schema2PlatformSpec{Architecture: "arm64", OS: "linux", Variant: "v8"},
+		},
+	})
+	listByte, err := list.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the instances are converted first, the list refers to the digests they are pushed with
+	instances := []manifest.ListUpdate{
+		{Digest: digest.FromString("amd64 oci"), Size: 101, MediaType: imgspecv1.MediaTypeImageManifest},
+		{Digest: digest.FromString("arm64 oci"), Size: 201, MediaType: imgspecv1.MediaTypeImageManifest},
+	}
+	converted, err := convertManifestList(listByte, manifest.DockerV2ListMediaType, imgspecv1.MediaTypeImageIndex, instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := manifest.OCI1IndexFromManifest(converted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.GuessMIMEType(converted) != imgspecv1.MediaTypeImageIndex || len(index.Manifests) != len(instances) {
+		t.Fatalf("converted list %s", converted)
+	}
+	for i, instance := range index.Manifests {
+		if instance.Digest != instances[i].Digest || instance.Size != instances[i].Size || instance.MediaType != instances[i].MediaType {
+			t.Errorf("instance %d is %s %s/%d, want %+v", i, instance.MediaType, instance.Digest, instance.Size, instances[i])
+		}
+	}
+	if platform := index.Manifests[1].Platform; platform == nil || platform.Architecture != "arm64" || platform.Variant != "v8" {
+		t.Errorf("platform of arm64 is %+v", platform)
+	}
+
+	if _, err := convertManifestList(listByte, manifest.DockerV2ListMediaType, imgspecv1.MediaTypeImageIndex, instances[:1]); err == nil {
+		t.Error("list converted with the update of one of its two instances")
+	}
+}
+
+func TestFormatManifestType(t *testing.T) {
+	tests := []struct {
+		format       string
+		manifestType string
+		want         string
+	}{
+		{"", manifest.DockerV2Schema1SignedMediaType, manifest.DockerV2Schema1SignedMediaType},
+		{ManifestFormatSchema2, manifest.DockerV2Schema1SignedMediaType, manifest.DockerV2Schema2MediaType},
+		{ManifestFormatSchema2, imgspecv1.MediaTypeImageIndex, manifest.DockerV2ListMediaType},
+		{ManifestFormatOCI, manifest.DockerV2Schema2MediaType, imgspecv1.MediaTypeImageManifest},
+		{ManifestFormatOCI, manifest.DockerV2ListMediaType, imgspecv1.MediaTypeImageIndex},
+	}
+	for _, test := range tests {
+		if got := formatManifestType(test.format, test.manifestType); got != test.want {
+			t.Errorf("formatManifestType(%q, %s) = %s, want %s", test.format, test.manifestType, got, test.want)
+		}
+	}
+}
+
+func TestChooseManifestType(t *testing.T) {
+	ociOnly := []string{imgspecv1.MediaTypeImageManifest, imgspecv1.MediaTypeImageIndex}
+	tests := []struct {
+		manifestType string
+		supported    []string
+		want         string
+	}{
+		{manifest.DockerV2Schema2MediaType, nil, manifest.DockerV2Schema2MediaType},
+		{manifest.DockerV2Schema2MediaType, ociOnly, imgspecv1.MediaTypeImageManifest},
+		{manifest.DockerV2ListMediaType, ociOnly, imgspecv1.MediaTypeImageIndex},
+		{imgspecv1.MediaTypeImageManifest, ociOnly, imgspecv1.MediaTypeImageManifest},
+		{manifest.DockerV2ListMediaType, []string{manifest.DockerV2Schema2MediaType}, ""},
+	}
+	for _, test := range tests {
+		if got := chooseManifestType(test.manifestType, test.supported); got != test.want {
+			t.Errorf("chooseManifestType(%s, %v) = %q, want %q", test.manifestType, test.supported, got, test.want)
+		}
+	}
+}
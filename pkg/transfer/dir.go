@@ -0,0 +1,85 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/image/v5/directory"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// dirTransport stores every image in its own directory <location>/<repository>/<tag>
+// with the layout of the containers/image "dir" transport
+type dirTransport struct{}
+
+func (dirTransport) Name() string {
+	return "dir"
+}
+
+func (dirTransport) SourceReference(location, repository, tag string) (types.ImageReference, error) {
+	return directory.NewReference(dirImagePath(location, repository, tag))
+}
+
+func (dirTransport) TargetReference(location, repository, tag string) (types.ImageReference, error) {
+	path := dirImagePath(location, repository, tag)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return directory.NewReference(path)
+}
+
+func (dirTransport) RepoTags(ctx context.Context, sysctx *types.SystemContext, location, repository string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(location, repository))
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		// only the directories holding an image are tags, the others may be nested repositories
+		if _, err := os.Stat(filepath.Join(location, repository, entry.Name(), "manifest.json")); err == nil {
+			tags = append(tags, entry.Name())
+		}
+	}
+	return tags, nil
+}
+
+func (dirTransport) ImageDigest(ctx context.Context, sysctx *types.SystemContext, ref types.ImageReference) (digest.Digest, error) {
+	return localImageDigest(ctx, sysctx, ref)
+}
+
+func (dirTransport) BundleIndexPath(location string) string {
+	return filepath.Join(location, BundleIndexFile)
+}
+
+// dirImagePath returns the directory of image repository:tag, the tag defaults to latest
+func dirImagePath(location, repository, tag string) string {
+	if tag == "" {
+		tag = "latest"
+	}
+	return filepath.Join(location, repository, tag)
+}
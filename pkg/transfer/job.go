@@ -19,9 +19,16 @@
 package transfer
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
 	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/pkg/blobinfocache/memory"
 	"github.com/containers/image/v5/pkg/blobinfocache/none"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"tkestack.io/image-transfer/pkg/log"
 )
@@ -35,12 +42,35 @@ var (
 
 // Job act as a sync action, it will pull a images from source to target
 type Job struct {
-	Source *ImageSource
-	Target *ImageTarget
+	Source Source
+	Target Target
+	// SourceDigest is the manifest digest of the source image transferred by Run
+	SourceDigest digest.Digest
+	// TargetDigest is the manifest digest pushed to the target by Run, it differs from SourceDigest
+	// if the manifest is converted
+	TargetDigest digest.Digest
+	// SourceManifestType and TargetManifestType are the manifest types of the source image and of
+	// the manifest pushed to the target
+	SourceManifestType string
+	TargetManifestType string
+	// ManifestFormat converts the manifests to schema2 or oci, they are kept as they are if it is empty
+	ManifestFormat string
+	// Compression recompresses the layers with gzip or zstd, they are kept as they are if it is empty
+	Compression string
+	// Platform chooses the image of a manifest list for a target which can not store manifest
+	// lists, like a docker archive, it is written as os/arch[/variant] and is the host platform
+	// if it is empty
+	Platform string
+	// Recompressed are the layers recompressed by Run, by their source digests
+	Recompressed map[digest.Digest]RecompressedLayer
+	// Progress receives the progress events of Run if it is set
+	Progress ProgressFunc
+	// JobID is the queue job the transfer belongs to, if any, it is logged as job_id
+	JobID string
 }
 
 // NewJob creates a transfer job
-func NewJob(source *ImageSource, target *ImageTarget) *Job {
+func NewJob(source Source, target Target) *Job {
 
 	return &Job{
 		Source: source,
@@ -50,122 +80,435 @@ func NewJob(source *ImageSource, target *ImageTarget) *Job {
 
 // Run is the main function of a transfer job
 func (j *Job) Run() error {
+	err := j.run()
+	j.report(ProgressEvent{Kind: ProgressImageDone, Error: err})
+	return err
+}
+
+// run transfers the image of the job
+func (j *Job) run() error {
 	// get manifest from source
-	manifestByte, manifestType, err := j.Source.GetManifest()
+	manifestByte, manifestType, err := j.Source.GetManifest(nil)
 	if err != nil {
-		log.Errorf("Failed to get manifest from %s/%s:%s error: %v",
-			j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag(), err)
+		log.Error("Failed to get manifest", j.LogFields(log.Err(err))...)
 		return err
 	}
-	log.Infof("Get manifest from %s/%s:%s", j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag())
+	log.Info("Get manifest", j.LogFields()...)
+
+	// the target may not store the manifest type of source, e.g. an OCI layout, convert it then
+	supportedTypes := j.Target.SupportedManifestTypes()
+	sourceManifestByte, sourceManifestType := manifestByte, manifestType
+	// instanceDigest is the image of the manifest list transferred alone to a target which can not
+	// store manifest lists
+	var instanceDigest *digest.Digest
+	if manifest.MIMETypeIsMultiImage(manifestType) &&
+		chooseManifestType(formatManifestType(j.manifestFormat(), manifestType), supportedTypes) == "" {
+		instance, err := j.chooseInstance(manifestByte, manifestType)
+		if err != nil {
+			log.Error("Choose image of manifest list error", j.LogFields(log.Err(err))...)
+			return err
+		}
+		manifestByte, manifestType, err = j.Source.GetManifest(&instance.Digest)
+		if err != nil {
+			log.Error("Get manifest for manifest list error", j.LogFields(
+				log.String(log.DigestKey, instance.Digest.String()), log.Err(err))...)
+			return err
+		}
+		instanceDigest = &instance.Digest
+		log.Info("Choose image of platform from manifest list", j.LogFields(
+			log.String(log.DigestKey, instance.Digest.String()),
+			log.String("os", instance.Platform.OS), log.String("arch", instance.Platform.Architecture))...)
+	}
 
 	blobInfos, err := j.Source.GetBlobInfos(manifestByte, manifestType)
 	if err != nil {
-		log.Errorf("Get blob info from %s/%s:%s error: %v",
-			j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag(), err)
+		log.Error("Get blob info error", j.LogFields(log.Err(err))...)
 		return err
 	}
 
 	// blob transformation
+	j.reportImageStarted(blobInfos)
+	j.Recompressed = map[digest.Digest]RecompressedLayer{}
 	for _, blobinfo := range blobInfos {
+		if j.needsRecompression(blobinfo) {
+			if _, exist := j.Recompressed[blobinfo.Digest]; exist {
+				j.reportBlobDone(blobinfo, true)
+				continue
+			}
+			layer, err := j.recompressLayer(blobinfo)
+			if err != nil {
+				log.Error("Recompress layer error", j.blobFields(blobinfo.Digest, blobinfo.Size,
+					log.String("compression", j.Compression), log.Err(err))...)
+				return err
+			}
+			j.Recompressed[blobinfo.Digest] = layer
+			continue
+		}
+
 		blobExist, err := j.Target.CheckBlobExist(blobinfo)
 		if err != nil {
-			log.Errorf("Check blob %s(%v) to %s/%s:%s exist error: %v",
-				blobinfo.Digest, blobinfo.Size, j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag(), err)
+			log.Error("Check blob exist error", j.blobFields(blobinfo.Digest, blobinfo.Size, log.Err(err))...)
 			return err
 		}
 
+		if !blobExist {
+			blobExist = j.tryMountBlob(blobinfo)
+		}
+
 		if !blobExist {
 			// pull a blob from source
-			log.Infof("Getting blob from %s/%s:%s ing...", j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag())
+			log.Info("Getting blob", j.blobFields(blobinfo.Digest, blobinfo.Size)...)
 			blob, size, err := j.Source.GetABlob(blobinfo)
 			if err != nil {
-				log.Errorf("Get blob %s(%v) from %s/%s:%s failed: %v", blobinfo.Digest,
-					size, j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag(), err)
+				log.Error("Get blob failed", j.blobFields(blobinfo.Digest, size, log.Err(err))...)
 				return err
 			}
 
-			log.Infof("Get a blob %s(%v) from %s/%s:%s success", blobinfo.Digest, size,
-				j.Source.GetRegistry(), j.Source.GetRepository(), j.Source.GetTag())
+			log.Info("Get blob success", j.blobFields(blobinfo.Digest, size)...)
+
+			// the blob is verified against the manifest as it is uploaded
+			verifiedBlob, err := NewVerifyingReader(blob, blobinfo)
+			if err != nil {
+				log.Error("Verify blob error", j.blobFields(blobinfo.Digest, blobinfo.Size, log.Err(err))...)
+				if closeErr := blob.Close(); closeErr != nil {
+					return errors.Wrapf(err, " (close error: %v)", closeErr)
+				}
+				return err
+			}
+			blob = j.newProgressReader(verifiedBlob, blobinfo)
 
 			blobinfo.Size = size
 			// push a blob to target
-			log.Infof("Putting blob to %s/%s:%s ing...", j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+			log.Info("Putting blob", j.blobFields(blobinfo.Digest, blobinfo.Size)...)
 			if err := j.Target.PutABlob(blob, blobinfo); err != nil {
-				log.Errorf("Put blob %s(%v) to %s/%s:%s failed: %v", blobinfo.Digest, blobinfo.Size,
-					j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag(), err)
+				log.Error("Put blob failed", j.blobFields(blobinfo.Digest, blobinfo.Size, log.Err(err))...)
 				if closeErr := blob.Close(); closeErr != nil {
 					return errors.Wrapf(err, " (close error: %v)", closeErr)
 				}
 				return err
 			}
 
-			log.Infof("Put blob %s(%v) to %s/%s:%s success", blobinfo.Digest, blobinfo.Size,
-				j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+			log.Info("Put blob success", j.blobFields(blobinfo.Digest, blobinfo.Size)...)
+			KnownBlobs.Record(j.Target.GetRegistry(), j.Target.GetRepository(), blobinfo.Digest)
+			j.reportBlobDone(blobinfo, false)
 		} else {
+			KnownBlobs.Record(j.Target.GetRegistry(), j.Target.GetRepository(), blobinfo.Digest)
+			j.reportBlobDone(blobinfo, true)
 			// print the log of ignored blob
-			log.Infof("Blob %s(%v) has been pushed to %s, will not be pulled", blobinfo.Digest,
-				blobinfo.Size, j.Target.GetRegistry()+"/"+j.Target.GetRepository())
+			log.Info("Blob has been pushed to target, will not be pulled", j.blobFields(blobinfo.Digest, blobinfo.Size)...)
 		}
 	}
 
+	pushType := chooseManifestType(formatManifestType(j.manifestFormat(), manifestType), supportedTypes)
+	if pushType == "" {
+		err := fmt.Errorf("manifest type %s is not supported by %s", manifestType, j.Target.GetRegistry())
+		log.Error("Put manifest error", j.LogFields(log.Err(err))...)
+		return err
+	}
+	pushManifestByte := manifestByte
+
 	//Push manifest list
-	if manifestType == manifest.DockerV2ListMediaType {
-		manifestSchemaListInfo, err := manifest.Schema2ListFromManifest(manifestByte)
+	if manifest.MIMETypeIsMultiImage(manifestType) {
+		instances, err := ListInstances(manifestByte, manifestType)
 		if err != nil {
 			return err
 		}
 
 		var subManifestByte []byte
+		var subManifestType string
+		var instanceUpdates []manifest.ListUpdate
+		// the instances change if they are converted or their layers are recompressed
+		instancesUpdated := false
 
 		// push manifest to target
-		for _, manifestDescriptorElem := range manifestSchemaListInfo.Manifests {
+		for _, manifestDescriptorElem := range instances {
+
+			log.Info("Handle manifest of platform", j.LogFields(log.String("os", manifestDescriptorElem.Platform.OS),
+				log.String("arch", manifestDescriptorElem.Platform.Architecture))...)
+
+			subManifestByte, subManifestType, err = j.Source.GetManifest(&manifestDescriptorElem.Digest)
+			if err != nil {
+				log.Error("Get manifest for manifest list error", j.LogFields(
+					log.String(log.DigestKey, manifestDescriptorElem.Digest.String()),
+					log.String("os", manifestDescriptorElem.Platform.OS),
+					log.String("arch", manifestDescriptorElem.Platform.Architecture), log.Err(err))...)
+				return err
+			}
 
-			log.Infof("handle manifest OS:%s Architecture:%s ", manifestDescriptorElem.Platform.OS,
-				manifestDescriptorElem.Platform.Architecture)
+			subPushType := chooseManifestType(formatManifestType(j.manifestFormat(), subManifestType), supportedTypes)
+			updateSubManifest, err := j.needsManifestUpdate(subManifestByte, subManifestType, subPushType)
+			if err != nil {
+				return err
+			}
+			if updateSubManifest {
+				instancesUpdated = true
+				subManifestByte, err = j.convertManifest(&manifestDescriptorElem.Digest, subPushType)
+				if err != nil {
+					return err
+				}
+			}
 
-			subManifestByte, _, err = j.Source.source.GetManifest(j.Source.ctx, &manifestDescriptorElem.Digest)
+			subManifestDigest, err := manifest.Digest(subManifestByte)
 			if err != nil {
-				log.Errorf("Get manifest %v of OS:%s Architecture:%s for manifest list error: %v",
-					manifestDescriptorElem.Digest, manifestDescriptorElem.Platform.OS,
-					manifestDescriptorElem.Platform.Architecture, err)
 				return err
 			}
 
-			if err := j.Target.PushManifest(subManifestByte); err != nil {
-				log.Errorf("Put manifest to %s/%s:%s error: %v", j.Target.GetRegistry(),
-					j.Target.GetRepository(), j.Target.GetTag(), err)
+			if err := j.Target.PushManifest(subManifestByte, &subManifestDigest); err != nil {
+				log.Error("Put manifest error", j.LogFields(log.String(log.DigestKey, subManifestDigest.String()),
+					log.Err(err))...)
 				return err
 			}
 
-			log.Infof("Put manifest to %s/%s:%s os:%s arch:%s", j.Target.GetRegistry(), j.Target.GetRepository(),
-				j.Target.GetTag(), manifestDescriptorElem.Platform.OS, manifestDescriptorElem.Platform.Architecture)
+			log.Info("Put manifest", j.LogFields(log.String(log.DigestKey, subManifestDigest.String()),
+				log.String("os", manifestDescriptorElem.Platform.OS),
+				log.String("arch", manifestDescriptorElem.Platform.Architecture))...)
 
+			instanceUpdates = append(instanceUpdates, manifest.ListUpdate{
+				Digest:    subManifestDigest,
+				Size:      int64(len(subManifestByte)),
+				MediaType: subPushType,
+			})
+		}
+
+		if pushType != manifestType || instancesUpdated {
+			pushManifestByte, err = convertManifestList(manifestByte, manifestType, pushType, instanceUpdates)
+			if err != nil {
+				log.Error("Convert manifestList error", j.LogFields(log.String("manifest_type", pushType),
+					log.Err(err))...)
+				return err
+			}
 		}
 
 		// push manifest list to target
-		if err := j.Target.PushManifest(manifestByte); err != nil {
-			log.Errorf("Put manifestList to %s/%s:%s error: %v", j.Target.GetRegistry(),
-				j.Target.GetRepository(), j.Target.GetTag(), err)
+		if err := j.Target.PushManifest(pushManifestByte, nil); err != nil {
+			log.Error("Put manifestList error", j.LogFields(log.Err(err))...)
 			return err
 		}
 
-		log.Infof("Put manifestList to %s/%s:%s", j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+		log.Info("Put manifestList", j.LogFields()...)
 
 	} else {
 
+		updateManifest, err := j.needsManifestUpdate(manifestByte, manifestType, pushType)
+		if err != nil {
+			return err
+		}
+		if updateManifest {
+			pushManifestByte, err = j.convertManifest(instanceDigest, pushType)
+			if err != nil {
+				return err
+			}
+		}
+
 		// push manifest to target
-		if err := j.Target.PushManifest(manifestByte); err != nil {
-			log.Errorf("Put manifest to %s/%s:%s error: %v", j.Target.GetRegistry(),
-				j.Target.GetRepository(), j.Target.GetTag(), err)
+		if err := j.Target.PushManifest(pushManifestByte, nil); err != nil {
+			log.Error("Put manifest error", j.LogFields(log.Err(err))...)
 			return err
 		}
 
-		log.Infof("Put manifest to %s/%s:%s", j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+		log.Info("Put manifest", j.LogFields()...)
+	}
+
+	if err := j.Target.Commit(); err != nil {
+		log.Error("Commit image error", j.LogFields(log.Err(err))...)
+		return err
 	}
 
-	log.Infof("Synchronization successfully from %s/%s:%s to %s/%s:%s", j.Source.GetRegistry(), j.Source.GetRepository(),
-		j.Source.GetTag(), j.Target.GetRegistry(), j.Target.GetRepository(), j.Target.GetTag())
+	sourceDigest, err := manifest.Digest(sourceManifestByte)
+	if err != nil {
+		return err
+	}
+	pushedDigest, err := manifest.Digest(pushManifestByte)
+	if err != nil {
+		return err
+	}
+	if pushedDigest != sourceDigest {
+		log.Info("Manifest is converted", j.LogFields(log.String("source_digest", sourceDigest.String()),
+			log.String("target_digest", pushedDigest.String()))...)
+	}
+
+	if j.Target.IsArchive() {
+		name := j.Target.GetRepository()
+		if j.Target.GetTag() != "" {
+			name = name + ":" + j.Target.GetTag()
+		}
+		recordBundleImage(j.Target.GetRegistry(), BundleImage{
+			Name:   name,
+			Source: j.SourceName(),
+			Digest: pushedDigest.String(),
+		})
+	} else if err := j.verifyManifest(pushedDigest); err != nil {
+		return err
+	}
+	j.SourceDigest = sourceDigest
+	j.TargetDigest = pushedDigest
+	j.SourceManifestType = sourceManifestType
+	j.TargetManifestType = pushType
+
+	log.Info("Synchronization successfully", j.LogFields(log.String(log.DigestKey, pushedDigest.String()))...)
 
 	return nil
 }
+
+// SourceName returns the source image, registry/repository:tag or transport:path:name of an archive
+func (j *Job) SourceName() string {
+	if j.Source.IsArchive() {
+		return j.Source.GetRegistry() + ":" + j.Source.GetRepository() + ":" + j.Source.GetTag()
+	}
+	return j.Source.GetRegistry() + "/" + j.Source.GetRepository() + ":" + j.Source.GetTag()
+}
+
+// TargetName returns the target image, registry/repository:tag or transport:path:name of an archive
+func (j *Job) TargetName() string {
+	if j.Target.IsArchive() {
+		return j.Target.GetRegistry() + ":" + j.Target.GetRepository() + ":" + j.Target.GetTag()
+	}
+	return j.Target.GetRegistry() + "/" + j.Target.GetRepository() + ":" + j.Target.GetTag()
+}
+
+// LogFields returns the fields of the log entries of the job followed by fields
+func (j *Job) LogFields(fields ...log.Field) []log.Field {
+	jobFields := make([]log.Field, 0, 3+len(fields))
+	if j.JobID != "" {
+		jobFields = append(jobFields, log.String(log.JobIDKey, j.JobID))
+	}
+	jobFields = append(jobFields, log.String(log.SourceKey, j.SourceName()), log.String(log.TargetKey, j.TargetName()))
+	return append(jobFields, fields...)
+}
+
+// blobFields returns the fields of the log entries of a blob of the job followed by fields
+func (j *Job) blobFields(blobDigest digest.Digest, size int64, fields ...log.Field) []log.Field {
+	blobFields := []log.Field{log.String(log.DigestKey, blobDigest.String()), log.Int64(log.BytesKey, size)}
+	return j.LogFields(append(blobFields, fields...)...)
+}
+
+// verifyManifest checks that the target resolves to the manifest pushed, a proxy in front of the
+// registry may have rewritten it
+func (j *Job) verifyManifest(pushedDigest digest.Digest) error {
+	targetDigest, err := j.Target.GetImageDigest()
+	if err != nil {
+		log.Error("Get manifest digest to verify error", j.LogFields(log.Err(err))...)
+		return err
+	}
+	if targetDigest != pushedDigest {
+		err := fmt.Errorf("target manifest digest %s differs from the pushed manifest digest %s", targetDigest, pushedDigest)
+		log.Error("Verify manifest error", j.LogFields(log.Err(err))...)
+		return err
+	}
+
+	log.Info("Verified manifest digest", j.LogFields(log.String(log.DigestKey, targetDigest.String()))...)
+	return nil
+}
+
+// tryMountBlob mounts the blob from another repository of the target registry which is known
+// to hold it, returns true if the blob does not need to be pulled from source any more
+func (j *Job) tryMountBlob(blobinfo types.BlobInfo) bool {
+	candidates := KnownBlobs.Candidates(j.Target.GetRegistry(), j.Target.GetRepository(), blobinfo.Digest)
+	for _, fromRepository := range candidates {
+		mounted, err := j.Target.MountABlob(blobinfo, fromRepository)
+		if err != nil {
+			log.Warn("Mount blob error", j.blobFields(blobinfo.Digest, blobinfo.Size,
+				log.String("from", j.Target.GetRegistry()+"/"+fromRepository), log.Err(err))...)
+			continue
+		}
+		if mounted {
+			log.Info("Mount blob success", j.blobFields(blobinfo.Digest, blobinfo.Size,
+				log.String("from", j.Target.GetRegistry()+"/"+fromRepository))...)
+			return true
+		}
+	}
+	return false
+}
+
+// convertManifest converts the manifest of an image instance of source to manifestType and pushes
+// the config rebuilt by the conversion, returns the converted manifest
+func (j *Job) convertManifest(instanceDigest *digest.Digest, manifestType string) ([]byte, error) {
+	converted, err := j.Source.ConvertManifest(instanceDigest, manifestType, j.Recompressed)
+	if err != nil {
+		log.Error("Convert manifest error", j.LogFields(log.String("manifest_type", manifestType), log.Err(err))...)
+		return nil, err
+	}
+	log.Info("Convert manifest", j.LogFields(log.String("manifest_type", manifestType))...)
+
+	configInfo := types.BlobInfo{
+		Digest:    converted.ConfigInfo.Digest,
+		Size:      int64(len(converted.Config)),
+		MediaType: converted.ConfigInfo.MediaType,
+	}
+	configExist, err := j.Target.CheckBlobExist(configInfo)
+	if err != nil {
+		return nil, err
+	}
+	if !configExist {
+		if err := j.Target.PutABlob(ioutil.NopCloser(bytes.NewReader(converted.Config)), configInfo); err != nil {
+			log.Error("Put config failed", j.blobFields(configInfo.Digest, configInfo.Size, log.Err(err))...)
+			return nil, err
+		}
+	}
+
+	return converted.Manifest, nil
+}
+
+// chooseInstance returns the image of the platform of the job in a manifest list
+func (j *Job) chooseInstance(manifestByte []byte, manifestType string) (imgspecv1.Descriptor, error) {
+	platform, err := ParsePlatform(j.Platform)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	instances, err := ListInstances(manifestByte, manifestType)
+	if err != nil {
+		return imgspecv1.Descriptor{}, err
+	}
+	instance, ok := ChoosePlatformInstance(instances, platform)
+	if !ok {
+		return imgspecv1.Descriptor{}, fmt.Errorf("%s can only store a single image, but the manifest list has no image of platform %s",
+			j.Target.GetRegistry(), FormatPlatform(platform))
+	}
+	return instance, nil
+}
+
+// manifestFormat returns the format the manifests are converted to, zstd layers need OCI manifests
+func (j *Job) manifestFormat() string {
+	if j.ManifestFormat == "" && j.Compression == CompressionZstd {
+		return ManifestFormatOCI
+	}
+	return j.ManifestFormat
+}
+
+// needsManifestUpdate checks if an image manifest is pushed as another manifest type or has
+// recompressed layers
+func (j *Job) needsManifestUpdate(manifestByte []byte, manifestType, pushType string) (bool, error) {
+	if pushType != manifestType {
+		return true, nil
+	}
+	if len(j.Recompressed) == 0 {
+		return false, nil
+	}
+
+	m, err := manifest.FromBlob(manifestByte, manifestType)
+	if err != nil {
+		return false, err
+	}
+	for _, layer := range m.LayerInfos() {
+		if _, exist := j.Recompressed[layer.Digest]; exist {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// convertManifestList rebuilds a manifest list to manifestType with the instances already converted
+func convertManifestList(manifestByte []byte, sourceType, manifestType string, instances []manifest.ListUpdate) ([]byte, error) {
+	list, err := manifest.ListFromBlob(manifestByte, sourceType)
+	if err != nil {
+		return nil, err
+	}
+	if err := list.UpdateInstances(instances); err != nil {
+		return nil, err
+	}
+	converted, err := list.ConvertToMIMEType(manifestType)
+	if err != nil {
+		return nil, err
+	}
+	return converted.Serialize()
+}
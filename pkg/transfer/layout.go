@@ -0,0 +1,167 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	ociarchive "github.com/containers/image/v5/oci/archive"
+	"github.com/containers/image/v5/oci/layout"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ociTransport stores images in an OCI layout directory, an image is named by the
+// org.opencontainers.image.ref.name annotation of index.json
+type ociTransport struct{}
+
+func (ociTransport) Name() string {
+	return "oci"
+}
+
+func (ociTransport) SourceReference(location, repository, tag string) (types.ImageReference, error) {
+	return layout.NewReference(location, archiveImageName(repository, tag))
+}
+
+func (ociTransport) TargetReference(location, repository, tag string) (types.ImageReference, error) {
+	name := archiveImageName(repository, tag)
+	if name == "" {
+		return nil, fmt.Errorf("image name in %s should not be empty", location)
+	}
+	if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+		return nil, err
+	}
+	return layout.NewReference(location, name)
+}
+
+func (ociTransport) RepoTags(ctx context.Context, sysctx *types.SystemContext, location, repository string) ([]string, error) {
+	indexJSON, err := ioutil.ReadFile(filepath.Join(location, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	return layoutRepoTags(indexJSON, repository)
+}
+
+func (ociTransport) ImageDigest(ctx context.Context, sysctx *types.SystemContext, ref types.ImageReference) (digest.Digest, error) {
+	return localImageDigest(ctx, sysctx, ref)
+}
+
+func (ociTransport) BundleIndexPath(location string) string {
+	return filepath.Join(location, BundleIndexFile)
+}
+
+// TargetLock returns the lock of the layout, index.json is loaded when a destination is
+// created and written back on commit
+func (ociTransport) TargetLock(location string) *sync.Mutex {
+	return getLayoutLock(location)
+}
+
+// ociArchiveTransport stores a single image in a tarball of an OCI layout
+type ociArchiveTransport struct{}
+
+func (ociArchiveTransport) Name() string {
+	return "oci-archive"
+}
+
+func (ociArchiveTransport) SourceReference(location, repository, tag string) (types.ImageReference, error) {
+	return ociarchive.NewReference(location, archiveImageName(repository, tag))
+}
+
+func (ociArchiveTransport) TargetReference(location, repository, tag string) (types.ImageReference, error) {
+	name := archiveImageName(repository, tag)
+	if name == "" {
+		return nil, fmt.Errorf("image name in %s should not be empty", location)
+	}
+	// the tarball is rewritten by every image committed to it
+	if err := claimSingleImageArchive(location, name); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+		return nil, err
+	}
+	return ociarchive.NewReference(location, name)
+}
+
+func (ociArchiveTransport) RepoTags(ctx context.Context, sysctx *types.SystemContext, location, repository string) ([]string, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("index.json not found in %s", location)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Clean(header.Name) == "index.json" {
+			indexJSON, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return nil, err
+			}
+			return layoutRepoTags(indexJSON, repository)
+		}
+	}
+}
+
+func (ociArchiveTransport) ImageDigest(ctx context.Context, sysctx *types.SystemContext, ref types.ImageReference) (digest.Digest, error) {
+	return localImageDigest(ctx, sysctx, ref)
+}
+
+func (ociArchiveTransport) BundleIndexPath(location string) string {
+	return location + BundleIndexSuffix
+}
+
+// layoutImages lists the names of all the images of an OCI layout by its index.json
+func layoutImages(indexJSON []byte) ([]string, error) {
+	index := imgspecv1.Index{}
+	if err := json.Unmarshal(indexJSON, &index); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, desc := range index.Manifests {
+		if name := desc.Annotations[imgspecv1.AnnotationRefName]; name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// layoutRepoTags gets all the tags of repository in an OCI layout by its index.json
+func layoutRepoTags(indexJSON []byte, repository string) ([]string, error) {
+	names, err := layoutImages(indexJSON)
+	if err != nil {
+		return nil, err
+	}
+	return filterRepoTags(names, repository), nil
+}
@@ -20,8 +20,11 @@ package transfer
 
 import (
 	"fmt"
+	"runtime"
+	"strings"
 
 	"github.com/containers/image/v5/manifest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // ManifestSchemaV2List describes a schema V2 manifest list
@@ -36,7 +39,7 @@ type ManifestSchemaV2Info struct {
 
 // ManifestHandler expends the ability of handling manifest list in schema2, but it's not finished yet
 // return the digest array of manifests in the manifest list if exist.
-func ManifestHandler(m []byte, t string, i *ImageSource) ([]manifest.Manifest, error) {
+func ManifestHandler(m []byte, t string, i Source) ([]manifest.Manifest, error) {
 	var manifestInfoSlice []manifest.Manifest
 
 	if t == manifest.DockerV2Schema2MediaType {
@@ -53,16 +56,23 @@ func ManifestHandler(m []byte, t string, i *ImageSource) ([]manifest.Manifest, e
 		}
 		manifestInfoSlice = append(manifestInfoSlice, manifestInfo)
 		return manifestInfoSlice, nil
-	} else if t == manifest.DockerV2ListMediaType {
+	} else if t == imgspecv1.MediaTypeImageManifest {
+		manifestInfo, err := manifest.OCI1FromManifest(m)
+		if err != nil {
+			return nil, err
+		}
+		manifestInfoSlice = append(manifestInfoSlice, manifestInfo)
+		return manifestInfoSlice, nil
+	} else if t == manifest.DockerV2ListMediaType || t == imgspecv1.MediaTypeImageIndex {
 
-		manifestSchemaListInfo, err := manifest.Schema2ListFromManifest(m)
+		instances, err := ListInstances(m, t)
 		if err != nil {
 			return nil, err
 		}
 
-		for _, manifestDescriptorElem := range manifestSchemaListInfo.Manifests {
+		for _, manifestDescriptorElem := range instances {
 
-			manifestByte, manifestType, err := i.source.GetManifest(i.ctx, &manifestDescriptorElem.Digest)
+			manifestByte, manifestType, err := i.GetManifest(&manifestDescriptorElem.Digest)
 			if err != nil {
 				return nil, err
 			}
@@ -78,3 +88,81 @@ func ManifestHandler(m []byte, t string, i *ImageSource) ([]manifest.Manifest, e
 	}
 	return nil, fmt.Errorf("unsupported manifest type: %v", t)
 }
+
+// ListInstances returns the descriptors of the images in a schema2 manifest list or an OCI index,
+// the platform of a descriptor is never nil
+func ListInstances(m []byte, t string) ([]imgspecv1.Descriptor, error) {
+	var instances []imgspecv1.Descriptor
+
+	if t == imgspecv1.MediaTypeImageIndex {
+		index, err := manifest.OCI1IndexFromManifest(m)
+		if err != nil {
+			return nil, err
+		}
+		for _, descriptor := range index.Manifests {
+			if descriptor.Platform == nil {
+				descriptor.Platform = &imgspecv1.Platform{}
+			}
+			instances = append(instances, descriptor)
+		}
+		return instances, nil
+	}
+
+	list, err := manifest.Schema2ListFromManifest(m)
+	if err != nil {
+		return nil, err
+	}
+	for _, descriptor := range list.Manifests {
+		instances = append(instances, imgspecv1.Descriptor{
+			MediaType: descriptor.MediaType,
+			Digest:    descriptor.Digest,
+			Size:      descriptor.Size,
+			Platform: &imgspecv1.Platform{
+				OS:           descriptor.Platform.OS,
+				Architecture: descriptor.Platform.Architecture,
+				Variant:      descriptor.Platform.Variant,
+			},
+		})
+	}
+	return instances, nil
+}
+
+// ParsePlatform parses a platform written as os/arch or os/arch/variant, it is the platform of the
+// host if platform is empty
+func ParsePlatform(platform string) (imgspecv1.Platform, error) {
+	if platform == "" {
+		return imgspecv1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}, nil
+	}
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return imgspecv1.Platform{}, fmt.Errorf("invalid platform %q, it should be os/arch or os/arch/variant", platform)
+	}
+	parsed := imgspecv1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		parsed.Variant = parts[2]
+	}
+	return parsed, nil
+}
+
+// FormatPlatform writes platform as os/arch or os/arch/variant
+func FormatPlatform(platform imgspecv1.Platform) string {
+	if platform.Variant == "" {
+		return platform.OS + "/" + platform.Architecture
+	}
+	return platform.OS + "/" + platform.Architecture + "/" + platform.Variant
+}
+
+// ChoosePlatformInstance returns the instance of platform in the descriptors returned by
+// ListInstances, the variant only matters if platform has one
+func ChoosePlatformInstance(instances []imgspecv1.Descriptor, platform imgspecv1.Platform) (imgspecv1.Descriptor, bool) {
+	for _, instance := range instances {
+		if instance.Platform.OS != platform.OS || instance.Platform.Architecture != platform.Architecture {
+			continue
+		}
+		if platform.Variant != "" && instance.Platform.Variant != platform.Variant {
+			continue
+		}
+		return instance, true
+	}
+	return imgspecv1.Descriptor{}, false
+}
@@ -0,0 +1,76 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// KnownBlobs records the target repositories which already hold a blob, it is
+// shared by all the jobs so that a layer pushed once can be mounted by the others
+var KnownBlobs = NewBlobLocations()
+
+// BlobLocations is a index of blob digest to the repositories of a registry
+// which already hold that blob
+type BlobLocations struct {
+	mutex     sync.RWMutex
+	locations map[string]map[digest.Digest][]string
+}
+
+// NewBlobLocations creates an empty BlobLocations
+func NewBlobLocations() *BlobLocations {
+	return &BlobLocations{
+		locations: make(map[string]map[digest.Digest][]string),
+	}
+}
+
+// Record remembers that repository of registry holds the blob
+func (b *BlobLocations) Record(registry, repository string, blobDigest digest.Digest) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	blobs, exist := b.locations[registry]
+	if !exist {
+		blobs = make(map[digest.Digest][]string)
+		b.locations[registry] = blobs
+	}
+
+	for _, repo := range blobs[blobDigest] {
+		if repo == repository {
+			return
+		}
+	}
+	blobs[blobDigest] = append(blobs[blobDigest], repository)
+}
+
+// Candidates returns the repositories of registry holding the blob, except the given repository
+func (b *BlobLocations) Candidates(registry, repository string, blobDigest digest.Digest) []string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	var candidates []string
+	for _, repo := range b.locations[registry][blobDigest] {
+		if repo != repository {
+			candidates = append(candidates, repo)
+		}
+	}
+	return candidates
+}
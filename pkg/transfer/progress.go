@@ -0,0 +1,117 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"io"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// ProgressKind is the kind of a progress event
+type ProgressKind string
+
+const (
+	// ProgressImageStarted is reported once the blobs of an image are known
+	ProgressImageStarted ProgressKind = "image-started"
+	// ProgressBlobBytes is reported as the bytes of a blob are transferred
+	ProgressBlobBytes ProgressKind = "blob-bytes"
+	// ProgressBlobDone is reported once a blob is in the target, transferred or not
+	ProgressBlobDone ProgressKind = "blob-done"
+	// ProgressImageDone is reported once an image is transferred or has failed
+	ProgressImageDone ProgressKind = "image-done"
+)
+
+// ProgressEvent is reported by a job as it transfers an image
+type ProgressEvent struct {
+	Kind ProgressKind
+	// Blobs and Size are the number and the total size of the blobs of the image started, the size of
+	// a blob is -1 if the manifest does not know it
+	Blobs int
+	Size  int64
+	// Blob is the blob of the blob events
+	Blob types.BlobInfo
+	// Bytes are the bytes of the blob read since the last event
+	Bytes int64
+	// Skipped blobs are already in the target and not transferred
+	Skipped bool
+	// Error is the error the image has failed with
+	Error error
+}
+
+// ProgressFunc receives the progress events of a job
+type ProgressFunc func(job *Job, event ProgressEvent)
+
+// report sends event to the progress func of the job, if any
+func (j *Job) report(event ProgressEvent) {
+	if j.Progress != nil {
+		j.Progress(j, event)
+	}
+}
+
+// reportImageStarted reports the blobs of the image to transfer
+func (j *Job) reportImageStarted(blobInfos []types.BlobInfo) {
+	event := ProgressEvent{Kind: ProgressImageStarted, Blobs: len(blobInfos)}
+	for _, blobinfo := range blobInfos {
+		if blobinfo.Size < 0 {
+			event.Size = -1
+			break
+		}
+		event.Size += blobinfo.Size
+	}
+	j.report(event)
+}
+
+// reportBlobDone reports that a blob is in the target
+func (j *Job) reportBlobDone(blobinfo types.BlobInfo, skipped bool) {
+	j.report(ProgressEvent{Kind: ProgressBlobDone, Blob: blobinfo, Skipped: skipped})
+}
+
+// progressReader reports the bytes of a blob read by a job
+type progressReader struct {
+	reader io.ReadCloser
+	job    *Job
+	digest digest.Digest
+	size   int64
+}
+
+// newProgressReader reports the bytes read from blob, it is blob itself if nobody receives the progress
+func (j *Job) newProgressReader(blob io.ReadCloser, blobinfo types.BlobInfo) io.ReadCloser {
+	if j.Progress == nil {
+		return blob
+	}
+	return &progressReader{reader: blob, job: j, digest: blobinfo.Digest, size: blobinfo.Size}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.job.report(ProgressEvent{
+			Kind:  ProgressBlobBytes,
+			Blob:  types.BlobInfo{Digest: r.digest, Size: r.size},
+			Bytes: int64(n),
+		})
+	}
+	return n, err
+}
+
+func (r *progressReader) Close() error {
+	return r.reader.Close()
+}
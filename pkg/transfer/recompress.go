@@ -0,0 +1,193 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+const (
+	// CompressionGzip recompresses layers with gzip
+	CompressionGzip = "gzip"
+	// CompressionZstd recompresses layers with zstd, the manifests are converted to OCI for it
+	CompressionZstd = "zstd"
+)
+
+// RecompressedLayers records the layers already recompressed, it is shared by all the jobs so that
+// a layer is recompressed only once even if it is pushed to several repositories
+var RecompressedLayers = &recompressedLayers{
+	layers: make(map[string]RecompressedLayer),
+}
+
+// RecompressedLayer is a source layer recompressed to another compression
+type RecompressedLayer struct {
+	SourceDigest digest.Digest
+	SourceSize   int64
+	Digest       digest.Digest
+	Size         int64
+	// DiffID is the digest of the uncompressed layer, which recompression does not change
+	DiffID      digest.Digest
+	Compression string
+}
+
+type recompressedLayers struct {
+	mutex  sync.RWMutex
+	layers map[string]RecompressedLayer
+}
+
+// Get returns the layer sourceDigest is recompressed to with compression
+func (r *recompressedLayers) Get(compression string, sourceDigest digest.Digest) (RecompressedLayer, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	layer, exist := r.layers[compression+"@"+sourceDigest.String()]
+	return layer, exist
+}
+
+// Record remembers a recompressed layer
+func (r *recompressedLayers) Record(layer RecompressedLayer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.layers[layer.Compression+"@"+layer.SourceDigest.String()] = layer
+}
+
+// layerCompression returns the compression of a layer of mediaType, false if it is not a layer which
+// can be recompressed, the layers of a schema1 manifest have no media type and are gzipped
+func layerCompression(mediaType string) (string, bool) {
+	switch mediaType {
+	case "", manifest.DockerV2Schema2LayerMediaType, imgspecv1.MediaTypeImageLayerGzip:
+		return CompressionGzip, true
+	case imgspecv1.MediaTypeImageLayerZstd:
+		return CompressionZstd, true
+	case manifest.DockerV2SchemaLayerMediaTypeUncompressed, imgspecv1.MediaTypeImageLayer:
+		return "", true
+	default:
+		return "", false
+	}
+}
+
+// needsRecompression checks if a blob is a layer which is not compressed with the compression of the job
+func (j *Job) needsRecompression(blobinfo types.BlobInfo) bool {
+	if j.Compression == "" {
+		return false
+	}
+	layerCompression, ok := layerCompression(blobinfo.MediaType)
+	return ok && layerCompression != j.Compression
+}
+
+// recompressLayer pushes a layer of source recompressed with the compression of the job to target,
+// a layer recompressed by another job is reused if the target holds it or can mount it
+func (j *Job) recompressLayer(blobinfo types.BlobInfo) (RecompressedLayer, error) {
+	if layer, exist := RecompressedLayers.Get(j.Compression, blobinfo.Digest); exist {
+		recompressedInfo := types.BlobInfo{Digest: layer.Digest, Size: layer.Size}
+		blobExist, err := j.Target.CheckBlobExist(recompressedInfo)
+		if err != nil {
+			return RecompressedLayer{}, err
+		}
+		if blobExist || j.tryMountBlob(recompressedInfo) {
+			log.Info("Recompressed layer has been pushed to target", j.blobFields(blobinfo.Digest, blobinfo.Size,
+				log.String("compression", j.Compression), log.String("recompressed_digest", layer.Digest.String()),
+				log.Int64("recompressed_bytes", layer.Size))...)
+			KnownBlobs.Record(j.Target.GetRegistry(), j.Target.GetRepository(), layer.Digest)
+			j.reportBlobDone(blobinfo, true)
+			return layer, nil
+		}
+	}
+
+	algorithm, err := compression.AlgorithmByName(j.Compression)
+	if err != nil {
+		return RecompressedLayer{}, err
+	}
+
+	log.Info("Getting blob", j.blobFields(blobinfo.Digest, blobinfo.Size)...)
+	blob, _, err := j.Source.GetABlob(blobinfo)
+	if err != nil {
+		return RecompressedLayer{}, fmt.Errorf("get blob %s error: %v", blobinfo.Digest, err)
+	}
+	verifiedBlob, err := NewVerifyingReader(blob, blobinfo)
+	if err != nil {
+		blob.Close()
+		return RecompressedLayer{}, err
+	}
+	source := &countingReader{reader: j.newProgressReader(verifiedBlob, blobinfo)}
+	diffID := digest.Canonical.Digester()
+
+	// the layer is decompressed and compressed again as it is uploaded
+	reader, writer := io.Pipe()
+	go func() {
+		defer verifiedBlob.Close()
+		writer.CloseWithError(recompress(writer, source, diffID.Hash(), algorithm))
+	}()
+
+	log.Info("Putting recompressed blob", j.blobFields(blobinfo.Digest, blobinfo.Size,
+		log.String("compression", j.Compression))...)
+	pushed, err := j.Target.PushABlob(reader)
+	if err != nil {
+		return RecompressedLayer{}, fmt.Errorf("put blob %s recompressed with %s error: %v", blobinfo.Digest, j.Compression, err)
+	}
+
+	layer := RecompressedLayer{
+		SourceDigest: blobinfo.Digest,
+		SourceSize:   source.size,
+		Digest:       pushed.Digest,
+		Size:         pushed.Size,
+		DiffID:       diffID.Digest(),
+		Compression:  j.Compression,
+	}
+	RecompressedLayers.Record(layer)
+	KnownBlobs.Record(j.Target.GetRegistry(), j.Target.GetRepository(), layer.Digest)
+	j.reportBlobDone(blobinfo, false)
+	log.Info("Put recompressed blob success", j.blobFields(layer.SourceDigest, layer.SourceSize,
+		log.String("compression", j.Compression), log.String("recompressed_digest", layer.Digest.String()),
+		log.Int64("recompressed_bytes", layer.Size))...)
+	return layer, nil
+}
+
+// recompress writes source compressed with algorithm to dest, and the uncompressed source to diffID
+func recompress(dest io.Writer, source io.Reader, diffID io.Writer, algorithm compression.Algorithm) error {
+	uncompressed, _, err := compression.AutoDecompress(source)
+	if err != nil {
+		return err
+	}
+	defer uncompressed.Close()
+
+	compressor, err := compression.CompressStream(dest, algorithm, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(compressor, io.TeeReader(uncompressed, diffID)); err != nil {
+		compressor.Close()
+		return err
+	}
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+	// the source is verified only once it is read to its end
+	_, err = io.Copy(ioutil.Discard, source)
+	return err
+}
@@ -0,0 +1,241 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestRecompress(t *testing.T) {
+	tests := []struct {
+		name   string
+		source compression.Algorithm
+		target compression.Algorithm
+	}{
+		{name: "gzip to zstd", source: compression.Gzip, target: compression.Zstd},
+		{name: "zstd to gzip", source: compression.Zstd, target: compression.Gzip},
+		{name: "gzip to gzip", source: compression.Gzip, target: compression.Gzip},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layer := newTestLayer(t, strings.Repeat("layer content ", 1000), test.source)
+			source, err := NewVerifyingReader(ioutil.NopCloser(bytes.NewReader(layer.blob)),
+				types.BlobInfo{Digest: layer.digest, Size: int64(len(layer.blob))})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var recompressed bytes.Buffer
+			diffID := digest.Canonical.Digester()
+			if err := recompress(&recompressed, source, diffID.Hash(), test.target); err != nil {
+				t.Fatal(err)
+			}
+
+			// recompression changes the blob but not its content
+			if diffID.Digest() != layer.diffID {
+				t.Errorf("diffID %s, want %s", diffID.Digest(), layer.diffID)
+			}
+			algorithm, decompressor, reader, err := compression.DetectCompressionFormat(bytes.NewReader(recompressed.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decompressor == nil || algorithm.Name() != test.target.Name() {
+				t.Fatalf("recompressed blob is compressed with %q, want %s", algorithm.Name(), test.target.Name())
+			}
+			uncompressed, err := decompressor(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer uncompressed.Close()
+			if got, err := digest.Canonical.FromReader(uncompressed); err != nil || got != layer.diffID {
+				t.Errorf("recompressed blob is %s uncompressed, want %s: %v", got, layer.diffID, err)
+			}
+		})
+	}
+}
+
+func TestRecompressCorruptSource(t *testing.T) {
+	layer := newTestLayer(t, "layer content", compression.Gzip)
+	// a blob with trailing garbage decompresses fine but does not match its digest
+	blob := append(append([]byte{}, layer.blob...), "garbage"...)
+	source, err := NewVerifyingReader(ioutil.NopCloser(bytes.NewReader(blob)), types.BlobInfo{Digest: layer.digest, Size: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := recompress(ioutil.Discard, source, ioutil.Discard, compression.Zstd); err == nil || !strings.Contains(err.Error(), "is corrupt") {
+		t.Errorf("got error %v, want a corrupt blob", err)
+	}
+}
+
+// recompressedTestLayer recompresses layer with algorithm like Job.recompressLayer
+func recompressedTestLayer(t *testing.T, layer testLayer, algorithm compression.Algorithm) RecompressedLayer {
+	var recompressed bytes.Buffer
+	diffID := digest.Canonical.Digester()
+	if err := recompress(&recompressed, bytes.NewReader(layer.blob), diffID.Hash(), algorithm); err != nil {
+		t.Fatal(err)
+	}
+	return RecompressedLayer{
+		SourceDigest: layer.digest,
+		SourceSize:   int64(len(layer.blob)),
+		Digest:       digest.FromBytes(recompressed.Bytes()),
+		Size:         int64(recompressed.Len()),
+		DiffID:       diffID.Digest(),
+		Compression:  algorithm.Name(),
+	}
+}
+
+func TestConvertRecompressedLayers(t *testing.T) {
+	gzipLayers := []testLayer{newTestLayer(t, "base", compression.Gzip), newTestLayer(t, "app", compression.Gzip)}
+	schema2Manifest, schema2Config := schema2Image(t, gzipLayers...)
+	zstdLayer := recompressedTestLayer(t, gzipLayers[1], compression.Zstd)
+
+	// an OCI image with a zstd layer is converted to schema2 with the layer recompressed to gzip
+	zstdSource := newTestLayer(t, "zstd app", compression.Zstd)
+	ociConfig := mustMarshal(t, imgspecv1.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       imgspecv1.RootFS{Type: "layers", DiffIDs: []digest.Digest{gzipLayers[0].diffID, zstdSource.diffID}},
+	})
+	ociManifest, err := manifest.OCI1FromComponents(imgspecv1.Descriptor{
+		MediaType: imgspecv1.MediaTypeImageConfig, Digest: digest.FromBytes(ociConfig), Size: int64(len(ociConfig)),
+	}, []imgspecv1.Descriptor{
+		{MediaType: imgspecv1.MediaTypeImageLayerGzip, Digest: gzipLayers[0].digest, Size: int64(len(gzipLayers[0].blob))},
+		{MediaType: imgspecv1.MediaTypeImageLayerZstd, Digest: zstdSource.digest, Size: int64(len(zstdSource.blob))},
+	}).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipLayer := recompressedTestLayer(t, zstdSource, compression.Gzip)
+
+	tests := []struct {
+		name         string
+		source       *ImageSource
+		manifestType string
+		recompressed RecompressedLayer
+		want         []imgspecv1.Descriptor
+		wantErr      string
+	}{
+		{
+			name:         "gzip to zstd",
+			source:       openDirImage(t, schema2Manifest, schema2Config, gzipLayers[0].blob, gzipLayers[1].blob),
+			manifestType: imgspecv1.MediaTypeImageManifest,
+			recompressed: zstdLayer,
+			want: []imgspecv1.Descriptor{
+				{MediaType: imgspecv1.MediaTypeImageLayerGzip, Digest: gzipLayers[0].digest, Size: int64(len(gzipLayers[0].blob))},
+				{MediaType: imgspecv1.MediaTypeImageLayerZstd, Digest: zstdLayer.Digest, Size: zstdLayer.Size},
+			},
+		},
+		{
+			name:         "wrong diffID",
+			source:       openDirImage(t, schema2Manifest, schema2Config, gzipLayers[0].blob, gzipLayers[1].blob),
+			manifestType: imgspecv1.MediaTypeImageManifest,
+			recompressed: func() RecompressedLayer {
+				layer := zstdLayer
+				layer.DiffID = digest.FromString("other")
+				return layer
+			}(),
+			wantErr: "but the config records diffID " + gzipLayers[1].diffID.String(),
+		},
+		{
+			name:         "zstd to gzip",
+			source:       openDirImage(t, ociManifest, ociConfig, gzipLayers[0].blob, zstdSource.blob),
+			manifestType: manifest.DockerV2Schema2MediaType,
+			recompressed: gzipLayer,
+			want: []imgspecv1.Descriptor{
+				{MediaType: manifest.DockerV2Schema2LayerMediaType, Digest: gzipLayers[0].digest, Size: int64(len(gzipLayers[0].blob))},
+				{MediaType: manifest.DockerV2Schema2LayerMediaType, Digest: gzipLayer.Digest, Size: gzipLayer.Size},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			converted, err := test.source.ConvertManifest(nil, test.manifestType,
+				map[digest.Digest]RecompressedLayer{test.recompressed.SourceDigest: test.recompressed})
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := manifest.FromBlob(converted.Manifest, test.manifestType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var layers []imgspecv1.Descriptor
+			for _, layer := range m.LayerInfos() {
+				layers = append(layers, imgspecv1.Descriptor{MediaType: layer.MediaType, Digest: layer.Digest, Size: layer.Size})
+			}
+			if !reflect.DeepEqual(layers, test.want) {
+				t.Errorf("layers %+v, want %+v", layers, test.want)
+			}
+			checkConfigDescriptor(t, converted, imgspecv1.Descriptor{Digest: m.ConfigInfo().Digest, Size: m.ConfigInfo().Size})
+
+			// the layers are the same once uncompressed, the config keeps their diffIDs
+			config := imgspecv1.Image{}
+			if err := json.Unmarshal(converted.Config, &config); err != nil {
+				t.Fatal(err)
+			}
+			if len(config.RootFS.DiffIDs) != 2 || config.RootFS.DiffIDs[1] != test.recompressed.DiffID {
+				t.Errorf("diffIDs %v, want %s of the recompressed layer", config.RootFS.DiffIDs, test.recompressed.DiffID)
+			}
+		})
+	}
+}
+
+func TestNeedsRecompression(t *testing.T) {
+	job := &Job{Compression: CompressionZstd}
+	tests := []struct {
+		mediaType string
+		want      bool
+	}{
+		// the layers of schema1 have no media type and are gzipped
+		{"", true},
+		{manifest.DockerV2Schema2LayerMediaType, true},
+		{imgspecv1.MediaTypeImageLayerGzip, true},
+		{imgspecv1.MediaTypeImageLayer, true},
+		{imgspecv1.MediaTypeImageLayerZstd, false},
+		{manifest.DockerV2Schema2ForeignLayerMediaType, false},
+		{manifest.DockerV2Schema2ConfigMediaType, false},
+	}
+	for _, test := range tests {
+		if got := job.needsRecompression(types.BlobInfo{MediaType: test.mediaType}); got != test.want {
+			t.Errorf("needsRecompression(%q) = %v, want %v", test.mediaType, got, test.want)
+		}
+	}
+	if (&Job{}).needsRecompression(types.BlobInfo{MediaType: manifest.DockerV2Schema2LayerMediaType}) {
+		t.Error("layer recompressed without a compression of the job")
+	}
+}
@@ -26,37 +26,52 @@ import (
 
 	"io"
 
-	"github.com/containers/image/v5/docker"
 	"github.com/containers/image/v5/types"
 	"tkestack.io/image-transfer/pkg/utils"
 )
 
+// Source is an image a Job reads, a new backend only needs to implement it
+type Source interface {
+	// GetManifest returns the manifest and its type, of the image itself if instanceDigest is nil
+	// and of an image of its manifest list otherwise
+	GetManifest(instanceDigest *digest.Digest) ([]byte, string, error)
+	// GetBlobInfos returns the layers and configs referred by a manifest and the images of a list
+	GetBlobInfos(manifestByte []byte, manifestType string) ([]types.BlobInfo, error)
+	// GetABlob returns the content of a blob and its size
+	GetABlob(blobInfo types.BlobInfo) (io.ReadCloser, int64, error)
+	// ConvertManifest converts the manifest of an image instance to manifestType
+	ConvertManifest(instanceDigest *digest.Digest, manifestType string,
+		recompressed map[digest.Digest]RecompressedLayer) (*ConvertedManifest, error)
+	GetImageDigest() (digest.Digest, error)
+	GetRegistry() string
+	GetRepository() string
+	GetTag() string
+	IsArchive() bool
+	Close() error
+}
+
 // ImageSource is a reference to a remote image need to be pulled.
 type ImageSource struct {
 	registry   string
 	repository string
 	tag        string
+	transport  Transport
+	location   string
 	sourceRef  types.ImageReference
 	source     types.ImageSource
 	ctx        context.Context
 	sysctx     *types.SystemContext
 }
 
+var _ Source = &ImageSource{}
+
 // NewImageSource generates a PullJob by repository, the repository string must include "tag",
 // if username or password is empty, access to repository will be anonymous.
 // a repository string is the rest part of the images url except "tag" and "registry"
+// The registry can also be an archive location like oci:/path/dir or docker-archive:/path/file.tar,
+// the image named repository:tag inside it is read by the transport of the location then.
 func NewImageSource(registry, repository, tag, username, password string, insecure bool) (*ImageSource, error) {
-	if utils.CheckIfIncludeTag(repository) {
-		return nil, fmt.Errorf("repository string should not include tag")
-	}
-
-	// tag may be empty
-	tagWithColon := ""
-	if tag != "" {
-		tagWithColon = ":" + tag
-	}
-
-	srcRef, err := docker.ParseReference("//" + registry + "/" + repository + tagWithColon)
+	transport, location, err := LookupTransport(registry)
 	if err != nil {
 		return nil, err
 	}
@@ -81,9 +96,14 @@ func NewImageSource(registry, repository, tag, username, password string, insecu
 		}
 	}
 
+	var srcRef types.ImageReference
 	var rawSource types.ImageSource
 	if tag != "" {
-		// if tag is empty, will attach to the "latest" tag, and will get a error if "latest" is not exist
+		// without a tag only the tags of repository can be listed
+		srcRef, err = transport.SourceReference(location, repository, tag)
+		if err != nil {
+			return nil, err
+		}
 		rawSource, err = srcRef.NewImageSource(ctx, sysctx)
 		if err != nil {
 			return nil, err
@@ -91,6 +111,8 @@ func NewImageSource(registry, repository, tag, username, password string, insecu
 	}
 
 	return &ImageSource{
+		transport:  transport,
+		location:   location,
 		sourceRef:  srcRef,
 		source:     rawSource,
 		ctx:        ctx,
@@ -101,12 +123,12 @@ func NewImageSource(registry, repository, tag, username, password string, insecu
 	}, nil
 }
 
-// GetManifest get manifest file from source image
-func (i *ImageSource) GetManifest() ([]byte, string, error) {
+// GetManifest get manifest file from source image, or of the image instanceDigest of its manifest list
+func (i *ImageSource) GetManifest(instanceDigest *digest.Digest) ([]byte, string, error) {
 	if i.source == nil {
 		return nil, "", fmt.Errorf("can not get manifest file without specfied a tag")
 	}
-	return i.source.GetManifest(i.ctx, nil)
+	return i.source.GetManifest(i.ctx, instanceDigest)
 }
 
 // GetBlobInfos get blobs from source image.
@@ -141,11 +163,17 @@ func (i *ImageSource) GetBlobInfos(manifestByte []byte, manifestType string) ([]
 
 // GetABlob gets a blob from remote image
 func (i *ImageSource) GetABlob(blobInfo types.BlobInfo) (io.ReadCloser, int64, error) {
+	if i.source == nil {
+		return nil, 0, fmt.Errorf("can not get blob without specfied a tag")
+	}
 	return i.source.GetBlob(i.ctx, types.BlobInfo{Digest: blobInfo.Digest, Size: -1}, NoCache)
 }
 
-// Close an ImageSource
+// Close an ImageSource, a source without tag has nothing to close
 func (i *ImageSource) Close() error {
+	if i.source == nil {
+		return nil
+	}
 	return i.source.Close()
 }
 
@@ -166,10 +194,27 @@ func (i *ImageSource) GetTag() string {
 
 // GetSourceRepoTags gets all the tags of a repository which ImageSource belongs to
 func (i *ImageSource) GetSourceRepoTags() ([]string, error) {
-	return docker.GetRepositoryTags(i.ctx, i.sysctx, i.sourceRef)
+	return i.transport.RepoTags(i.ctx, i.sysctx, i.location, i.repository)
 }
 
 // GetImageDigest checks if a tag exist for target, return target tag of digest
 func (i *ImageSource) GetImageDigest() (digest.Digest, error) {
-	return docker.GetDigest(i.ctx, i.sysctx, i.sourceRef)
+	if i.sourceRef == nil {
+		return "", fmt.Errorf("can not get image digest without specfied a tag")
+	}
+	return i.transport.ImageDigest(i.ctx, i.sysctx, i.sourceRef)
+}
+
+// DeleteManifest deletes the manifest with manifestDigest from the repository of ImageSource through
+// the registry API, every tag referring to the manifest is deleted along with it
+func (i *ImageSource) DeleteManifest(manifestDigest digest.Digest) error {
+	if i.IsArchive() {
+		return fmt.Errorf("delete image of archive %s is not supported", i.registry)
+	}
+	return deleteManifest(i.ctx, i.sysctx, i.registry, i.repository, manifestDigest)
+}
+
+// IsArchive checks if the source is an OCI layout or a docker-archive
+func (i *ImageSource) IsArchive() bool {
+	return utils.IsArchiveURL(i.registry)
 }
@@ -0,0 +1,44 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"testing"
+
+	"github.com/containers/image/v5/types"
+)
+
+func TestImageSourceWithoutTag(t *testing.T) {
+	source, err := NewImageSource("127.0.0.1:5000", "library/nginx", "", "", "", true)
+	if err != nil {
+		t.Fatalf("NewImageSource() error = %v", err)
+	}
+	if err := source.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if _, _, err := source.GetABlob(types.BlobInfo{Digest: "sha256:0000"}); err == nil {
+		t.Error("GetABlob() error = nil, want an error without tag")
+	}
+	if _, _, err := source.GetManifest(nil); err == nil {
+		t.Error("GetManifest() error = nil, want an error without tag")
+	}
+	if _, err := source.ConvertManifest(nil, "", nil); err == nil {
+		t.Error("ConvertManifest() error = nil, want an error without tag")
+	}
+}
@@ -22,40 +22,70 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/opencontainers/go-digest"
 
-	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/pkg/blobinfocache/memory"
 	"github.com/containers/image/v5/types"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"tkestack.io/image-transfer/pkg/utils"
 )
 
+// Target is an image a Job writes, a new backend only needs to implement it
+type Target interface {
+	// PushManifest stores a manifest, instanceDigest is set for an image of a manifest list
+	PushManifest(manifestByte []byte, instanceDigest *digest.Digest) error
+	// Commit marks the image is completely stored
+	Commit() error
+	// PutABlob stores a blob of a known digest
+	PutABlob(blob io.ReadCloser, blobInfo types.BlobInfo) error
+	// PushABlob stores a blob whose digest is only known once it is stored
+	PushABlob(blob io.ReadCloser) (types.BlobInfo, error)
+	CheckBlobExist(blobInfo types.BlobInfo) (bool, error)
+	// MountABlob reuses a blob of another repository of the same registry
+	MountABlob(blobInfo types.BlobInfo, fromRepository string) (bool, error)
+	// SupportedManifestTypes returns the manifest types accepted, nil means any type
+	SupportedManifestTypes() []string
+	GetImageDigest() (digest.Digest, error)
+	GetRegistry() string
+	GetRepository() string
+	GetTag() string
+	IsArchive() bool
+	Close() error
+}
+
 // ImageTarget is a reference of a remote image we will push to
 type ImageTarget struct {
 	registry   string
 	repository string
 	tag        string
+	transport  Transport
+	location   string
 	targetRef  types.ImageReference
 	target     types.ImageDestination
 	ctx        context.Context
 	sysctx     *types.SystemContext
+	// targetLock is set if target shares a file rewritten by every image with other jobs
+	targetLock *sync.Mutex
 }
 
+var _ Target = &ImageTarget{}
+
 // NewImageTarget generates a ImageTarget by repository, the repository string must include "tag".
 // If username or password is empty, access to repository will be anonymous.
+// The registry can also be an archive location like oci:/path/dir or docker-archive:/path/file.tar,
+// the image is then stored in it with the name repository:tag by the transport of the location.
 func NewImageTarget(registry, repository, tag, username, password string, insecure bool) (*ImageTarget, error) {
-	if utils.CheckIfIncludeTag(repository) {
-		return nil, fmt.Errorf("repository string should not include tag")
-	}
-
-	// tag may be empty
-	tagWithColon := ""
-	if tag != "" {
-		tagWithColon = ":" + tag
+	transport, location, err := LookupTransport(registry)
+	if err != nil {
+		return nil, err
 	}
 
 	// if tag is empty, will attach to the "latest" tag
-	destRef, err := docker.ParseReference("//" + registry + "/" + repository + tagWithColon)
+	destRef, err := transport.TargetReference(location, repository, tag)
 	if err != nil {
 		return nil, err
 	}
@@ -85,7 +115,14 @@ func NewImageTarget(registry, repository, tag, username, password string, insecu
 		return nil, err
 	}
 
+	var targetLock *sync.Mutex
+	if locked, ok := transport.(lockedTransport); ok {
+		targetLock = locked.TargetLock(location)
+	}
+
 	return &ImageTarget{
+		transport:  transport,
+		location:   location,
 		targetRef:  destRef,
 		target:     rawtarget,
 		ctx:        ctx,
@@ -93,12 +130,46 @@ func NewImageTarget(registry, repository, tag, username, password string, insecu
 		registry:   registry,
 		repository: repository,
 		tag:        tag,
+		targetLock: targetLock,
 	}, nil
 }
 
-// PushManifest push a manifest file to target image
-func (i *ImageTarget) PushManifest(manifestByte []byte) error {
-	return i.target.PutManifest(i.ctx, manifestByte, nil)
+// PushManifest push a manifest file to target image, instanceDigest is set for an image of a manifest
+// list and nil for the top level manifest
+func (i *ImageTarget) PushManifest(manifestByte []byte, instanceDigest *digest.Digest) error {
+	if i.targetLock == nil {
+		return i.target.PutManifest(i.ctx, manifestByte, instanceDigest)
+	}
+
+	// a shared file like index.json of an OCI layout is loaded when a destination is created and
+	// written back on commit, reload it under lock so that jobs sharing it keep each other's images
+	i.targetLock.Lock()
+	defer i.targetLock.Unlock()
+
+	dest, err := i.targetRef.NewImageDestination(i.ctx, i.sysctx)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	if err := dest.PutManifest(i.ctx, manifestByte, instanceDigest); err != nil {
+		return err
+	}
+	return dest.Commit(i.ctx, nil)
+}
+
+// Commit marks the image is completely stored, it is required by archive targets
+func (i *ImageTarget) Commit() error {
+	if i.targetLock != nil {
+		// already committed with the manifest
+		return nil
+	}
+	return i.target.Commit(i.ctx, nil)
+}
+
+// IsArchive checks if the target is an OCI layout or a docker-archive
+func (i *ImageTarget) IsArchive() bool {
+	return utils.IsArchiveURL(i.registry)
 }
 
 // PutABlob push a blob to target image
@@ -106,7 +177,7 @@ func (i *ImageTarget) PutABlob(blob io.ReadCloser, blobInfo types.BlobInfo) erro
 	_, err := i.target.PutBlob(i.ctx, blob, types.BlobInfo{
 		Digest: blobInfo.Digest,
 		Size:   blobInfo.Size,
-	}, Memory, true)
+	}, Memory, isConfigBlob(blobInfo))
 
 	// io.ReadCloser need to be close
 	defer blob.Close()
@@ -114,6 +185,17 @@ func (i *ImageTarget) PutABlob(blob io.ReadCloser, blobInfo types.BlobInfo) erro
 	return err
 }
 
+// PushABlob uploads a blob whose digest is not known yet, returns the digest and size of the blob uploaded
+func (i *ImageTarget) PushABlob(blob io.ReadCloser) (types.BlobInfo, error) {
+	defer blob.Close()
+
+	pushed, err := i.target.PutBlob(i.ctx, blob, types.BlobInfo{Size: -1}, Memory, false)
+	if err != nil {
+		return types.BlobInfo{}, err
+	}
+	return types.BlobInfo{Digest: pushed.Digest, Size: pushed.Size}, nil
+}
+
 // CheckBlobExist checks if a blob exist for target and reuse exist blobs
 func (i *ImageTarget) CheckBlobExist(blobInfo types.BlobInfo) (bool, error) {
 	exist, _, err := i.target.TryReusingBlob(i.ctx, types.BlobInfo{
@@ -124,8 +206,33 @@ func (i *ImageTarget) CheckBlobExist(blobInfo types.BlobInfo) (bool, error) {
 	return exist, err
 }
 
+// MountABlob tries a cross-repository mount of a blob which already exists in fromRepository
+// of the same registry, returns false if the registry refused to mount it
+func (i *ImageTarget) MountABlob(blobInfo types.BlobInfo, fromRepository string) (bool, error) {
+	if i.IsArchive() {
+		return false, nil
+	}
+	dockerRef := i.targetRef.DockerReference()
+
+	// a private cache with the only known location, the docker transport will
+	// mount the blob from there instead of uploading it
+	cache := memory.New()
+	cache.RecordKnownLocation(i.targetRef.Transport(), types.BICTransportScope{Opaque: reference.Domain(dockerRef)},
+		blobInfo.Digest, types.BICLocationReference{Opaque: reference.Domain(dockerRef) + "/" + fromRepository})
+
+	mounted, _, err := i.target.TryReusingBlob(i.ctx, types.BlobInfo{
+		Digest: blobInfo.Digest,
+		Size:   blobInfo.Size,
+	}, cache, false)
+
+	return mounted, err
+}
+
 // Close a ImageTarget
 func (i *ImageTarget) Close() error {
+	if i.target == nil {
+		return nil
+	}
 	return i.target.Close()
 }
 
@@ -146,14 +253,35 @@ func (i *ImageTarget) GetTag() string {
 
 // GetImageDigest checks if a tag exist for target, return target tag of digest
 func (i *ImageTarget) GetImageDigest() (digest.Digest, error) {
-	return docker.GetDigest(i.ctx, i.sysctx, i.targetRef)
+	if i.IsArchive() {
+		return "", fmt.Errorf("get image digest of archive %s is not supported", i.registry)
+	}
+	return i.transport.ImageDigest(i.ctx, i.sysctx, i.targetRef)
 }
 
 // GetTargetRepoTags gets all the tags of a repository which ImageTarget belongs to
 func (i *ImageTarget) GetTargetRepoTags() ([]string, error) {
-	tags, err := docker.GetRepositoryTags(i.ctx, i.sysctx, i.targetRef)
+	if i.IsArchive() {
+		return nil, fmt.Errorf("list tags of archive %s is not supported", i.registry)
+	}
+	tags, err := i.transport.RepoTags(i.ctx, i.sysctx, i.location, i.repository)
 	if err != nil && utils.IsTagsNotFound(err) {
 		return nil, nil
 	}
 	return tags, err
 }
+
+// DeleteManifest deletes the manifest with manifestDigest from the repository of ImageTarget through
+// the registry API, every tag referring to the manifest is deleted along with it
+func (i *ImageTarget) DeleteManifest(manifestDigest digest.Digest) error {
+	if i.IsArchive() {
+		return fmt.Errorf("delete image of archive %s is not supported", i.registry)
+	}
+	return deleteManifest(i.ctx, i.sysctx, i.registry, i.repository, manifestDigest)
+}
+
+// isConfigBlob checks if a blob is the config of an image by its media type
+func isConfigBlob(blobInfo types.BlobInfo) bool {
+	return blobInfo.MediaType == manifest.DockerV2Schema2ConfigMediaType ||
+		blobInfo.MediaType == imgspecv1.MediaTypeImageConfig
+}
@@ -0,0 +1,165 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+	"tkestack.io/image-transfer/pkg/utils"
+)
+
+// Transport is a kind of image store an ImageSource reads from or an ImageTarget writes to,
+// it is selected by the scheme of the image url, e.g. oci:/path/dir:name is stored by the "oci"
+// transport and an url without a scheme is an image of a registry.
+// For a registry the location is the registry domain, for the others it is the path of the store.
+type Transport interface {
+	// Name returns the url scheme of the transport without ":"
+	Name() string
+	// SourceReference returns the reference of the image repository:tag to read from location
+	SourceReference(location, repository, tag string) (types.ImageReference, error)
+	// TargetReference returns the reference of the image repository:tag to write to location
+	TargetReference(location, repository, tag string) (types.ImageReference, error)
+	// RepoTags lists all the tags of repository stored at location
+	RepoTags(ctx context.Context, sysctx *types.SystemContext, location, repository string) ([]string, error)
+	// ImageDigest returns the manifest digest of the image referred by ref
+	ImageDigest(ctx context.Context, sysctx *types.SystemContext, ref types.ImageReference) (digest.Digest, error)
+	// BundleIndexPath returns the path of the bundle index describing the images stored at
+	// location, it is empty for a registry
+	BundleIndexPath(location string) string
+}
+
+// lockedTransport is implemented by the transports whose images at the same location share a file
+// which is rewritten by every image, the manifest of a target is then pushed under the returned lock
+type lockedTransport interface {
+	TargetLock(location string) *sync.Mutex
+}
+
+var (
+	transportsMutex sync.RWMutex
+	transports      = make(map[string]Transport)
+	// DockerTransport is the transport of images in a registry, it is used for the urls without a scheme
+	DockerTransport Transport = dockerTransport{}
+)
+
+func init() {
+	RegisterTransport(DockerTransport)
+	RegisterTransport(ociTransport{})
+	RegisterTransport(ociArchiveTransport{})
+	RegisterTransport(dockerArchiveTransport{})
+	RegisterTransport(dirTransport{})
+}
+
+// RegisterTransport makes the images urls with the scheme of transport stored by it
+func RegisterTransport(transport Transport) {
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+
+	transports[transport.Name()] = transport
+	if transport != DockerTransport {
+		utils.RegisterArchiveScheme(transport.Name())
+	}
+}
+
+// GetTransport returns the transport registered with name
+func GetTransport(name string) (Transport, error) {
+	transportsMutex.RLock()
+	defer transportsMutex.RUnlock()
+
+	transport, exist := transports[name]
+	if !exist {
+		return nil, fmt.Errorf("unknown transport %q", name)
+	}
+	return transport, nil
+}
+
+// LookupTransport returns the transport storing the images of registry and the location
+// of the images inside the transport, registry can be a domain or an archive location
+func LookupTransport(registry string) (Transport, string, error) {
+	if !utils.IsArchiveURL(registry) {
+		return DockerTransport, registry, nil
+	}
+
+	scheme, location := utils.SplitArchiveLocation(registry)
+	transport, err := GetTransport(scheme)
+	if err != nil {
+		return nil, "", err
+	}
+	return transport, location, nil
+}
+
+// dockerTransport stores images in a docker registry V2
+type dockerTransport struct{}
+
+func (dockerTransport) Name() string {
+	return "docker"
+}
+
+func (t dockerTransport) SourceReference(location, repository, tag string) (types.ImageReference, error) {
+	return t.reference(location, repository, tag)
+}
+
+func (t dockerTransport) TargetReference(location, repository, tag string) (types.ImageReference, error) {
+	return t.reference(location, repository, tag)
+}
+
+func (dockerTransport) reference(registry, repository, tag string) (types.ImageReference, error) {
+	if utils.CheckIfIncludeTag(repository) {
+		return nil, fmt.Errorf("repository string should not include tag")
+	}
+
+	// tag may be empty
+	tagWithColon := ""
+	if tag != "" {
+		tagWithColon = ":" + tag
+	}
+
+	// if tag is empty, will attach to the "latest" tag
+	return docker.ParseReference("//" + registry + "/" + repository + tagWithColon)
+}
+
+func (t dockerTransport) RepoTags(ctx context.Context, sysctx *types.SystemContext, location, repository string) ([]string, error) {
+	ref, err := t.reference(location, repository, "")
+	if err != nil {
+		return nil, err
+	}
+	return docker.GetRepositoryTags(ctx, sysctx, ref)
+}
+
+func (dockerTransport) ImageDigest(ctx context.Context, sysctx *types.SystemContext, ref types.ImageReference) (digest.Digest, error) {
+	return docker.GetDigest(ctx, sysctx, ref)
+}
+
+func (dockerTransport) BundleIndexPath(location string) string {
+	return ""
+}
+
+// deleteManifest deletes the manifest with manifestDigest from repository of a registry through the
+// registry API, every tag referring to the manifest is deleted along with it
+func deleteManifest(ctx context.Context, sysctx *types.SystemContext, registry, repository string, manifestDigest digest.Digest) error {
+	ref, err := docker.ParseReference("//" + registry + "/" + repository + "@" + manifestDigest.String())
+	if err != nil {
+		return err
+	}
+	return ref.DeleteImage(ctx, sysctx)
+}
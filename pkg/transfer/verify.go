@@ -0,0 +1,87 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+package transfer
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// verifyingReader hashes and counts a blob as it flows from the source to the target, the read
+// reaching the end of the blob fails if the blob does not match the digest or size of its manifest,
+// so that the upload is aborted before the target stores it
+type verifyingReader struct {
+	blob     io.ReadCloser
+	blobInfo types.BlobInfo
+	digester digest.Digester
+	size     int64
+	err      error
+}
+
+// NewVerifyingReader wraps blob to verify it against blobInfo of the manifest, the size is not
+// verified if it is unknown
+func NewVerifyingReader(blob io.ReadCloser, blobInfo types.BlobInfo) (io.ReadCloser, error) {
+	if err := blobInfo.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest of blob %s: %v", blobInfo.Digest, err)
+	}
+	return &verifyingReader{
+		blob:     blob,
+		blobInfo: blobInfo,
+		digester: blobInfo.Digest.Algorithm().Digester(),
+	}, nil
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n, err := r.blob.Read(p)
+	r.digester.Hash().Write(p[:n])
+	r.size += int64(n)
+
+	if r.blobInfo.Size >= 0 && r.size > r.blobInfo.Size {
+		r.err = fmt.Errorf("blob %s is corrupt: more than %d bytes are read", r.blobInfo.Digest, r.blobInfo.Size)
+		return n, r.err
+	}
+	if err == io.EOF {
+		if verifyErr := r.verify(); verifyErr != nil {
+			r.err = verifyErr
+			return n, verifyErr
+		}
+	}
+	return n, err
+}
+
+// verify checks the blob which has been read completely
+func (r *verifyingReader) verify() error {
+	if r.blobInfo.Size >= 0 && r.size != r.blobInfo.Size {
+		return fmt.Errorf("blob %s is corrupt: %d bytes are read, expected %d", r.blobInfo.Digest, r.size, r.blobInfo.Size)
+	}
+	if computed := r.digester.Digest(); computed != r.blobInfo.Digest {
+		return fmt.Errorf("blob %s is corrupt: computed digest %s", r.blobInfo.Digest, computed)
+	}
+	return nil
+}
+
+func (r *verifyingReader) Close() error {
+	return r.blob.Close()
+}
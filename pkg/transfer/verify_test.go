@@ -0,0 +1,117 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package transfer
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	blob := "layer content of a blob"
+	blobDigest := digest.FromString(blob)
+
+	tests := []struct {
+		name     string
+		blob     string
+		blobInfo types.BlobInfo
+		wantErr  string
+	}{
+		{name: "matching", blob: blob, blobInfo: types.BlobInfo{Digest: blobDigest, Size: int64(len(blob))}},
+		{name: "unknown size", blob: blob, blobInfo: types.BlobInfo{Digest: blobDigest, Size: -1}},
+		{
+			name: "sha512", blob: blob,
+			blobInfo: types.BlobInfo{Digest: digest.SHA512.FromString(blob), Size: int64(len(blob))},
+		},
+		{name: "empty", blob: "", blobInfo: types.BlobInfo{Digest: digest.FromString(""), Size: 0}},
+		{
+			name: "too short", blob: blob[:10],
+			blobInfo: types.BlobInfo{Digest: blobDigest, Size: int64(len(blob))},
+			wantErr:  "10 bytes are read, expected 23",
+		},
+		{
+			name: "too long", blob: blob + " and more",
+			blobInfo: types.BlobInfo{Digest: blobDigest, Size: int64(len(blob))},
+			wantErr:  "more than 23 bytes are read",
+		},
+		{
+			name: "digest mismatch", blob: strings.ToUpper(blob),
+			blobInfo: types.BlobInfo{Digest: blobDigest, Size: int64(len(blob))},
+			wantErr:  "computed digest " + digest.FromString(strings.ToUpper(blob)).String(),
+		},
+		{
+			name: "digest mismatch of unknown size", blob: blob[:10],
+			blobInfo: types.BlobInfo{Digest: blobDigest, Size: -1},
+			wantErr:  "computed digest",
+		},
+	}
+
+	readers := map[string]func(io.Reader) io.Reader{
+		"whole":              func(r io.Reader) io.Reader { return r },
+		"one byte":           iotest.OneByteReader,
+		"eof with last data": iotest.DataErrReader,
+	}
+
+	for _, test := range tests {
+		for readerName, reader := range readers {
+			t.Run(test.name+"/"+readerName, func(t *testing.T) {
+				r, err := NewVerifyingReader(ioutil.NopCloser(reader(strings.NewReader(test.blob))), test.blobInfo)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer r.Close()
+
+				data, err := ioutil.ReadAll(r)
+				if test.wantErr == "" {
+					if err != nil {
+						t.Fatal(err)
+					}
+					if string(data) != test.blob {
+						t.Errorf("read %q, want %q", data, test.blob)
+					}
+					return
+				}
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				if !strings.Contains(err.Error(), "blob "+blobDigest.String()+" is corrupt") {
+					t.Errorf("error %v does not name the blob", err)
+				}
+				// the error sticks, a retried read does not see a clean end of the blob
+				if _, again := r.Read(make([]byte, 8)); again != err {
+					t.Errorf("read after the error returned %v", again)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyingReaderInvalidDigest(t *testing.T) {
+	for _, d := range []digest.Digest{"", "sha256:xyz", "md5:d41d8cd98f00b204e9800998ecf8427e"} {
+		if _, err := NewVerifyingReader(ioutil.NopCloser(strings.NewReader("")), types.BlobInfo{Digest: d, Size: -1}); err == nil {
+			t.Errorf("digest %q accepted", d)
+		}
+	}
+}
@@ -1,13 +1,13 @@
 package utils
 
 import (
-	"encoding/base64"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"io"
+	"go.uber.org/zap/zapcore"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 	"tkestack.io/image-transfer/pkg/log"
 )
@@ -26,123 +26,151 @@ func ClearLogFile(logFilePath string) error {
 	return nil
 }
 
+// LogWSClearMessage 是日志被清空时 websocket 推送的消息，日志行总是以时间或 { 开头，不会与之混淆
+const LogWSClearMessage = "[logs cleared]"
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true // 允许所有来源
 	},
 }
 
-// 全局通道，用于通知日志清空
-var logCleared = make(chan struct{}, 1)
+// logFilter 根据查询参数 level 与 job 选择推送的日志，默认推送全部日志
+func logFilter(c *gin.Context) (log.Filter, error) {
+	filter := log.Filter{Level: zapcore.DebugLevel, JobID: c.Query("job")}
+	if level := c.Query("level"); level != "" {
+		if err := filter.Level.UnmarshalText([]byte(level)); err != nil {
+			return filter, fmt.Errorf("invalid log level %q", level)
+		}
+	}
+	return filter, nil
+}
+
+// subscribeLogs 订阅实时日志，带有 Last-Event-ID 时同时返回断开期间的日志
+func subscribeLogs(c *gin.Context, filter log.Filter) (*log.Subscription, []log.Entry) {
+	if id, ok := lastEventSeq(c); ok {
+		return log.Resume(filter, id)
+	}
+	return log.Subscribe(filter), nil
+}
 
-// WebSocket 处理程序
+// WebSocket 处理程序，每条日志是一个文本消息，日志被清空时发送 LogWSClearMessage，
+// 客户端接收过慢而丢弃日志时发送丢弃的条数
 func LogWSHandler(c *gin.Context) {
+	filter, err := logFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Error(fmt.Sprintf("Failed to upgrade connection: %v", err))
 		return
 	}
 	defer conn.Close()
+	subscription, missed := subscribeLogs(c, filter)
+	defer subscription.Close()
+
+	// 客户端只会关闭连接
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
 
-	// 打开日志文件
-	logFile, err := os.Open("./logs/app.log")
-	if err != nil {
-		log.Error(fmt.Sprintf("Failed to open log file: %v", err))
-		return
+	send := func(entry log.Entry) error {
+		if entry.Cleared {
+			return conn.WriteMessage(websocket.TextMessage, []byte(LogWSClearMessage))
+		}
+		return conn.WriteMessage(websocket.TextMessage, []byte(entry.Line))
 	}
-	defer logFile.Close()
-
-	// 初始时移动到日志文件末尾
-	_, err = logFile.Seek(0, io.SeekEnd)
-	if err != nil {
-		log.Error(fmt.Sprintf("Failed to seek to end of log file: %v", err))
-		return
+	for _, entry := range missed {
+		if err := send(entry); err != nil {
+			return
+		}
 	}
-
-	buf := make([]byte, 1024)
+	var dropped uint64
 	for {
 		select {
-		case <-logCleared:
-			// 如果日志被清空，重置文件指针
-			logFile.Close()
-			logFile, err = os.Open("./logs/app.log") // 重新打开日志文件
-			if err != nil {
-				log.Error(fmt.Sprintf("Failed to open log file after clearing: %v", err))
+		case <-closed:
+			return
+		case entry := <-subscription.C:
+			if err := send(entry); err != nil {
 				return
 			}
-			_, err = logFile.Seek(0, io.SeekEnd) // 移动到文件末尾
-			if err != nil {
-				log.Error(fmt.Sprintf("Failed to seek to end of log file after clearing: %v", err))
+		}
+		if n := subscription.Dropped(); n > dropped {
+			message := fmt.Sprintf("%d log entries dropped", n-dropped)
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
 				return
 			}
-		default:
-			n, err := logFile.Read(buf)
-			if err != nil {
-				if err == io.EOF {
-					time.Sleep(1 * time.Second) // 等待新的日志条目
-					continue
-				}
-				log.Error(fmt.Sprintf("Error reading log file: %v", err))
-				break
-			}
-
-			if n > 0 {
-				if err := conn.WriteMessage(websocket.TextMessage, buf[:n]); err != nil {
-					log.Error(fmt.Sprintf("Failed to write message: %v", err))
-					break
-				}
-			}
+			dropped = n
 		}
 	}
 }
 
-func ClearLogHandler(c *gin.Context) {
-	logFilePath := "./logs/app.log"
-
-	// 清空日志文件
-	err := ClearLogFile(logFilePath)
+// LogSSEHandler 以 Server-Sent Events 推送日志，每条日志是一个 log 事件，日志被清空时推送 clear 事件，
+// 客户端接收过慢而丢弃日志时推送 dropped 事件，重连时根据 Last-Event-ID 补齐断开期间的日志
+func LogSSEHandler(c *gin.Context) {
+	filter, err := logFilter(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear log file"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	// 通知 WebSocket 处理程序日志已被清空
-	select {
-	case logCleared <- struct{}{}: // 发送日志清空信号
-	default: // 如果通道满，什么都不做
+	subscription, missed := subscribeLogs(c, filter)
+	defer subscription.Close()
+	StartSSE(c)
+
+	send := func(entry log.Entry) error {
+		id := strconv.FormatUint(entry.ID, 10)
+		if entry.Cleared {
+			return WriteSSE(c, id, "clear", "")
+		}
+		return WriteSSE(c, id, "log", entry.Line)
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Log file cleared successfully"})
-}
-
-func BasicAuth(username, password string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		auth := c.Request.Header.Get("Authorization")
-		if auth == "" {
-			c.Header("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
-			c.AbortWithStatus(http.StatusUnauthorized)
+	for _, entry := range missed {
+		if err := send(entry); err != nil {
 			return
 		}
-
-		const prefix = "Basic "
-		if len(auth) <= len(prefix) || auth[:len(prefix)] != prefix {
-			c.Header("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
-			c.AbortWithStatus(http.StatusUnauthorized)
+	}
+	keepAlive := time.NewTicker(SSEKeepAlive)
+	defer keepAlive.Stop()
+	var dropped uint64
+	for {
+		select {
+		case <-c.Request.Context().Done():
 			return
+		case <-keepAlive.C:
+			if err := WriteSSEComment(c, "keep-alive"); err != nil {
+				return
+			}
+		case entry := <-subscription.C:
+			if err := send(entry); err != nil {
+				return
+			}
 		}
-
-		payload, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
-		if err != nil {
-			c.Header("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
-			c.AbortWithStatus(http.StatusUnauthorized)
-			return
+		if n := subscription.Dropped(); n > dropped {
+			if err := WriteSSE(c, "", "dropped", strconv.FormatUint(n-dropped, 10)); err != nil {
+				return
+			}
+			dropped = n
 		}
+	}
+}
 
-		pair := string(payload)
-		if pair != username+":"+password {
-			c.Header("WWW-Authenticate", "Basic realm=\"Authorization Required\"")
-			c.AbortWithStatus(http.StatusUnauthorized)
+func ClearLogHandler(c *gin.Context) {
+	// 通知所有实时日志的订阅者日志已被清空，再清空日志文件
+	log.ClearEntries()
+	for _, logFilePath := range log.OutputFiles() {
+		if err := ClearLogFile(logFilePath); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear log file"})
 			return
 		}
 	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Log file cleared successfully"})
 }
@@ -0,0 +1,85 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package utils
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/spf13/pflag"
+	"tkestack.io/image-transfer/pkg/log"
+)
+
+func TestMain(m *testing.M) {
+	// keep the logs out of the package directory
+	pflag.Set(log.OutputPathsName, "stderr")
+	gin.SetMode(gin.TestMode)
+	os.Exit(m.Run())
+}
+
+func TestLogWSHandlerClear(t *testing.T) {
+	router := gin.New()
+	router.GET("/ws/logs", LogWSHandler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws/logs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	// the handler subscribes after the upgrade, log until a line comes through
+	received := make(chan string, 100)
+	go func() {
+		defer close(received)
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- string(message)
+		}
+	}()
+	for subscribed := false; !subscribed; {
+		log.Info("Ping live logs")
+		select {
+		case message, ok := <-received:
+			if !ok {
+				t.Fatal("connection closed")
+			}
+			subscribed = strings.Contains(message, "Ping live logs")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	log.ClearEntries()
+	for message := range received {
+		if message == LogWSClearMessage {
+			return
+		}
+	}
+	t.Fatal("no clear message")
+}
@@ -0,0 +1,87 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package utils
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SSEKeepAlive is how often an idle event stream sends a comment, so that proxies keep it open
+const SSEKeepAlive = 15 * time.Second
+
+// StartSSE writes the headers of a server-sent event stream
+func StartSSE(c *gin.Context) {
+	header := c.Writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	// proxies like nginx buffer the response otherwise
+	header.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+}
+
+// WriteSSE writes an event to a server-sent event stream, id and eventType may be empty
+func WriteSSE(c *gin.Context, id, eventType, data string) error {
+	var event strings.Builder
+	if id != "" {
+		event.WriteString("id: " + id + "\n")
+	}
+	if eventType != "" {
+		event.WriteString("event: " + eventType + "\n")
+	}
+	for _, line := range strings.Split(data, "\n") {
+		event.WriteString("data: " + line + "\n")
+	}
+	event.WriteString("\n")
+	if _, err := c.Writer.WriteString(event.String()); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+// WriteSSEComment writes a comment ignored by the clients to a server-sent event stream
+func WriteSSEComment(c *gin.Context, comment string) error {
+	if _, err := c.Writer.WriteString(": " + comment + "\n\n"); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+// LastEventID returns the ID of the last event a client has received, sent by a reconnecting
+// EventSource as the Last-Event-ID header or given as the lastEventId query parameter
+func LastEventID(c *gin.Context) string {
+	if id := c.GetHeader("Last-Event-ID"); id != "" {
+		return id
+	}
+	return c.Query("lastEventId")
+}
+
+// lastEventSeq parses the last event ID of a client of a Broadcaster, false if it has none
+func lastEventSeq(c *gin.Context) (uint64, bool) {
+	id, err := strconv.ParseUint(LastEventID(c), 10, 64)
+	return id, err == nil
+}
@@ -0,0 +1,81 @@
+/*
+ * Tencent is pleased to support the open source community by making TKEStack
+ * available.
+ *
+ * Copyright (C) 2012-2020 Tencent. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+ * this file except in compliance with the License. You may obtain a copy of the
+ * License at
+ *
+ * https://opensource.org/licenses/Apache-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+ * WARRANTIES OF ANY KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations under the License.
+ */
+
+package utils
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// TargetFields are the fields of a source image a target template is rendered with,
+// e.g. registry.b/platform/teamx-{{.Repo}}:{{.Tag}}-mirror
+type TargetFields struct {
+	Registry  string
+	Namespace string
+	Repo      string
+	Tag       string
+}
+
+// targetFuncs are the functions a target template can call besides the text/template builtins
+var targetFuncs = template.FuncMap{
+	// replace rewrites s with a regular expression, repl can refer to the capture groups like $1
+	"replace": func(s, pattern, repl string) (string, error) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return "", err
+		}
+		return re.ReplaceAllString(s, repl), nil
+	},
+	"trimPrefix": strings.TrimPrefix,
+	"trimSuffix": strings.TrimSuffix,
+	"lower":      strings.ToLower,
+}
+
+// IsTargetTemplate checks if a rule target is a template rendered for every source image
+func IsTargetTemplate(target string) bool {
+	return strings.Contains(target, "{{")
+}
+
+// IsWildcardSource checks if a rule source names its repositories with a pattern matched against
+// the catalog of the registry, like registry.a/teamx/*, * does not match /
+func IsWildcardSource(source string) bool {
+	source = strings.TrimPrefix(source, DockerScheme)
+	return !IsArchiveURL(source) && strings.ContainsAny(source, "*?[")
+}
+
+// RenderTarget renders a target template for the image of url with tag
+func RenderTarget(target string, url *RepoURL, tag string) (string, error) {
+	tmpl, err := template.New("target").Funcs(targetFuncs).Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, TargetFields{
+		Registry:  url.GetRegistry(),
+		Namespace: url.GetNamespace(),
+		Repo:      url.GetRepo(),
+		Tag:       tag,
+	}); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
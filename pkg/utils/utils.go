@@ -23,7 +23,23 @@ import (
 	"strings"
 )
 
+// DockerScheme is the optional url scheme of an image in a registry, e.g. docker://registry/ns/repo:tag
+const DockerScheme = "docker://"
+
+// archiveSchemes are the url schemes of the transports storing images in local files instead of a
+// registry, e.g. "oci" for oci:/path/dir:name, they are registered by the transports
+var archiveSchemes []string
+
+// RegisterArchiveScheme makes urls of scheme refer to images stored in local files
+func RegisterArchiveScheme(scheme string) {
+	if !IsContain(archiveSchemes, scheme) {
+		archiveSchemes = append(archiveSchemes, scheme)
+	}
+}
+
 // The RepoURL will divide a images url to <registry>/<namespace>/<repo>:<tag>
+// For an archive url <location>:<name>:<tag>, the registry is the archive location
+// and the repo is the image name inside the archive.
 type RepoURL struct {
 	// origin url
 	url string
@@ -32,10 +48,28 @@ type RepoURL struct {
 	namespace string
 	repo      string
 	tag       string
+	archive   bool
 }
 
 // NewRepoURL creates a RepoURL
 func NewRepoURL(url string) (*RepoURL, error) {
+	url = strings.TrimPrefix(url, DockerScheme)
+
+	if IsArchiveURL(url) {
+		location, name := ParseArchiveURL(url)
+		if name == "" {
+			return nil, fmt.Errorf("image name should not be empty in archive url: %v", url)
+		}
+		repo, tag := SplitArchiveName(name)
+		return &RepoURL{
+			url:      url,
+			registry: location,
+			repo:     repo,
+			tag:      tag,
+			archive:  true,
+		}, nil
+	}
+
 	// split to registry/namespace/repoAndTag
 	slice := strings.SplitN(url, "/", 3)
 
@@ -140,14 +174,67 @@ func (r *RepoURL) GetRepoWithTag() string {
 	return r.repo + ":" + r.tag
 }
 
+// IsArchive checks if the url refers to an image inside an OCI layout or docker-archive
+func (r *RepoURL) IsArchive() bool {
+	return r.archive
+}
+
 // GetURLWithoutTag returns registry/namespace/repository in a url
 func (r *RepoURL) GetURLWithoutTag() string {
+	if r.archive {
+		return r.registry + ":" + r.repo
+	}
 	if r.namespace == "" {
 		return r.registry + "/" + r.repo
 	}
 	return r.registry + "/" + r.namespace + "/" + r.repo
 }
 
+// IsArchiveURL checks if url refers to images stored in local files, like an OCI layout or a
+// docker-archive, instead of a registry
+func IsArchiveURL(url string) bool {
+	return archiveScheme(url) != ""
+}
+
+// archiveScheme returns the scheme of an archive url, it is empty for a registry url
+func archiveScheme(url string) string {
+	for _, scheme := range archiveSchemes {
+		if strings.HasPrefix(url, scheme+":") {
+			return scheme
+		}
+	}
+	return ""
+}
+
+// ParseArchiveURL splits an archive url like oci:/path/dir:name into its location
+// oci:/path/dir and the image name inside it, the name may be empty
+func ParseArchiveURL(url string) (string, string) {
+	prefix := archiveScheme(url) + ":"
+
+	path := strings.TrimPrefix(url, prefix)
+	name := ""
+	if sep := strings.Index(path, ":"); sep != -1 {
+		name = path[sep+1:]
+		path = path[:sep]
+	}
+	return prefix + path, name
+}
+
+// SplitArchiveLocation splits an archive location like oci:/path/dir into the scheme oci and the path
+func SplitArchiveLocation(location string) (string, string) {
+	scheme := archiveScheme(location)
+	return scheme, strings.TrimPrefix(location, scheme+":")
+}
+
+// SplitArchiveName splits an image name inside an archive to repository and tag
+func SplitArchiveName(name string) (string, string) {
+	sep := strings.LastIndex(name, ":")
+	if sep == -1 || sep < strings.LastIndex(name, "/") {
+		return name, ""
+	}
+	return name[:sep], name[sep+1:]
+}
+
 // CheckIfIncludeTag checks if a repository string includes tag
 func CheckIfIncludeTag(repository string) bool {
 	return strings.Contains(repository, ":")